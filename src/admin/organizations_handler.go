@@ -124,7 +124,10 @@ func (h *OrganizationsHandler) Update(c echo.Context, org *models.Organization)
 	if err := c.Bind(org); err != nil {
 		return err
 	}
-	err := org.Update(ctx)
+	err := org.ValidateLabelsOfPipelines(ctx)
+	if err == nil {
+		err = org.Update(ctx)
+	}
 	if err != nil {
 		log.Errorf(ctx, "Failed to update Organization: %v because of %v\n", org, err)
 		r := &ResOrgsEdit{
@@ -12,8 +12,34 @@ import (
 
 const (
 	AUTH_HEADER = "Authorization"
+
+	// App Engine sets these headers to the requests from cron and task queues
+	// and removes them from the requests from outside.
+	APPENGINE_CRON_HEADER       = "X-Appengine-Cron"
+	APPENGINE_QUEUE_NAME_HEADER = "X-Appengine-Queuename"
+	APPENGINE_TASK_NAME_HEADER  = "X-Appengine-Taskname"
 )
 
+// isAppEngineInternal returns true if the request comes from cron or task queues of App Engine.
+func isAppEngineInternal(req *http.Request) bool {
+	return req.Header.Get(APPENGINE_CRON_HEADER) == "true" || req.Header.Get(APPENGINE_QUEUE_NAME_HEADER) != ""
+}
+
+// isAppEngineTask returns true if the request comes from task queues of App Engine.
+func isAppEngineTask(req *http.Request) bool {
+	return req.Header.Get(APPENGINE_QUEUE_NAME_HEADER) != ""
+}
+
+// withAppEngineInternal accepts only the requests from cron or task queues of App Engine.
+func withAppEngineInternal(impl func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if !isAppEngineInternal(c.Request()) {
+			return c.JSON(http.StatusForbidden, map[string]string{"message": "Forbidden"})
+		}
+		return impl(c)
+	}
+}
+
 func withAuth(impl func(c echo.Context) error) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		ctx := c.Get("aecontext").(context.Context)
@@ -35,3 +61,17 @@ func withAuth(impl func(c echo.Context) error) func(c echo.Context) error {
 		return impl(c)
 	}
 }
+
+// withTaskAuth is withAuth for the routes of tasks. It also accepts the tasks without token
+// because the tasks posted by a scheduled run have no token to forward since the server
+// can't restore the token of the organization.
+func withTaskAuth(impl func(c echo.Context) error) func(c echo.Context) error {
+	auth := withAuth(impl)
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Header.Get(AUTH_HEADER) == "" && isAppEngineTask(req) {
+			return impl(c)
+		}
+		return auth(c)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	pubsub "google.golang.org/api/pubsub/v1"
 )
@@ -10,6 +11,14 @@ type DummyPublisher struct {
 	ResultMessageId string
 }
 
-func (p *DummyPublisher) Publish(ctx context.Context, topic string, req *pubsub.PublishRequest) (string, error) {
-	return p.ResultMessageId, nil
+func (p *DummyPublisher) Publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) ([]string, error) {
+	msgIds := []string{}
+	for i := range msgs {
+		if i == 0 {
+			msgIds = append(msgIds, p.ResultMessageId)
+		} else {
+			msgIds = append(msgIds, fmt.Sprintf("%s-%d", p.ResultMessageId, i))
+		}
+	}
+	return msgIds, nil
 }
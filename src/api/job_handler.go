@@ -2,8 +2,11 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo"
@@ -28,6 +31,11 @@ func (h *JobHandler) member(action echo.HandlerFunc) echo.HandlerFunc {
 	return gae_support.With(jobBy(h.job_id_name, http.StatusNotFound, JobToPl(PlToOrg(withAuth(action)))))
 }
 
+// task is for the routes of tasks which accept the tasks without token.
+func (h *JobHandler) task(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(jobBy(h.job_id_name, http.StatusNotFound, JobToPl(PlToOrg(withTaskAuth(action)))))
+}
+
 // curl -v -X POST http://localhost:8080/pipelines/3/jobs --data '{"id":"2","name":"akm"}' -H 'Content-Type: application/json'
 func (h *JobHandler) create(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
@@ -42,28 +50,18 @@ func (h *JobHandler) create(c echo.Context) error {
 	job.Pipeline = pl
 	job.InitStatus(c.QueryParam("ready") == "true")
 
-	switch pl.Status {
-	case models.HibernationChecking:
-		pl.PullingTaskSize = 1
-		err := pl.BackToBeOpened(ctx)
-		if err != nil {
-			return err
-		}
-		err = PostPipelineTask(c, "subscribe_task", pl)
-		if err != nil {
-			return err
-		}
-	case models.Hibernating:
-		err := pl.BackToBeReserved(ctx)
-		if err != nil {
-			return err
-		}
-		err = PostPipelineTask(c, "build_task", pl)
-		if err != nil {
-			return err
+	if err := job.ResolveDependency(ctx); err != nil {
+		if _, ok := err.(*models.InvalidDependency); ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 		}
+		return err
 	}
-	err := job.CreateAndPublishIfPossible(ctx)
+
+	err := h.WakeUpPipelineIfNeeded(c, ctx, pl)
+	if err != nil {
+		return err
+	}
+	err = job.CreateAndPublishIfPossible(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Failed to create Job: %v\n%v\n", job, err)
 		return err
@@ -81,17 +79,108 @@ func (h *JobHandler) create(c echo.Context) error {
 	return c.JSON(http.StatusCreated, job)
 }
 
+// index lists the jobs by the pages of models.MaxJobSearchLimit unless limit is given.
 // curl -v http://localhost:8080/pipelines/3/jobs
+// curl -v 'http://localhost:8080/pipelines/3/jobs?status=Ready&created_after=2018-01-01T00:00:00Z&limit=100&fields=id_by_client,status'
+// curl -v 'http://localhost:8080/pipelines/3/jobs?id_by_client=job-1&limit=100&cursor=<X-Next-Cursor of the previous response>'
 func (h *JobHandler) index(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	pl := c.Get("pipeline").(*models.Pipeline)
-	jobs, err := pl.JobAccessor().All(ctx)
+	cond, err := h.jobSearchCondition(c)
 	if err != nil {
-		return err
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	jobs, cursor, err := pl.JobAccessor().Search(ctx, cond)
+	if err != nil {
+		switch err.(type) {
+		case *models.InvalidSearchCondition:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		default:
+			return err
+		}
+	}
+	if cursor != "" {
+		c.Response().Header().Set(NextCursorHeader, cursor)
+	}
+	// Only the whole list in a page without limit is sorted by priority.
+	// The pages keep the order of the query, CreatedAt or id_by_client,
+	// so that the cursor continues from the last job of the page.
+	if c.QueryParam("limit") == "" && cursor == "" && cond.Cursor == "" {
+		jobs.SortByPriority()
+	}
+	if len(cond.Fields) > 0 {
+		res, err := projectJobs(jobs, cond.Fields)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, res)
 	}
 	return c.JSON(http.StatusOK, jobs)
 }
 
+const NextCursorHeader = "X-Next-Cursor"
+
+func (h *JobHandler) jobSearchCondition(c echo.Context) (*models.JobSearchCondition, error) {
+	cond := &models.JobSearchCondition{
+		IdByClientPrefix: c.QueryParam("id_by_client"),
+		Cursor:           c.QueryParam("cursor"),
+	}
+	if v := c.QueryParam("status"); v != "" {
+		st, err := models.ParseJobStatus(v)
+		if err != nil {
+			return nil, err
+		}
+		cond.Status = &st
+	}
+	for name, dest := range map[string]*time.Time{
+		"created_after":  &cond.CreatedAfter,
+		"created_before": &cond.CreatedBefore,
+	} {
+		if v := c.QueryParam(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*dest = t
+		}
+	}
+	// The jobs are listed by the pages of MaxJobSearchLimit without limit
+	cond.Limit = models.MaxJobSearchLimit
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("Invalid limit: %q", v)
+		}
+		cond.Limit = limit
+	}
+	if v := c.QueryParam("fields"); v != "" {
+		cond.Fields = strings.Split(v, ",")
+	}
+	return cond, nil
+}
+
+// projectJobs returns the maps which have only the id and the given fields of the jobs.
+func projectJobs(jobs models.Jobs, fields []string) ([]map[string]interface{}, error) {
+	res := []map[string]interface{}{}
+	for _, job := range jobs {
+		b, err := json.Marshal(job)
+		if err != nil {
+			return nil, err
+		}
+		all := map[string]interface{}{}
+		err = json.Unmarshal(b, &all)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{"id": job.ID}
+		for _, f := range fields {
+			m[f] = all[f]
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
 type BulkGetJobsPayload struct {
 	JobIds []string `json:"job_ids"`
 }
@@ -188,6 +277,41 @@ func (h *JobHandler) show(c echo.Context) error {
 	return c.JSON(http.StatusOK, job)
 }
 
+// curl -v http://localhost:8080/jobs/1/output
+func (h *JobHandler) output(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	job := c.Get("job").(*models.Job)
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	err := job.WriteOutputTo(ctx, models.CurrentOutputStore(ctx), res)
+	if err != nil {
+		// The status has already been sent, so just log the error.
+		log.Errorf(ctx, "Failed to write the output of job %v because of %v\n", job.ID, err)
+	}
+	return nil
+}
+
+type JobEventsMediaType struct {
+	Events        models.JobEvents          `json:"events"`
+	StepDurations []*models.JobStepDuration `json:"step_durations"`
+}
+
+// curl -v http://localhost:8080/jobs/1/events
+func (h *JobHandler) events(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	job := c.Get("job").(*models.Job)
+	events, err := job.Events(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get events of job %v because of %v\n", job.ID, err)
+		return err
+	}
+	return c.JSON(http.StatusOK, &JobEventsMediaType{
+		Events:        events,
+		StepDurations: events.StepDurations(),
+	})
+}
+
 // curl -v http://localhost:8080/jobs/1/getready
 func (h *JobHandler) getReady(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
@@ -209,6 +333,27 @@ func (h *JobHandler) getReady(c echo.Context) error {
 	return c.JSON(http.StatusOK, job)
 }
 
+// WakeUpPipelineIfNeeded makes the pipeline which is hibernating or
+// going to hibernate open again to process new jobs.
+func (h *JobHandler) WakeUpPipelineIfNeeded(c echo.Context, ctx context.Context, pl *models.Pipeline) error {
+	switch pl.Status {
+	case models.HibernationChecking:
+		pl.PullingTaskSize = 1
+		err := pl.BackToBeOpened(ctx)
+		if err != nil {
+			return err
+		}
+		return PostPipelineTask(c, "subscribe_task", pl)
+	case models.Hibernating:
+		err := pl.BackToBeReserved(ctx)
+		if err != nil {
+			return err
+		}
+		return PostPipelineTask(c, "build_task", pl)
+	}
+	return nil
+}
+
 func (h *JobHandler) StartToWaitAndPublishIfNeeded(c echo.Context, job *models.Job) error {
 	if job.Status != models.Ready {
 		return nil
@@ -233,6 +378,11 @@ func (h *JobHandler) WaitToPublishTask(c echo.Context) error {
 	started := time.Now()
 	pl := c.Get("pipeline").(*models.Pipeline)
 	job := c.Get("job").(*models.Job)
+	if job.Status != models.Ready {
+		ctx := c.Get("aecontext").(context.Context)
+		log.Infof(ctx, "Quit wait_task because the job %v is %v\n", job.ID, job.Status)
+		return c.JSON(http.StatusOK, job)
+	}
 	switch {
 	case models.StatusesOpened.Include(pl.Status):
 		err := h.PostJobTask(c, job, "publish_task", started)
@@ -249,10 +399,36 @@ func (h *JobHandler) WaitToPublishTask(c echo.Context) error {
 	}
 }
 
+const PublishDeferInterval = 5 * time.Second
+
 // curl -v http://localhost:8080/jobs/1/publish_task
 func (h *JobHandler) PublishTask(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	job := c.Get("job").(*models.Job)
+	if job.Status == models.Ready {
+		pl := c.Get("pipeline").(*models.Pipeline)
+		if models.StatusesPaused.Include(pl.Status) {
+			log.Infof(ctx, "Hold job %v in Ready because the pipeline is %v\n", job.ID, pl.Status)
+			err := h.PostJobTask(c, job, "wait_task", time.Now().Add(30*time.Second))
+			if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusAccepted, job)
+		}
+		// Let the jobs with higher priority be published first
+		deferred, err := pl.JobAccessor().HasWaitingJobPrioritizedOver(ctx, job)
+		if err != nil {
+			return err
+		}
+		if deferred {
+			log.Infof(ctx, "Defer publishing job %v because of the jobs with higher priority than %d\n", job.ID, job.Priority)
+			err := h.PostJobTask(c, job, "publish_task", time.Now().Add(PublishDeferInterval))
+			if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusAccepted, job)
+		}
+	}
 	if job.Status != models.Publishing {
 		job.Status = models.Publishing
 		log.Debugf(ctx, "PublishAndUpdate#1: %v\n", job)
@@ -304,9 +480,41 @@ func (h *JobHandler) IncreaseSubscribeTask(c echo.Context, ctx context.Context,
 func (h *JobHandler) Cancel(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	job := c.Get("job").(*models.Job)
+	job.Pipeline = c.Get("pipeline").(*models.Pipeline)
 	err := job.Cancel(ctx)
 	if err != nil {
 		return err
 	}
+	if job.Status == models.Cancelled {
+		if _, err := PromoteDependentJobs(c, job.Pipeline, models.Jobs{job}); err != nil {
+			return err
+		}
+	} else if job.CancelRequested {
+		// Cancel the job even if the worker never reports CANCELLING
+		if err := h.PostJobTask(c, job, "check_cancel_task", job.CancelRequestExpiresAt()); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// CheckCancelTask makes the CancelRequested job Cancelled after CancelRequestTimeout.
+// curl -v -X POST http://localhost:8080/jobs/1/check_cancel_task
+func (h *JobHandler) CheckCancelTask(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	job := c.Get("job").(*models.Job)
+	job.Pipeline = c.Get("pipeline").(*models.Pipeline)
+	expired, err := job.ExpireCancelRequest(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Failed to expire the cancel request of job %v because of %v\n", job.ID, err)
+		return err
+	}
+	if !expired {
+		log.Infof(ctx, "Quit check_cancel_task because the job %v is %v\n", job.ID, job.Status)
+		return c.JSON(http.StatusOK, job)
+	}
+	if _, err := PromoteDependentJobs(c, job.Pipeline, models.Jobs{job}); err != nil {
+		return err
+	}
 	return c.JSON(http.StatusOK, job)
 }
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+// BulkCreateJobsMediaType has the same shape as BulkGetJobsMediaType.
+// The keys are the line numbers of NDJSON or the 1-origin indexes of JSON array,
+// and the errors are given as messages.
+type BulkCreateJobsMediaType struct {
+	Jobs   map[string]*BulkGetJobsMediaTypeJob `json:"jobs"`
+	Errors map[string]string                   `json:"errors"`
+}
+
+// curl -v -X POST http://localhost:8080/pipelines/3/jobs/bulk?ready=true --data-binary @jobs.ndjson -H 'Content-Type: application/x-ndjson'
+// curl -v -X POST http://localhost:8080/pipelines/3/jobs/bulk --data '[{"id_by_client":"1"},{"id_by_client":"2"}]' -H 'Content-Type: application/json'
+func (h *JobHandler) bulkCreate(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	ready := c.QueryParam("ready") == "true"
+
+	if ready {
+		if !pl.AcceptsReadyJobs() {
+			res := map[string]interface{}{"message": fmt.Sprintf("Can't create and publish jobs to a pipeline which is %v", pl.Status)}
+			return c.JSON(http.StatusNotAcceptable, res)
+		}
+		err := h.WakeUpPipelineIfNeeded(c, ctx, pl)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := &BulkCreateJobsMediaType{
+		Jobs:   map[string]*BulkGetJobsMediaTypeJob{},
+		Errors: map[string]string{},
+	}
+	readyCount := 0
+
+	batch := models.Jobs{}
+	lines := []string{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		errors := pl.CreateJobs(ctx, batch)
+		created := map[string]*models.Job{}
+		for i, job := range batch {
+			if errors[i] != nil {
+				r.Errors[lines[i]] = errors[i].Error()
+				continue
+			}
+			created[lines[i]] = job
+			if job.Status == models.Ready {
+				readyCount++
+			}
+		}
+		for key, job := range h.JobsFromModelToMediaType(created) {
+			r.Jobs[key] = job
+		}
+		batch = models.Jobs{}
+		lines = []string{}
+	}
+
+	line, err := h.eachBulkJobPayload(c.Request().Body, func(line int, job *models.Job, err error) {
+		key := strconv.Itoa(line)
+		if err != nil {
+			r.Errors[key] = err.Error()
+			return
+		}
+		job.InitStatus(ready)
+		if job.HasDependency() {
+			// Create the jobs in the previous lines which it may depend on
+			flush()
+		}
+		batch = append(batch, job)
+		lines = append(lines, key)
+		if len(batch) >= models.CreateJobsBatchSize {
+			flush()
+		}
+	})
+	flush()
+	if err != nil {
+		log.Warningf(ctx, "Quit reading jobs at %d because of %v\n", line, err)
+		r.Errors[strconv.Itoa(line)] = err.Error()
+	}
+	log.Debugf(ctx, "%d jobs created and %d errors\n", len(r.Jobs), len(r.Errors))
+
+	if readyCount > 0 && models.StatusesOpened.Include(pl.Status) {
+		err := PostPipelineTask(c, "publish_task", pl)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
+
+// eachBulkJobPayload calls f with each Job in the JSON array or NDJSON.
+// Invalid jobs are given to f with errors but a syntax error of JSON array quits reading.
+// It returns the line number and the error which quits reading.
+func (h *JobHandler) eachBulkJobPayload(body io.Reader, f func(int, *models.Job, error)) (int, error) {
+	reader := bufio.NewReader(body)
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		if !bytes.Contains([]byte(" \t\r\n"), b) {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	b, _ := reader.Peek(1)
+	if b[0] == '[' {
+		return h.eachJobInJSONArray(reader, f)
+	}
+	return h.eachJobInNDJSON(reader, f)
+}
+
+func (h *JobHandler) eachJobInJSONArray(reader io.Reader, f func(int, *models.Job, error)) (int, error) {
+	dec := json.NewDecoder(reader)
+	if _, err := dec.Token(); err != nil {
+		return 0, err
+	}
+	index := 0
+	for dec.More() {
+		index++
+		job := &models.Job{}
+		if err := dec.Decode(job); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				return index, err
+			}
+			f(index, nil, err)
+			continue
+		}
+		f(index, job, nil)
+	}
+	if _, err := dec.Token(); err != nil {
+		return index, err
+	}
+	return index, nil
+}
+
+func (h *JobHandler) eachJobInNDJSON(reader *bufio.Reader, f func(int, *models.Job, error)) (int, error) {
+	line := 0
+	for {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return line + 1, err
+		}
+		if len(b) > 0 {
+			line++
+			if s := bytes.TrimSpace(b); len(s) > 0 {
+				job := &models.Job{}
+				if err := json.Unmarshal(s, job); err != nil {
+					f(line, nil, err)
+				} else {
+					f(line, job, nil)
+				}
+			}
+		}
+		if err == io.EOF {
+			return line, nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+type DeadLetterMediaType struct {
+	ID            string           `json:"id"`
+	IdByClient    string           `json:"id_by_client"`
+	Status        models.JobStatus `json:"status"`
+	Attempt       int              `json:"attempt"`
+	Zone          string           `json:"zone"`
+	Hostname      string           `json:"hostname"`
+	FailedStep    string           `json:"failed_step"`
+	FailureReason string           `json:"failure_reason"`
+	PublishedAt   time.Time        `json:"published_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+func DeadLetterFromModelToMediaType(job *models.Job) *DeadLetterMediaType {
+	return &DeadLetterMediaType{
+		ID:            job.ID,
+		IdByClient:    job.IdByClient,
+		Status:        job.Status,
+		Attempt:       job.CurrentAttempt(),
+		Zone:          job.Zone,
+		Hostname:      job.Hostname,
+		FailedStep:    job.FailedStep,
+		FailureReason: job.FailureReason,
+		PublishedAt:   job.PublishedAt,
+		CreatedAt:     job.CreatedAt,
+		UpdatedAt:     job.UpdatedAt,
+	}
+}
+
+// curl -v http://localhost:8080/pipelines/3/dead_letters
+func (h *JobHandler) DeadLetters(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	jobs, err := pl.JobAccessor().DeadLetters(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get dead letters of %v because of %v\n", pl.ID, err)
+		return err
+	}
+	r := []*DeadLetterMediaType{}
+	for _, job := range jobs {
+		r = append(r, DeadLetterFromModelToMediaType(job))
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// curl -v -X POST http://localhost:8080/pipelines/3/dead_letters/requeue --data '{"job_ids":["1","2","5"]}' -H 'Content-Type: application/json'
+func (h *JobHandler) RequeueDeadLetters(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	payload := &BulkGetJobsPayload{}
+	if err := c.Bind(payload); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		log.Errorf(ctx, "req: %v\n", c.Request())
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	pl := c.Get("pipeline").(*models.Pipeline)
+
+	if models.StatusesAlreadyClosing.Include(pl.Status) {
+		res := map[string]interface{}{"message": fmt.Sprintf("Can't requeue jobs to a pipeline which is %v", pl.Status)}
+		return c.JSON(http.StatusNotAcceptable, res)
+	}
+
+	accessor := pl.JobAccessor()
+	jobs := map[string]*models.Job{}
+	errors := map[string]error{}
+	for _, jobId := range payload.JobIds {
+		if jobId == "" {
+			continue
+		}
+		var job *models.Job
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			job, err = accessor.Find(ctx, jobId)
+			if err != nil {
+				return err
+			}
+			job.Pipeline = pl
+			if err := job.Requeue(ctx); err != nil {
+				return err
+			}
+			return h.StartToWaitAndPublishIfNeeded(c, job)
+		}, nil)
+		if err != nil {
+			log.Warningf(ctx, "Failed to requeue job %v because of %v\n", jobId, err)
+			errors[jobId] = err
+			continue
+		}
+		jobs[jobId] = job
+	}
+
+	// Don't wake up the hibernating pipeline when no job is requeued
+	if len(jobs) > 0 {
+		if err := h.WakeUpPipelineIfNeeded(c, ctx, pl); err != nil {
+			return err
+		}
+	}
+
+	r := &BulkGetJobsMediaType{
+		Jobs:   h.JobsFromModelToMediaType(jobs),
+		Errors: errors,
+	}
+	return c.JSON(http.StatusOK, r)
+}
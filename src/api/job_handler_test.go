@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -173,6 +174,11 @@ func TestJobHandlerActions(t *testing.T) {
 			"id":           job.ID,
 			"id_by_client": fmt.Sprintf("%s-1", job_id_base),
 			"status":       float64(st),
+			"priority":     float64(0),
+			"depends_on": map[string]interface{}{
+				"condition": float64(0),
+				"job_ids":   nil,
+			},
 			"zone":         "",
 			"hostname":     "",
 			"published_at": "0001-01-01T00:00:00Z",
@@ -184,9 +190,11 @@ func TestJobHandlerActions(t *testing.T) {
 				},
 				"data": "",
 			},
-			"message_id": "",
-			"created_at": job.CreatedAt.Format(time.RFC3339Nano),
-			"updated_at": job.UpdatedAt.Format(time.RFC3339Nano),
+			"message_id":   "",
+			"retry_policy": map[string]interface{}{},
+			"attempt":      float64(1),
+			"created_at":   job.CreatedAt.Format(time.RFC3339Nano),
+			"updated_at":   job.UpdatedAt.Format(time.RFC3339Nano),
 		}, jobRes)
 
 		// Test for invalid POST
@@ -337,7 +345,7 @@ func TestJobHandlerActions(t *testing.T) {
 			models.GlobalPublisher = &DummyPublisher{ResultMessageId: msgId}
 			defer (func() { models.GlobalPublisher = backup })()
 
-			assert.NoError(t, h.member(h.PublishTask)(c))
+			assert.NoError(t, h.task(h.PublishTask)(c))
 			assert.Equal(t, http.StatusOK, rec.Code)
 
 			reloaded, err := models.GlobalJobAccessor.Find(ctx, job.ID)
@@ -347,4 +355,240 @@ func TestJobHandlerActions(t *testing.T) {
 		}
 	}
 
+	// Test for dead_letters
+	deadLetter := &models.Job{
+		Pipeline:      pl1,
+		IdByClient:    fmt.Sprintf("%s-job-dead-letter", pl1.Name),
+		Status:        models.Failure,
+		Hostname:      "host-1",
+		FailedStep:    "EXECUTING",
+		FailureReason: "Failed at EXECUTING on host-1: Something wrong",
+	}
+	err = deadLetter.Create(ctx)
+	assert.NoError(t, err)
+
+	path := "/pipelines/" + pl1.ID + "/dead_letters"
+	req, err = inst.NewRequest(echo.GET, path, nil)
+	assert.NoError(t, err)
+	req.Header.Set(auth_header, token)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetPath(path)
+	c.SetParamNames("pipeline_id")
+	c.SetParamValues(pl1.ID)
+
+	if assert.NoError(t, h.collection(h.DeadLetters)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res []map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(rec.Body.String()), &res))
+		if assert.Equal(t, 1, len(res)) {
+			assert.Equal(t, deadLetter.ID, res[0]["id"])
+			assert.Equal(t, "EXECUTING", res[0]["failed_step"])
+			assert.Equal(t, deadLetter.FailureReason, res[0]["failure_reason"])
+		}
+	}
+
+	// Test for dead_letters/requeue
+	requeuePayload, err := json.Marshal(map[string][]string{
+		"job_ids": []string{deadLetter.ID, "invalid-job-id"},
+	})
+	assert.NoError(t, err)
+
+	path = "/pipelines/" + pl1.ID + "/dead_letters/requeue"
+	req, err = inst.NewRequest(echo.POST, path, strings.NewReader(string(requeuePayload)))
+	assert.NoError(t, err)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(auth_header, token)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetPath(path)
+	c.SetParamNames("pipeline_id")
+	c.SetParamValues(pl1.ID)
+
+	if assert.NoError(t, h.collection(h.RequeueDeadLetters)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res map[string]map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(rec.Body.String()), &res))
+		assert.Equal(t, 1, len(res["jobs"]))
+		assert.NotNil(t, res["jobs"][deadLetter.ID])
+		assert.Equal(t, 1, len(res["errors"]))
+	}
+
+	requeued, err := models.GlobalJobAccessor.Find(ctx, deadLetter.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Ready, requeued.Status)
+	assert.Equal(t, 2, requeued.Attempt)
+	assert.Empty(t, requeued.FailureReason)
+	if assert.Equal(t, 1, len(requeued.AttemptHistory)) {
+		assert.Equal(t, "Failed at EXECUTING on host-1: Something wrong", requeued.AttemptHistory[0].Reason)
+	}
+
+	deadLetters, err := pl1.JobAccessor().DeadLetters(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deadLetters))
+
+	// The hibernating pipeline isn't woken up when no job is requeued
+	pl1.Status = models.Hibernating
+	assert.NoError(t, pl1.Update(ctx))
+	requeuePayload, err = json.Marshal(map[string][]string{
+		"job_ids": []string{"invalid-job-id"},
+	})
+	assert.NoError(t, err)
+	req, err = inst.NewRequest(echo.POST, path, strings.NewReader(string(requeuePayload)))
+	assert.NoError(t, err)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(auth_header, token)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetPath(path)
+	c.SetParamNames("pipeline_id")
+	c.SetParamValues(pl1.ID)
+
+	if assert.NoError(t, h.collection(h.RequeueDeadLetters)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	hibernating, err := models.GlobalPipelineAccessor.Find(ctx, pl1.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Hibernating, hibernating.Status)
+}
+
+func TestJobHandlerBulkCreate(t *testing.T) {
+	handlers := SetupRoutes(echo.New())
+
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	h, ok := handlers["jobs"].(*JobHandler)
+	assert.True(t, ok)
+
+	req, err := inst.NewRequest(echo.GET, "/", nil)
+	assert.NoError(t, err)
+	ctx := appengine.NewContext(req)
+
+	kinds := []string{"Jobs", "Pipelines", "Organizations"}
+	for _, k := range kinds {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &models.Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl1 := &models.Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: models.PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+	}
+	err = pl1.Create(ctx)
+	assert.NoError(t, err)
+
+	existing := &models.Job{
+		Pipeline:   pl1,
+		IdByClient: "existing",
+		Status:     models.Success,
+	}
+	err = existing.Create(ctx)
+	assert.NoError(t, err)
+
+	auth := &models.Auth{Organization: org1}
+	err = auth.Create(ctx)
+	assert.NoError(t, err)
+	token := "Bearer " + auth.Token
+
+	post := func(contentType, body string) map[string]map[string]interface{} {
+		path := "/pipelines/" + pl1.ID + "/jobs/bulk"
+		req, err := inst.NewRequest(echo.POST, path+"?ready=true", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set(echo.HeaderContentType, contentType)
+		req.Header.Set(auth_header, token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath(path)
+		c.SetParamNames("pipeline_id")
+		c.SetParamValues(pl1.ID)
+
+		var res map[string]map[string]interface{}
+		if assert.NoError(t, h.collection(h.bulkCreate)(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.NoError(t, json.Unmarshal([]byte(rec.Body.String()), &res))
+		}
+		return res
+	}
+
+	// NDJSON
+	ndjson := strings.Join([]string{
+		`{"id_by_client":"job-1","priority":1}`,
+		``,
+		`{"id_by_client":"job-2","message":{"attributes":{"foo":"bar"}}}`,
+		`{"id_by_client":"existing"}`,
+		`{"id_by_client":"job-1"}`,
+		`{"id_by_client":"job-3","message":{"attributes":"INVALID"}}`,
+		`{INVALID JSON}`,
+		`{"message":{"attributes":{"foo":"baz"}}}`,
+	}, "\n")
+	res := post("application/x-ndjson", ndjson)
+	assert.Equal(t, []string{"1", "3", "4", "5"}, sortedKeys(res["jobs"]))
+	assert.Equal(t, []string{"6", "7", "8"}, sortedKeys(res["errors"]))
+
+	job1 := res["jobs"]["1"].(map[string]interface{})
+	assert.Equal(t, "job-1", job1["id_by_client"])
+	assert.Equal(t, float64(models.Ready), job1["status"])
+	assert.Equal(t, job1["id"], res["jobs"]["5"].(map[string]interface{})["id"])
+
+	existingRes := res["jobs"]["4"].(map[string]interface{})
+	assert.Equal(t, existing.ID, existingRes["id"])
+	assert.Equal(t, float64(models.Success), existingRes["status"])
+
+	loaded, err := models.GlobalJobAccessor.Find(ctx, job1["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded.Priority)
+	assert.Equal(t, 1, loaded.Attempt)
+
+	jobs, err := pl1.JobAccessor().All(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(jobs))
+
+	// JSON array
+	res = post(echo.MIMEApplicationJSON, `[{"id_by_client":"job-2"}, {"id_by_client":"job-4"}, "INVALID", {"id_by_client":"job-5"} {`)
+	assert.Equal(t, []string{"1", "2", "4"}, sortedKeys(res["jobs"]))
+	assert.Equal(t, []string{"3", "5"}, sortedKeys(res["errors"]))
+
+	jobs, err = pl1.JobAccessor().All(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(jobs))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestJobHandlerJobSearchConditionLimit(t *testing.T) {
+	h := &JobHandler{}
+	for query, expected := range map[string]int{
+		"":                   models.MaxJobSearchLimit,
+		"?status=Ready":      models.MaxJobSearchLimit,
+		"?limit=100":         100,
+		"?limit=100&cursor=": 100,
+	} {
+		req := httptest.NewRequest(echo.GET, "/pipelines/1/jobs"+query, nil)
+		c := e.NewContext(req, httptest.NewRecorder())
+		cond, err := h.jobSearchCondition(c)
+		assert.NoError(t, err, query)
+		assert.Equal(t, expected, cond.Limit, query)
+	}
 }
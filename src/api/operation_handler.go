@@ -29,6 +29,11 @@ func (h *OperationHandler) member(action echo.HandlerFunc) echo.HandlerFunc {
 	return gae_support.With(operationBy(h.operation_id_name, http.StatusNotFound, OperationToPl(PlToOrg(withAuth(action)))))
 }
 
+// task is for the routes of tasks which accept the tasks without token.
+func (h *OperationHandler) task(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(operationBy(h.operation_id_name, http.StatusNotFound, OperationToPl(PlToOrg(withTaskAuth(action)))))
+}
+
 // curl -v -X POST http://localhost:8080/operations/3/wait_building_task --data '' -H 'Content-Type: application/json'
 func (h *OperationHandler) waitBuildingTask(c echo.Context) error {
 	started := time.Now()
@@ -68,6 +73,12 @@ func (h *OperationHandler) waitBuildingTask(c echo.Context) error {
 			})
 		} else {
 			return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+				if pl.HasJobDeadline() {
+					err := PostPipelineTask(c, "check_stuck_jobs_task", pl)
+					if err != nil {
+						return err
+					}
+				}
 				return PostPipelineTask(c, "publish_task", pl)
 			})
 		}
@@ -217,11 +228,22 @@ func (h *OperationHandler) waitScalingTask(c echo.Context) error {
 	operation := c.Get("operation").(*models.PipelineOperation)
 	log.Debugf(ctx, "waitScalingTask operation: %v\n", operation)
 
+	// check_scaling=false is given by check_instance_size_task not to start
+	// another check_scaling_task chain while the chain of the pipeline is running.
+	params := url.Values{}
+	checkScaling := c.FormValue("check_scaling") != "false"
+	if !checkScaling {
+		params.Set("check_scaling", "false")
+	}
+
 	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		return models.WithInstanceGroupServicer(ctx, func(servicer models.InstanceGroupServicer) error {
 			handler_called := false
 			handler := func(_ string) error {
 				handler_called = true
+				if !checkScaling {
+					return nil
+				}
 				return operation.LoadPipelineWith(ctx, func(pl *models.Pipeline) error {
 					return PostPipelineTaskWithETA(c, "check_scaling_task", pl, started.Add(30*time.Second))
 				})
@@ -244,7 +266,7 @@ func (h *OperationHandler) waitScalingTask(c echo.Context) error {
 				return c.JSON(http.StatusOK, operation)
 			}
 			return ReturnJsonWith(c, operation, http.StatusAccepted, func() error {
-				return PostOperationTaskWithETA(c, "wait_scaling_task", operation, started.Add(30*time.Second))
+				return PostOperationTaskWith(c, "wait_scaling_task", operation, params, SetETAFunc(started.Add(30*time.Second)))
 			})
 		})
 
@@ -256,3 +278,104 @@ func (h *OperationHandler) waitScalingTask(c echo.Context) error {
 	}
 	return nil
 }
+
+// curl -v -X	POST http://localhost:8080/operations/1/wait_updating_task
+func (h *OperationHandler) waitUpdatingTask(c echo.Context) error {
+	started := time.Now()
+	ctx := c.Get("aecontext").(context.Context)
+	operation := c.Get("operation").(*models.PipelineOperation)
+	log.Debugf(ctx, "waitUpdatingTask operation: %v\n", operation)
+
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := models.WithDefaultDeploymentServicer(ctx, func(servicer models.DeploymentServicer) error {
+			updater := &models.DeploymentUpdater{Servicer: servicer}
+			return operation.ProcessUpdating(ctx, updater, func(pl *models.Pipeline) error {
+				return PostPipelineTask(c, "rolling_update_task", pl)
+			})
+		})
+		if err != nil {
+			log.Errorf(ctx, "Failed to ProcessUpdating operation: %v\n", operation)
+			return err
+		}
+
+		if !operation.Done() {
+			return ReturnJsonWith(c, operation, http.StatusAccepted, func() error {
+				return PostOperationTaskWithETA(c, "wait_updating_task", operation, started.Add(30*time.Second))
+			})
+		}
+
+		return c.JSON(http.StatusOK, operation)
+	}, nil)
+	if err != nil {
+		log.Errorf(ctx, "Error occurred in TX %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// curl -v -X	POST http://localhost:8080/operations/1/wait_rolling_update_task
+func (h *OperationHandler) waitRollingUpdateTask(c echo.Context) error {
+	started := time.Now()
+	ctx := c.Get("aecontext").(context.Context)
+	operation := c.Get("operation").(*models.PipelineOperation)
+	log.Debugf(ctx, "waitRollingUpdateTask operation: %v\n", operation)
+
+	retry := func() error {
+		return ReturnJsonWith(c, operation, http.StatusAccepted, func() error {
+			return PostOperationTaskWithETA(c, "wait_rolling_update_task", operation, started.Add(30*time.Second))
+		})
+	}
+
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return models.WithInstanceGroupServicer(ctx, func(servicer models.InstanceGroupServicer) error {
+			// The operation is already done when it's retried to wait for the instances
+			if !operation.Done() {
+				updater := &models.InstanceGroupUpdater{Servicer: servicer}
+				err := operation.ProcessRollingUpdate(ctx, updater)
+				if err != nil {
+					log.Errorf(ctx, "Failed to ProcessRollingUpdate operation %v because of %v\n", operation, err)
+					return err
+				}
+				if !operation.Done() {
+					return retry()
+				}
+			}
+			if operation.HasError() {
+				return c.JSON(http.StatusOK, operation)
+			}
+
+			pl, err := operation.LoadPipeline(ctx)
+			if err != nil {
+				return err
+			}
+			if !pl.Updating {
+				log.Infof(ctx, "Quit because the pipeline isn't being updated\n")
+				return c.JSON(http.StatusOK, operation)
+			}
+			rollingUpdater := models.NewRollingUpdaterWith(servicer)
+			stable, err := rollingUpdater.Stable(ctx, pl)
+			if err != nil {
+				return err
+			}
+			if !stable {
+				return retry()
+			}
+
+			operation.AppendLog("All instances are replaced")
+			err = operation.Update(ctx)
+			if err != nil {
+				return err
+			}
+			err = pl.CompleteUpdating(ctx)
+			if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusOK, operation)
+		})
+	}, nil)
+	if err != nil {
+		log.Errorf(ctx, "Error occurred in TX %v\n", err)
+		return err
+	}
+	return nil
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo"
 	"google.golang.org/appengine/datastore"
@@ -27,32 +31,151 @@ func (h *PipelineHandler) member(action echo.HandlerFunc) echo.HandlerFunc {
 	return gae_support.With(plBy(h.pipeline_id_name, http.StatusNotFound, PlToOrg(withAuth(action))))
 }
 
+// task is for the routes of tasks which accept the tasks without token.
+func (h *PipelineHandler) task(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(plBy(h.pipeline_id_name, http.StatusNotFound, PlToOrg(withTaskAuth(action))))
+}
+
 // curl -v http://localhost:8080/orgs/2/pipelines
+// curl -v 'http://localhost:8080/orgs/2/pipelines?status=opened,hibernating&sort=-created_at&limit=50&summary=true'
+// curl -v 'http://localhost:8080/orgs/2/pipelines?name=akm&limit=50&cursor=<X-Next-Cursor of the previous response>'
 func (h *PipelineHandler) index(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	org := c.Get("organization").(*models.Organization)
-	pipelines, err := org.PipelineAccessor().GetAll(ctx)
+	cond, err := h.pipelineSearchCondition(c)
 	if err != nil {
-		return err
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	pipelines, cursor, err := org.PipelineAccessor().Search(ctx, cond)
+	if err != nil {
+		switch err.(type) {
+		case *models.InvalidSearchCondition:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		default:
+			return err
+		}
+	}
+	if cursor != "" {
+		c.Response().Header().Set(NextCursorHeader, cursor)
+	}
+	if c.QueryParam("summary") == "true" {
+		res, err := summarizePipelines(pipelines)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, res)
 	}
 	return c.JSON(http.StatusOK, pipelines)
 }
 
+func (h *PipelineHandler) pipelineSearchCondition(c echo.Context) (*models.PipelineSearchCondition, error) {
+	cond := &models.PipelineSearchCondition{
+		NamePrefix: c.QueryParam("name"),
+		Sort:       c.QueryParam("sort"),
+		Cursor:     c.QueryParam("cursor"),
+	}
+	if v := c.QueryParam("status"); v != "" {
+		sts, err := models.ParseStatuses(strings.Split(v, ","))
+		if err != nil {
+			return nil, err
+		}
+		cond.Statuses = sts
+	}
+	for name, dest := range map[string]*time.Time{
+		"created_after":  &cond.CreatedAfter,
+		"created_before": &cond.CreatedBefore,
+	} {
+		if v := c.QueryParam(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*dest = t
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("Invalid limit: %q", v)
+		}
+		cond.Limit = limit
+	}
+	return cond, nil
+}
+
+// summarizePipelines returns the maps of the pipelines without models.PipelineSummaryOmittedFields.
+func summarizePipelines(pipelines []*models.Pipeline) ([]map[string]interface{}, error) {
+	res := []map[string]interface{}{}
+	for _, pl := range pipelines {
+		b, err := json.Marshal(pl)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		err = json.Unmarshal(b, &m)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range models.PipelineSummaryOmittedFields {
+			delete(m, f)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
 // curl -v -X POST http://localhost:8080/orgs/2/pipelines --data '{"id":"2","name":"akm"}' -H 'Content-Type: application/json'
+// curl -v -X POST 'http://localhost:8080/orgs/2/pipelines?template=3&template_version=2' --data '{"name":"akm"}' -H 'Content-Type: application/json'
 func (h *PipelineHandler) create(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	req := c.Request()
-	pl := &models.Pipeline{}
-	if err := c.Bind(pl); err != nil {
-		log.Errorf(ctx, "err: %v\n", err)
-		log.Errorf(ctx, "req: %v\n", req)
-		return err
-	}
 	org := c.Get("organization").(*models.Organization)
+	bind := func(pl *models.Pipeline) error {
+		if err := c.Bind(pl); err != nil {
+			log.Errorf(ctx, "err: %v\n", err)
+			log.Errorf(ctx, "req: %v\n", req)
+			return err
+		}
+		return nil
+	}
+
+	var pl *models.Pipeline
+	if tmplID := c.QueryParam("template"); tmplID != "" {
+		tmpl, err := org.PipelineTemplateAccessor().Find(ctx, tmplID)
+		if _, ok := err.(*models.InvalidParent); ok || err == models.ErrNoSuchPipelineTemplate {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No pipeline template found for " + tmplID})
+		}
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := c.QueryParam("template_version"); v != "" {
+			version, err = strconv.Atoi(v)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid template_version: %q", v)})
+			}
+		}
+		// The request body overrides the fields of the template
+		pl, err = tmpl.NewPipeline(ctx, version, bind)
+		if err == models.ErrNoSuchPipelineTemplate {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("No version %d of pipeline template %v", version, tmplID)})
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		pl = &models.Pipeline{}
+		if err := bind(pl); err != nil {
+			return err
+		}
+	}
 	pl.Organization = org
 	err := pl.CreateWithReserveOrWait(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Failed to reserve or wait pipeline: %v\n%v\n", pl, err)
+		if _, ok := err.(*models.InvalidOperation); ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
 		return err
 	}
 	log.Debugf(ctx, "Created pipeline: %v\n", pl)
@@ -95,6 +218,28 @@ func (h *PipelineHandler) show(c echo.Context) error {
 	return c.JSON(http.StatusOK, pl)
 }
 
+type DependencyStatusMediaType struct {
+	PipelineID string        `json:"pipeline_id"`
+	Status     models.Status `json:"status"`
+	*models.DependencyStatus
+}
+
+// curl -v http://localhost:8080/pipelines/1/dependency_status
+func (h *PipelineHandler) dependencyStatus(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	st, err := pl.Dependency.Status(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get dependency status of %v because of %v\n", pl.ID, err)
+		return err
+	}
+	return c.JSON(http.StatusOK, &DependencyStatusMediaType{
+		PipelineID:       pl.ID,
+		Status:           pl.Status,
+		DependencyStatus: st,
+	})
+}
+
 // curl -v -X PUT http://localhost:8080/pipelines/1/cancel
 // curl -v -X PUT http://localhost:8080/pipelines/1/close
 func (h *PipelineHandler) cancel(c echo.Context) error {
@@ -108,7 +253,7 @@ func (h *PipelineHandler) cancel(c echo.Context) error {
 	case models.StatusesNowDeploying.Include(st):
 		// Wait until deploying is finished
 		return c.JSON(http.StatusAccepted, pl)
-	case models.StatusesOpened.Include(st):
+	case models.StatusesOpened.Include(st) || models.StatusesPaused.Include(st):
 		return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
 			return PostPipelineTask(c, "close_task", pl)
 		})
@@ -127,6 +272,80 @@ func (h *PipelineHandler) cancel(c echo.Context) error {
 	}
 }
 
+// curl -v -X PATCH http://localhost:8080/pipelines/1 --data '{"container_name":"groovenauts/batch_type_iot_example:0.3.2"}' -H 'Content-Type: application/json'
+func (h *PipelineHandler) update(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	r := &models.PipelineReconfiguration{}
+	if err := c.Bind(r); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	needsUpdate, err := pl.Reconfigure(ctx, r)
+	if err != nil {
+		switch err.(type) {
+		case *models.InvalidReconfiguration:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case *models.InvalidOperation:
+			res := map[string]interface{}{"message": err.Error()}
+			return c.JSON(http.StatusNotAcceptable, res)
+		default:
+			return err
+		}
+	}
+	if !needsUpdate {
+		return c.JSON(http.StatusOK, pl)
+	}
+	return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+		return PostPipelineTask(c, "update_task", pl)
+	})
+}
+
+// curl -v -X PUT http://localhost:8080/pipelines/1/pause
+func (h *PipelineHandler) pause(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	if err := pl.Pause(ctx); err != nil {
+		switch err.(type) {
+		case *models.InvalidStateTransition:
+			res := map[string]interface{}{"message": err.Error()}
+			return c.JSON(http.StatusNotAcceptable, res)
+		default:
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, pl)
+}
+
+// curl -v -X PUT http://localhost:8080/pipelines/1/resume
+func (h *PipelineHandler) resume(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	if err := pl.Resume(ctx); err != nil {
+		switch err.(type) {
+		case *models.InvalidStateTransition:
+			res := map[string]interface{}{"message": err.Error()}
+			return c.JSON(http.StatusNotAcceptable, res)
+		default:
+			return err
+		}
+	}
+	return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+		// Publish the jobs held while the pipeline was paused
+		err := PostPipelineTask(c, "publish_task", pl)
+		if err != nil {
+			return err
+		}
+		// Keep at least one subscribe_task running to check closing or hibernation
+		// which was suspended while the pipeline was paused
+		return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			return pl.CalcAndUpdatePullingTaskSize(ctx, 1, func(newTasks int) error {
+				return PostPipelineTask(c, "subscribe_task", pl)
+			})
+		}, nil)
+	})
+}
+
 // curl -v -X DELETE http://localhost:8080/pipelines/1
 func (h *PipelineHandler) destroy(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
@@ -147,6 +366,10 @@ func (h *PipelineHandler) destroy(c echo.Context) error {
 func (h *PipelineHandler) publishTask(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	pl := c.Get("pipeline").(*models.Pipeline)
+	if models.StatusesPaused.Include(pl.Status) {
+		log.Infof(ctx, "Quit publish_task because the pipeline is %v so the jobs are held in Ready\n", pl.Status)
+		return c.JSON(http.StatusOK, pl)
+	}
 	err := pl.PublishJobs(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Failed to Pipeline.PublishJobs for %v because of %v\n", pl.ID, err)
@@ -5,7 +5,6 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/appengine/log"
 
 	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
@@ -19,16 +18,13 @@ func (h *PipelineHandler) buildTask(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	// The operation of the existing deployment is returned if the deployment is already inserted
 	operation, err := builder.Process(ctx, pl)
 	if err != nil {
-		switch err.(type) {
-		case *googleapi.Error:
-			e2 := err.(*googleapi.Error)
-			switch e2.Code {
-			case http.StatusConflict: // googleapi: Error 409: 'projects/optical-hangar-158902/global/deployments/pipeline-mjr-59-20170926-163820' already exists and cannot be created., duplicate
-				log.Warningf(ctx, "Skip building because of %v", e2.Message)
-				return c.JSON(http.StatusNoContent, pl)
-			}
+		if _, ok := err.(*models.InvalidOperation); ok {
+			// The pipeline is Broken, so the task must not be retried
+			log.Errorf(ctx, "Quit building pipeline %v because of %v\n", pl.ID, err)
+			return c.JSON(http.StatusOK, pl)
 		}
 		log.Errorf(ctx, "Failed to build a pipeline %v because of %v\n", pl, err)
 		return err
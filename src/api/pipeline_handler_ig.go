@@ -2,7 +2,10 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo"
@@ -32,6 +35,13 @@ func (h *PipelineHandler) checkScalingTask(c echo.Context) error {
 		models.StatusesHibernating.Include(pl.Status):
 		log.Infof(ctx, "Quit because the pipeline is %v so now stopping subscribe_task. \n", pl.Status)
 		return c.JSON(http.StatusOK, pl)
+	case models.StatusesAlreadyClosing.Include(pl.Status):
+		log.Infof(ctx, "Quit because the pipeline is already %v\n", pl.Status)
+		return c.JSON(http.StatusOK, pl)
+	case models.StatusesPaused.Include(pl.Status):
+		// check_scaling_task is started again by publish_task after resumed
+		log.Infof(ctx, "Quit because the pipeline is %v\n", pl.Status)
+		return c.JSON(http.StatusOK, pl)
 	}
 
 	return models.WithScaler(ctx, func(scaler *models.Scaler) error {
@@ -49,3 +59,55 @@ func (h *PipelineHandler) checkScalingTask(c echo.Context) error {
 		})
 	})
 }
+
+// checkInstanceSizeTask compares InstanceSize with the actual size of the instance group.
+// It's posted by /pipelines/refresh periodically.
+// curl -v -X	POST http://localhost:8080/pipelines/1/check_instance_size_task
+func (h *PipelineHandler) checkInstanceSizeTask(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+
+	if !models.StatusesOpened.Include(pl.Status) && !models.StatusesPaused.Include(pl.Status) {
+		log.Infof(ctx, "Quit because the pipeline is %v\n", pl.Status)
+		return c.JSON(http.StatusOK, pl)
+	}
+
+	return models.WithDriftDetector(ctx, func(detector *models.DriftDetector) error {
+		drift, operation, err := detector.Process(ctx, pl, time.Now())
+		if err != nil {
+			if drift == nil {
+				return err
+			}
+			// Not to record the same drift again by retrying the task
+			log.Errorf(ctx, "Failed to correct the drift of %v because of %v\n", pl.ID, err)
+			return c.JSON(http.StatusOK, pl)
+		}
+		if operation != nil {
+			// check_scaling_task is already running for the pipeline
+			params := url.Values{"check_scaling": []string{"false"}}
+			return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+				return PostOperationTaskWith(c, "wait_scaling_task", operation, params, nil)
+			})
+		}
+		return c.JSON(http.StatusOK, pl)
+	})
+}
+
+// curl -v 'http://localhost:8080/pipelines/1/instance_size_drifts?limit=20'
+func (h *PipelineHandler) instanceSizeDrifts(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	limit := 0
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid limit: %q", v)})
+		}
+	}
+	drifts, err := pl.InstanceSizeDrifts(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, drifts)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/gae_support"
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+// internal is for the requests from cron which have no pipeline in their path.
+func (h *PipelineHandler) internal(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(withAppEngineInternal(action))
+}
+
+// refresh is called by cron. It repairs the stuck pipelines and returns the audit logs of the repairs.
+// The thresholds in seconds given as the parameters override REFRESH_BUILDING_TIMEOUT,
+// REFRESH_SUBSCRIBE_TIMEOUT, REFRESH_DRIFT_CHECK_INTERVAL and REFRESH_PUBLISHING_TIMEOUT.
+// curl -v 'http://localhost:8080/pipelines/refresh?building_timeout=1800&subscribe_timeout=600&drift_check_interval=300&publishing_timeout=600' -H 'X-Appengine-Cron: true'
+func (h *PipelineHandler) refresh(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	config := models.RefreshConfigFromEnv()
+	for name, dest := range map[string]*time.Duration{
+		"building_timeout":     &config.BuildingTimeout,
+		"subscribe_timeout":    &config.SubscribeTimeout,
+		"drift_check_interval": &config.DriftCheckInterval,
+		"publishing_timeout":   &config.PublishingTimeout,
+	} {
+		if v := c.QueryParam(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid %s: %q", name, v)})
+			}
+			*dest = time.Duration(i) * time.Second
+		}
+	}
+
+	refresher := &models.Refresher{
+		Config: config,
+		PostTask: func(pl *models.Pipeline, action string) error {
+			return PostPipelineTask(c, action, pl)
+		},
+	}
+	logs, err := refresher.Process(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Failed to refresh pipelines because of %v\n", err)
+		return err
+	}
+	return c.JSON(http.StatusOK, logs)
+}
+
+// curl -v 'http://localhost:8080/pipelines/1/refresh_logs?limit=20'
+func (h *PipelineHandler) refreshLogs(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	limit := 0
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid limit: %q", v)})
+		}
+	}
+	logs, err := models.RefreshLogsFor(ctx, pl, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, logs)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+const CheckStuckJobsInterval = 60 * time.Second
+
+// curl -v -X	POST http://localhost:8080/pipelines/1/check_stuck_jobs_task
+func (h *PipelineHandler) checkStuckJobsTask(c echo.Context) error {
+	started := time.Now()
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+
+	if !pl.HasJobDeadline() {
+		log.Warningf(ctx, "Quit because the pipeline has no deadline for jobs.\n")
+		return c.JSON(http.StatusOK, pl)
+	}
+
+	// The jobs published before paused are still executed
+	if !models.StatusesOpened.Include(pl.Status) && !models.StatusesPaused.Include(pl.Status) {
+		log.Infof(ctx, "Quit because the pipeline is %v so now stopping check_stuck_jobs_task.\n", pl.Status)
+		return c.JSON(http.StatusOK, pl)
+	}
+
+	jobs, err := pl.FailStuckJobs(ctx, started, func(job *models.Job) error {
+		log.Infof(ctx, "Retry stuck job %v as attempt %d at %v\n", job.ID, job.Attempt, job.RetryAt)
+		return PostJobTaskWithETA(c, "wait_task", job, job.RetryAt)
+	})
+	if err != nil {
+		log.Errorf(ctx, "Failed to Pipeline.FailStuckJobs for %v because of %v\n", pl.ID, err)
+		return err
+	}
+	log.Debugf(ctx, "%d stuck jobs found\n", len(jobs))
+
+	ended := models.Jobs{}
+	for _, job := range jobs {
+		if job.Status.Ended() {
+			ended = append(ended, job)
+		}
+	}
+	if err := h.followEndedJobs(c, pl, ended); err != nil {
+		return err
+	}
+
+	return ReturnJsonWith(c, pl, http.StatusAccepted, func() error {
+		return PostPipelineTaskWithETA(c, "check_stuck_jobs_task", pl, started.Add(CheckStuckJobsInterval))
+	})
+}
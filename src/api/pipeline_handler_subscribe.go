@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo"
@@ -19,11 +20,13 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 	started := time.Now()
 	ctx := c.Get("aecontext").(context.Context)
 	pl := c.Get("pipeline").(*models.Pipeline)
+	chain := h.subscribeChain(c)
+	pl.BeatSubscribe(ctx, chain, started)
 
 	if pl.Cancelled {
-		return pl.DecreasePullingTaskSize(ctx, 1, func() error {
+		return h.stopSubscribing(c, pl, chain, func() error {
 			switch {
-			case models.StatusesOpened.Include(pl.Status):
+			case models.StatusesOpened.Include(pl.Status) || models.StatusesPaused.Include(pl.Status):
 				log.Infof(ctx, "Pipeline is cancelled.\n")
 				return ReturnJsonWith(c, pl, http.StatusNoContent, func() error {
 					return PostPipelineTask(c, "close_task", pl)
@@ -42,13 +45,20 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 	switch {
 	case models.StatusesHibernationInProgresss.Include(pl.Status) ||
 		models.StatusesHibernating.Include(pl.Status):
-		return pl.DecreasePullingTaskSize(ctx, 1, func() error {
+		return h.stopSubscribing(c, pl, chain, func() error {
 			log.Infof(ctx, "Pipeline is %v so now stopping subscribe_task. \n", pl.Status)
 			return c.JSON(http.StatusOK, pl)
 		})
 	}
 
-	err := pl.PullAndUpdateJobStatus(ctx)
+	ended, err := pl.PullAndUpdateJobStatus(ctx, func(job *models.Job) error {
+		log.Infof(ctx, "Retry job %v as attempt %d at %v\n", job.ID, job.Attempt, job.RetryAt)
+		return PostJobTaskWithETA(c, "wait_task", job, job.RetryAt)
+	})
+	// The jobs which ended are saved even if some messages failed
+	if promoteErr := h.followEndedJobs(c, pl, ended); promoteErr != nil {
+		return promoteErr
+	}
 	if err != nil {
 		if err == datastore.ErrConcurrentTransaction {
 			log.Warningf(ctx, "Quit subscribe_task because of %v\n", err)
@@ -58,7 +68,7 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 		case *models.SubscriprionNotFound:
 			switch {
 			case models.StatusesAlreadyClosing.Include(pl.Status):
-				return pl.DecreasePullingTaskSize(ctx, 1, func() error {
+				return h.stopSubscribing(c, pl, chain, func() error {
 					log.Infof(ctx, "Pipeline is already %v\n", pl.Status)
 					return c.JSON(http.StatusOK, pl)
 				})
@@ -66,7 +76,7 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 				log.Infof(ctx, "Subscription is not found but the pipeline isn't closed because of %v\n", err)
 			}
 		default:
-			return pl.DecreasePullingTaskSize(ctx, 1, func() error {
+			return h.stopSubscribing(c, pl, chain, func() error {
 				log.Errorf(ctx, "Failed to get Pipeline#PullAndUpdateJobStatus() because of %v\n", err)
 				return err
 			})
@@ -82,33 +92,13 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 	}
 	log.Debugf(ctx, "Pipeline has %v jobs\n", len(jobs))
 
-	// // Comment out the following code
-	// // Because there are no dependency control actually.
-	//
-	// pendings, err := models.GlobalPipelineAccessor.PendingsFor(ctx, jobs.Finished().IDs())
-	// if err != nil {
-	// 	return err
-	// }
-	//
-	// for _, pending := range pendings {
-	// 	org := c.Get("organization").(*models.Organization)
-	// 	pending.Organization = org
-	// 	err := pending.UpdateIfReserveOrWait(ctx)
-	// 	if err != nil {
-	// 		log.Errorf(ctx, "Failed to UpdateIfReserveOrWait pending: %v\n%v\n", pending, err)
-	// 		return err
-	// 	}
-	// 	if pending.Status == models.Reserved {
-	// 		err = h.PostPipelineTaskIfPossible(c, pending)
-	// 		if err != nil {
-	// 			log.Errorf(ctx, "Failed to PostPipelineTaskIfPossible pending: %v\n%v\n", pending, err)
-	// 			return err
-	// 		}
-	// 	}
-	// }
-
 	if jobs.AllFinished() {
-		return pl.DecreasePullingTaskSize(ctx, 1, func() error {
+		return h.stopSubscribing(c, pl, chain, func() error {
+			if models.StatusesPaused.Include(pl.Status) {
+				// Closing and hibernation are checked again by subscribe_task after resumed
+				log.Infof(ctx, "Pipeline is %v so it's neither closed nor hibernated.\n", pl.Status)
+				return c.JSON(http.StatusOK, pl)
+			}
 			if pl.ClosePolicy.Match(jobs) {
 				if pl.HibernationDelay == 0 {
 					return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
@@ -135,6 +125,102 @@ func (h *PipelineHandler) subscribeTask(c echo.Context) error {
 
 	return ReturnJsonWith(c, pl, http.StatusAccepted, func() error {
 		interval := time.Duration(models.Int64WithDefault(pl.Pulling.IntervalSeconds, 30))
-		return PostPipelineTaskWithETA(c, "subscribe_task", pl, started.Add(interval*time.Second))
+		params := url.Values{"chain": []string{chain}}
+		return PostPipelineTaskWith(c, "subscribe_task", pl, params, SetETAFunc(started.Add(interval*time.Second)))
 	})
 }
+
+// subscribeChain returns the ID of the subscribe_task chain which is the name of the first task of the chain.
+func (h *PipelineHandler) subscribeChain(c echo.Context) string {
+	if chain := c.FormValue("chain"); chain != "" {
+		return chain
+	}
+	if name := c.Request().Header.Get(APPENGINE_TASK_NAME_HEADER); name != "" {
+		return name
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// stopSubscribing ends the subscribe_task chain.
+func (h *PipelineHandler) stopSubscribing(c echo.Context, pl *models.Pipeline, chain string, f func() error) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl.StopSubscribeHeartbeat(ctx, chain)
+	return pl.DecreasePullingTaskSize(ctx, 1, f)
+}
+
+// followEndedJobs promotes the jobs and wakes up the pending pipelines
+// which depend on the jobs ended just now.
+func (h *PipelineHandler) followEndedJobs(c echo.Context, pl *models.Pipeline, ended models.Jobs) error {
+	_, err := PromoteDependentJobs(c, pl, ended)
+	if err != nil {
+		return err
+	}
+	// The cancelled jobs never satisfy the dependency of pipelines
+	return h.WakeUpPendingsFor(c, ended.Finished())
+}
+
+// PromoteDependentJobs makes the jobs depending on the ended jobs Ready or Cancelled
+// and posts publish_task for the Ready ones. It returns the jobs cancelled by their dependency.
+func PromoteDependentJobs(c echo.Context, pl *models.Pipeline, ended models.Jobs) (models.Jobs, error) {
+	ctx := c.Get("aecontext").(context.Context)
+	if len(ended) == 0 {
+		return models.Jobs{}, nil
+	}
+	promoted, cancelled, err := pl.PromoteDependentJobs(ctx, ended)
+	if err != nil {
+		log.Errorf(ctx, "Failed to Pipeline.PromoteDependentJobs because of %v\n", err)
+		return nil, err
+	}
+	if len(cancelled) > 0 {
+		log.Infof(ctx, "%d jobs are cancelled because their dependencies are never satisfied\n", len(cancelled))
+	}
+	if len(promoted) > 0 {
+		log.Infof(ctx, "%d jobs are ready because their dependencies are satisfied\n", len(promoted))
+		err := PostPipelineTask(c, "publish_task", pl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cancelled, nil
+}
+
+// WakeUpPendingsFor reserves the pending pipelines which depend on the finished jobs
+// and starts building them if their dependencies are satisfied.
+func (h *PipelineHandler) WakeUpPendingsFor(c echo.Context, finished models.Jobs) error {
+	ctx := c.Get("aecontext").(context.Context)
+	if len(finished) == 0 {
+		return nil
+	}
+
+	pendings, err := models.GlobalPipelineAccessor.PendingsFor(ctx, finished.IDs())
+	if err != nil {
+		log.Errorf(ctx, "Failed to PendingsFor because of %v\n", err)
+		return err
+	}
+
+	for _, pending := range pendings {
+		err := pending.LoadOrganization(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Failed to load organization of pending: %v\n%v\n", pending, err)
+			return err
+		}
+		err = pending.UpdateIfReserveOrWait(ctx)
+		if err != nil {
+			switch err.(type) {
+			case *models.InvalidStateTransition:
+				log.Warningf(ctx, "Skip pending %v because of %v\n", pending.ID, err)
+				continue
+			default:
+				log.Errorf(ctx, "Failed to UpdateIfReserveOrWait pending: %v\n%v\n", pending, err)
+				return err
+			}
+		}
+		log.Infof(ctx, "Pending pipeline %v is now %v\n", pending.ID, pending.Status)
+		err = h.PostPipelineTaskIfPossible(c, pending)
+		if err != nil {
+			log.Errorf(ctx, "Failed to PostPipelineTaskIfPossible pending: %v\n%v\n", pending, err)
+			return err
+		}
+	}
+	return nil
+}
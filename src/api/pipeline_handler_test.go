@@ -142,6 +142,37 @@ func TestActions(t *testing.T) {
 		}
 	}
 
+	// Only the routes of tasks accept the tasks without token
+	internal_headers := map[string]string{
+		"X-Appengine-Queuename": "default",
+		"X-Appengine-Cron":      "true",
+	}
+	for header, value := range internal_headers {
+		for _, isTask := range []bool{false, true} {
+			req, err = inst.NewRequest(echo.GET, path, nil)
+			assert.NoError(t, err)
+			req.Header.Set(header, value)
+
+			rec = httptest.NewRecorder()
+			c = e.NewContext(req, rec)
+			c.SetPath(path)
+			c.SetParamNames("org_id", "id")
+			c.SetParamValues(org.ID, pl.ID)
+
+			mw := h.member
+			if isTask {
+				mw = h.task
+			}
+			if assert.NoError(t, mw(h.show)(c)) {
+				if isTask && header == "X-Appengine-Queuename" {
+					assert.Equal(t, http.StatusOK, rec.Code)
+				} else {
+					assert.Equal(t, http.StatusUnauthorized, rec.Code)
+				}
+			}
+		}
+	}
+
 	type expection struct {
 		status models.Status
 		result map[string][]string
@@ -202,6 +233,47 @@ func TestActions(t *testing.T) {
 		}
 	}
 
+	// Test for index with filters and summary
+	for query, expected := range map[string]int{"?summary=true": 1, "?status=closed&summary=true": 0} {
+		req, err = inst.NewRequest(echo.GET, "/orgs"+org.ID+"/pipelines"+query, nil)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(auth_header, token)
+		assert.NoError(t, err)
+
+		rec = httptest.NewRecorder()
+		c = e.NewContext(req, rec)
+		c.SetPath("/orgs" + org.ID + "/pipelines")
+		c.SetParamNames("org_id")
+		c.SetParamValues(org.ID)
+
+		if assert.NoError(t, h.collection(h.index)(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			pls := []map[string]interface{}{}
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pls)) && assert.Equal(t, expected, len(pls), query) && expected > 0 {
+				assert.Equal(t, "pipeline01", pls[0]["name"])
+				assert.NotContains(t, pls[0], "boot_disk")
+				assert.NotContains(t, pls[0], "dependency")
+			}
+		}
+	}
+
+	// Test for index with an invalid status
+	req, err = inst.NewRequest(echo.GET, "/orgs"+org.ID+"/pipelines?status=unknown", nil)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(auth_header, token)
+	assert.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetPath("/orgs" + org.ID + "/pipelines")
+	c.SetParamNames("org_id")
+	c.SetParamValues(org.ID)
+
+	if assert.NoError(t, h.collection(h.index)(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+
 	// https://github.com/golang/appengine/blob/master/aetest/instance.go#L32-L46
 	ctx = appengine.NewContext(req)
 
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+// quitUpdating clears Updating of the pipeline which can't be updated any more.
+func (h *PipelineHandler) quitUpdating(c echo.Context, pl *models.Pipeline) (bool, error) {
+	ctx := c.Get("aecontext").(context.Context)
+	if !pl.Updating {
+		log.Infof(ctx, "Quit because the pipeline isn't being updated\n")
+		return true, c.JSON(http.StatusOK, pl)
+	}
+	if !models.StatusesOpened.Include(pl.Status) && !models.StatusesPaused.Include(pl.Status) {
+		log.Warningf(ctx, "Quit updating because the pipeline is %v\n", pl.Status)
+		err := pl.CompleteUpdating(ctx)
+		if err != nil {
+			return true, err
+		}
+		return true, c.JSON(http.StatusOK, pl)
+	}
+	return false, nil
+}
+
+// curl -v -X POST http://localhost:8080/pipelines/1/update_task
+func (h *PipelineHandler) updateTask(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	if quit, err := h.quitUpdating(c, pl); quit {
+		return err
+	}
+
+	builder, err := models.NewBuilder(ctx)
+	if err != nil {
+		return err
+	}
+	operation, err := builder.Update(ctx, pl)
+	if err != nil {
+		log.Errorf(ctx, "Failed to update a pipeline %v because of %v\n", pl, err)
+		return err
+	}
+
+	return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+		return PostOperationTask(c, "wait_updating_task", operation)
+	})
+}
+
+// curl -v -X POST http://localhost:8080/pipelines/1/rolling_update_task
+func (h *PipelineHandler) rollingUpdateTask(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	pl := c.Get("pipeline").(*models.Pipeline)
+	if quit, err := h.quitUpdating(c, pl); quit {
+		return err
+	}
+
+	return models.WithRollingUpdater(ctx, func(updater *models.RollingUpdater) error {
+		operation, err := updater.Process(ctx, pl)
+		if err != nil {
+			return err
+		}
+		return ReturnJsonWith(c, pl, http.StatusCreated, func() error {
+			return PostOperationTask(c, "wait_rolling_update_task", operation)
+		})
+	})
+}
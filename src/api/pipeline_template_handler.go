@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/gae_support"
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+type PipelineTemplateHandler struct {
+	org_id_name      string
+	template_id_name string
+}
+
+func (h *PipelineTemplateHandler) collection(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(orgBy(h.org_id_name, http.StatusNotFound, withAuth(action)))
+}
+
+func (h *PipelineTemplateHandler) member(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(orgBy(h.org_id_name, http.StatusNotFound, withAuth(templateBy(h.template_id_name, http.StatusNotFound, action))))
+}
+
+func templateBy(key string, statusNotFound int, impl func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		id := c.Param(key)
+		org := c.Get("organization").(*models.Organization)
+		tmpl, err := org.PipelineTemplateAccessor().Find(ctx, id)
+		if _, ok := err.(*models.InvalidParent); ok || err == models.ErrNoSuchPipelineTemplate {
+			return c.JSON(statusNotFound, map[string]string{"message": "Not found for " + id})
+		}
+		if err != nil {
+			log.Errorf(ctx, "templateBy %v id: %v\n", err, id)
+			return err
+		}
+		c.Set("template", tmpl)
+		return impl(c)
+	}
+}
+
+// PipelineTemplatePayload is the request body to create or update a pipeline template.
+type PipelineTemplatePayload struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Pipeline    json.RawMessage `json:"pipeline"`
+}
+
+func (p *PipelineTemplatePayload) ApplyTo(tmpl *models.PipelineTemplate) {
+	tmpl.Name = p.Name
+	tmpl.Description = p.Description
+	tmpl.Pipeline = p.Pipeline
+}
+
+// curl -v http://localhost:8080/orgs/2/pipeline_templates
+func (h *PipelineTemplateHandler) index(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	org := c.Get("organization").(*models.Organization)
+	templates, err := org.PipelineTemplateAccessor().All(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+// curl -v -X POST http://localhost:8080/orgs/2/pipeline_templates --data '{"name":"iot","pipeline":{"machine_type":"f1-micro"}}' -H 'Content-Type: application/json'
+func (h *PipelineTemplateHandler) create(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	org := c.Get("organization").(*models.Organization)
+	payload := &PipelineTemplatePayload{}
+	if err := c.Bind(payload); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	tmpl := &models.PipelineTemplate{Organization: org}
+	payload.ApplyTo(tmpl)
+	if err := tmpl.Create(ctx); err != nil {
+		return h.saveError(c, err)
+	}
+	return c.JSON(http.StatusCreated, tmpl)
+}
+
+// curl -v http://localhost:8080/orgs/2/pipeline_templates/1
+func (h *PipelineTemplateHandler) show(c echo.Context) error {
+	tmpl := c.Get("template").(*models.PipelineTemplate)
+	return c.JSON(http.StatusOK, tmpl)
+}
+
+// curl -v http://localhost:8080/orgs/2/pipeline_templates/1/versions
+func (h *PipelineTemplateHandler) versions(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	tmpl := c.Get("template").(*models.PipelineTemplate)
+	versions, err := tmpl.Versions(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, versions)
+}
+
+// curl -v -X PUT http://localhost:8080/orgs/2/pipeline_templates/1 --data '{"name":"iot","pipeline":{"machine_type":"n1-standard-1"}}' -H 'Content-Type: application/json'
+func (h *PipelineTemplateHandler) update(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	tmpl := c.Get("template").(*models.PipelineTemplate)
+	payload := &PipelineTemplatePayload{}
+	if err := c.Bind(payload); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	payload.ApplyTo(tmpl)
+	if err := tmpl.Update(ctx); err != nil {
+		return h.saveError(c, err)
+	}
+	return c.JSON(http.StatusOK, tmpl)
+}
+
+// curl -v -X DELETE http://localhost:8080/orgs/2/pipeline_templates/1
+func (h *PipelineTemplateHandler) destroy(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	tmpl := c.Get("template").(*models.PipelineTemplate)
+	if err := tmpl.Destroy(ctx); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tmpl)
+}
+
+func (h *PipelineTemplateHandler) saveError(c echo.Context, err error) error {
+	switch err.(type) {
+	case *models.InvalidOperation:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return err
+}
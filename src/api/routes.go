@@ -12,6 +12,8 @@ func SetupRoutes(echo *echo.Echo) map[string]interface{} {
 		"pipelines":  SetupRoutesOfPipelines(),
 		"operations": SetupRoutesOfOperations(),
 		"jobs":       SetupRoutesOfJobs(),
+		"templates":  SetupRoutesOfPipelineTemplates(),
+		"schedules":  SetupRoutesOfSchedules(),
 	}
 }
 
@@ -26,13 +28,21 @@ func SetupRoutesOfPipelines() *PipelineHandler {
 	g.POST("", h.create)
 	g.GET("/subscriptions", h.subscriptions)
 
+	e.GET("/pipelines/refresh", h.refresh, h.internal)
+
 	g = e.Group("/pipelines", h.member)
 	g.GET("/:id", h.show)
+	g.GET("/:id/dependency_status", h.dependencyStatus)
+	g.GET("/:id/refresh_logs", h.refreshLogs)
+	g.GET("/:id/instance_size_drifts", h.instanceSizeDrifts)
+	g.PATCH("/:id", h.update)
 	g.PUT("/:id/cancel", h.cancel)
 	g.PUT("/:id/close", h.cancel)
+	g.PUT("/:id/pause", h.pause)
+	g.PUT("/:id/resume", h.resume)
 	g.DELETE("/:id", h.destroy)
 
-	g = e.Group("/pipelines", h.member)
+	g = e.Group("/pipelines", h.task)
 	g.POST("/:id/close_task", h.closeTask)
 	g.POST("/:id/check_hibernation_task", h.checkHibernationTask)
 	g.POST("/:id/hibernate_task", h.hibernateTask)
@@ -41,6 +51,10 @@ func SetupRoutesOfPipelines() *PipelineHandler {
 	g.POST("/:id/publish_task", h.publishTask)
 	g.POST("/:id/subscribe_task", h.subscribeTask)
 	g.POST("/:id/check_scaling_task", h.checkScalingTask)
+	g.POST("/:id/check_instance_size_task", h.checkInstanceSizeTask)
+	g.POST("/:id/check_stuck_jobs_task", h.checkStuckJobsTask)
+	g.POST("/:id/update_task", h.updateTask)
+	g.POST("/:id/rolling_update_task", h.rollingUpdateTask)
 
 	return h
 }
@@ -51,11 +65,13 @@ func SetupRoutesOfOperations() *OperationHandler {
 		operation_id_name: "id",
 	}
 
-	g := e.Group("/operations", h.member)
+	g := e.Group("/operations", h.task)
 	g.POST("/:id/wait_building_task", h.waitBuildingTask)
 	g.POST("/:id/wait_hibernation_task", h.waitHibernationTask)
 	g.POST("/:id/wait_closing_task", h.waitClosingTask)
 	g.POST("/:id/wait_scaling_task", h.waitScalingTask)
+	g.POST("/:id/wait_updating_task", h.waitUpdatingTask)
+	g.POST("/:id/wait_rolling_update_task", h.waitRollingUpdateTask)
 
 	return h
 }
@@ -69,18 +85,65 @@ func SetupRoutesOfJobs() *JobHandler {
 	g := e.Group("/pipelines/:pipeline_id/jobs", h.collection)
 	g.GET("", h.index)
 	g.POST("", h.create)
+	g.POST("/bulk", h.bulkCreate)
 
 	e.POST("/pipelines/:pipeline_id/bulk_get_jobs", h.BulkGetJobs, h.collection)
 	e.POST("/pipelines/:pipeline_id/bulk_job_statuses", h.BulkJobStatuses, h.collection)
+	e.GET("/pipelines/:pipeline_id/dead_letters", h.DeadLetters, h.collection)
+	e.POST("/pipelines/:pipeline_id/dead_letters/requeue", h.RequeueDeadLetters, h.collection)
 
 	g = e.Group("/jobs", h.member)
 	g.GET("/:id", h.show)
+	g.GET("/:id/output", h.output)
+	g.GET("/:id/events", h.events)
 	g.POST("/:id/getready", h.getReady)
 	g.POST("/:id/cancel", h.Cancel)
 
-	g = e.Group("/jobs", h.member)
+	g = e.Group("/jobs", h.task)
 	g.POST("/:id/wait_task", h.WaitToPublishTask)
 	g.POST("/:id/publish_task", h.PublishTask)
+	g.POST("/:id/check_cancel_task", h.CheckCancelTask)
+
+	return h
+}
+
+func SetupRoutesOfPipelineTemplates() *PipelineTemplateHandler {
+	h := &PipelineTemplateHandler{
+		org_id_name:      "org_id",
+		template_id_name: "id",
+	}
+
+	g := e.Group("/orgs/:org_id/pipeline_templates", h.collection)
+	g.GET("", h.index)
+	g.POST("", h.create)
+
+	g = e.Group("/orgs/:org_id/pipeline_templates", h.member)
+	g.GET("/:id", h.show)
+	g.GET("/:id/versions", h.versions)
+	g.PUT("/:id", h.update)
+	g.DELETE("/:id", h.destroy)
+
+	return h
+}
+
+func SetupRoutesOfSchedules() *ScheduleHandler {
+	h := &ScheduleHandler{
+		org_id_name:      "org_id",
+		schedule_id_name: "id",
+	}
+
+	g := e.Group("/orgs/:org_id/schedules", h.collection)
+	g.GET("", h.index)
+	g.POST("", h.create)
+
+	g = e.Group("/orgs/:org_id/schedules", h.member)
+	g.GET("/:id", h.show)
+	g.GET("/:id/runs", h.runs)
+	g.PUT("/:id", h.update)
+	g.DELETE("/:id", h.destroy)
+
+	e.GET("/schedules/tick", h.tick, h.internal)
+	e.POST("/schedules/:id/run_task", h.runTask, h.task)
 
 	return h
 }
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/gae_support"
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/models"
+)
+
+type ScheduleHandler struct {
+	org_id_name      string
+	schedule_id_name string
+}
+
+func (h *ScheduleHandler) collection(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(orgBy(h.org_id_name, http.StatusNotFound, withAuth(action)))
+}
+
+func (h *ScheduleHandler) member(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(orgBy(h.org_id_name, http.StatusNotFound, withAuth(scheduleBy(h.schedule_id_name, http.StatusNotFound, action))))
+}
+
+// internal is for the requests from cron which have no organization in their path.
+func (h *ScheduleHandler) internal(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(withAppEngineInternal(action))
+}
+
+// task returns 204 for the deleted schedule not to retry the task.
+func (h *ScheduleHandler) task(action echo.HandlerFunc) echo.HandlerFunc {
+	return gae_support.With(withAppEngineInternal(scheduleBy(h.schedule_id_name, http.StatusNoContent, action)))
+}
+
+func scheduleBy(key string, statusNotFound int, impl func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		id := c.Param(key)
+		accessor := models.GlobalScheduleAccessor
+		if org, ok := c.Get("organization").(*models.Organization); ok {
+			accessor = org.ScheduleAccessor()
+		}
+		schedule, err := accessor.Find(ctx, id)
+		if _, ok := err.(*models.InvalidParent); ok || err == models.ErrNoSuchSchedule {
+			return c.JSON(statusNotFound, map[string]string{"message": "Not found for " + id})
+		}
+		if err != nil {
+			log.Errorf(ctx, "scheduleBy %v id: %v\n", err, id)
+			return err
+		}
+		c.Set("schedule", schedule)
+		return impl(c)
+	}
+}
+
+// SchedulePayload is the request body to create or update a schedule.
+type SchedulePayload struct {
+	Name            string               `json:"name"`
+	Cron            string               `json:"cron"`
+	TimeZone        string               `json:"time_zone"`
+	TemplateID      string               `json:"template_id"`
+	TemplateVersion int                  `json:"template_version"`
+	Pipeline        json.RawMessage      `json:"pipeline"`
+	Jobs            json.RawMessage      `json:"jobs"`
+	JobGenerator    *models.JobGenerator `json:"job_generator"`
+	CatchUp         string               `json:"catch_up"`
+	MaxCatchUpRuns  int                  `json:"max_catch_up_runs"`
+	Disabled        bool                 `json:"disabled"`
+}
+
+func (p *SchedulePayload) ApplyTo(schedule *models.Schedule) {
+	schedule.Name = p.Name
+	schedule.Cron = p.Cron
+	schedule.TimeZone = p.TimeZone
+	schedule.TemplateID = p.TemplateID
+	schedule.TemplateVersion = p.TemplateVersion
+	schedule.Pipeline = p.Pipeline
+	schedule.Jobs = p.Jobs
+	schedule.JobGenerator = p.JobGenerator
+	schedule.CatchUp = p.CatchUp
+	schedule.MaxCatchUpRuns = p.MaxCatchUpRuns
+	schedule.Disabled = p.Disabled
+}
+
+// curl -v http://localhost:8080/orgs/2/schedules
+func (h *ScheduleHandler) index(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	org := c.Get("organization").(*models.Organization)
+	schedules, err := org.ScheduleAccessor().All(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+// curl -v -X POST http://localhost:8080/orgs/2/schedules --data '{"name":"nightly","cron":"0 3 * * *","time_zone":"Asia/Tokyo","template_id":"3","job_generator":{"count":10,"id_by_client":"%{date}-%{index}"}}' -H 'Content-Type: application/json'
+func (h *ScheduleHandler) create(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	org := c.Get("organization").(*models.Organization)
+	payload := &SchedulePayload{}
+	if err := c.Bind(payload); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	schedule := &models.Schedule{Organization: org}
+	payload.ApplyTo(schedule)
+	if err := schedule.Create(ctx); err != nil {
+		return h.saveError(c, err)
+	}
+	return c.JSON(http.StatusCreated, schedule)
+}
+
+// curl -v http://localhost:8080/orgs/2/schedules/1
+func (h *ScheduleHandler) show(c echo.Context) error {
+	schedule := c.Get("schedule").(*models.Schedule)
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// curl -v 'http://localhost:8080/orgs/2/schedules/1/runs?limit=30'
+func (h *ScheduleHandler) runs(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	schedule := c.Get("schedule").(*models.Schedule)
+	limit := 0
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid limit: %q", v)})
+		}
+	}
+	runs, err := schedule.Runs(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, runs)
+}
+
+// curl -v -X PUT http://localhost:8080/orgs/2/schedules/1 --data '{"name":"nightly","cron":"0 4 * * *","time_zone":"Asia/Tokyo","template_id":"3","jobs":[{"id_by_client":"job1"}]}' -H 'Content-Type: application/json'
+func (h *ScheduleHandler) update(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	schedule := c.Get("schedule").(*models.Schedule)
+	payload := &SchedulePayload{}
+	if err := c.Bind(payload); err != nil {
+		log.Errorf(ctx, "err: %v\n", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	payload.ApplyTo(schedule)
+	if err := schedule.Update(ctx); err != nil {
+		return h.saveError(c, err)
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// curl -v -X DELETE http://localhost:8080/orgs/2/schedules/1
+func (h *ScheduleHandler) destroy(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	schedule := c.Get("schedule").(*models.Schedule)
+	if err := schedule.Destroy(ctx); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+func (h *ScheduleHandler) saveError(c echo.Context, err error) error {
+	switch err.(type) {
+	case *models.InvalidOperation:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return err
+}
+
+// tick is called by cron every minute. It posts run_task for each due run of the schedules.
+// The tasks are added in the transaction of Schedule.Tick, so a failed schedule is ticked
+// again at the next minute without losing its runs.
+// curl -v http://localhost:8080/schedules/tick -H 'X-Appengine-Cron: true'
+func (h *ScheduleHandler) tick(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	now := time.Now()
+	schedules, err := models.GlobalScheduleAccessor.GetDue(ctx, now)
+	if err != nil {
+		return err
+	}
+	res := map[string][]time.Time{}
+	for _, schedule := range schedules {
+		runs, err := schedule.Tick(ctx, now, func(ctx context.Context, runs []time.Time) error {
+			return h.addRunTasks(ctx, schedule, runs)
+		})
+		if err != nil {
+			log.Warningf(ctx, "Failed to tick Schedule %v. It will be ticked again at the next minute because of %v\n", schedule.ID, err)
+			continue
+		}
+		res[schedule.ID] = runs
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// addRunTasks adds run_task for each run. run_task needs no token to forward.
+func (h *ScheduleHandler) addRunTasks(ctx context.Context, schedule *models.Schedule, runs []time.Time) error {
+	tasks := []*taskqueue.Task{}
+	for _, t := range runs {
+		params := url.Values{}
+		params.Set("scheduled_at", t.UTC().Format(time.RFC3339))
+		tasks = append(tasks, taskqueue.NewPOSTTask(fmt.Sprintf("/schedules/%s/run_task", schedule.ID), params))
+	}
+	if _, err := taskqueue.AddMulti(ctx, tasks, ""); err != nil {
+		log.Errorf(ctx, "Failed to add run_task of Schedule %v to taskqueue because of %v\n", schedule.ID, err)
+		return err
+	}
+	return nil
+}
+
+// runTask creates the pipeline and its jobs for the run.
+// A failed run is recorded in the run history and isn't retried by the task queue.
+// curl -v -X POST http://localhost:8080/schedules/1/run_task --data 'scheduled_at=2018-01-02T03:00:00Z' -H 'X-Appengine-Queuename: default'
+func (h *ScheduleHandler) runTask(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	schedule := c.Get("schedule").(*models.Schedule)
+	v := c.FormValue("scheduled_at")
+	scheduledAt, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Errorf(ctx, "Invalid scheduled_at: %q\n", v)
+		return c.JSON(http.StatusOK, map[string]string{"error": fmt.Sprintf("Invalid scheduled_at: %q", v)})
+	}
+	// build_task is posted before the run succeeds to post it again when the task is retried
+	ph := &PipelineHandler{}
+	run, _, err := schedule.Run(ctx, scheduledAt, func(pl *models.Pipeline) error {
+		return ph.PostPipelineTaskIfPossible(c, pl)
+	})
+	if run == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, run)
+}
@@ -49,6 +49,16 @@ func PostOperationTaskWith(c echo.Context, action string, pl *models.PipelineOpe
 	return PostTaskWith(c, OperationTaskPath(action, pl), params, f)
 }
 
+// Methods For Job
+
+func JobTaskPath(action string, job *models.Job) string {
+	return fmt.Sprintf("/jobs/%s/%s", job.ID, action)
+}
+
+func PostJobTaskWithETA(c echo.Context, action string, job *models.Job, eta time.Time) error {
+	return PostTaskWithETA(c, JobTaskPath(action, job), eta)
+}
+
 // Base methods for tasks
 
 func PostTask(c echo.Context, path string) error {
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+const (
+	LocalSSDDiskType     = "local-ssd"
+	LocalSSDDiskSizeGb   = 375
+	AdditionalDisksMount = "/mnt/disks"
+)
+
+// MountPathRegexp allows only the characters which are safe in the docker run options of the startup script
+var MountPathRegexp = regexp.MustCompile(`\A/[-_./A-Za-z0-9]*\z`)
+
+// AdditionalDisk is a disk attached to the instances in addition to the boot disk.
+// It's mounted on /mnt/disks/<device name> of the instance and bound to MountPath of the containers.
+//
+// DiskType "local-ssd" means a local SSD. A persistent disk is created blank
+// or from SourceImage or SourceSnapshot. The blank disks including the local SSDs
+// are formatted by the startup script unless they have a filesystem already.
+type AdditionalDisk struct {
+	DiskType       string `json:"disk_type,omitempty"` // "pd-standard", "pd-ssd" or "local-ssd". Default is "pd-standard"
+	DiskSizeGb     int    `json:"disk_size_gb,omitempty"`
+	SourceImage    string `json:"source_image,omitempty"`
+	SourceSnapshot string `json:"source_snapshot,omitempty"`
+	ReadOnly       bool   `json:"read_only,omitempty"`
+	Interface      string `json:"interface,omitempty"` // "SCSI" or "NVME" for local-ssd. Default is "SCSI"
+	MountPath      string `json:"mount_path"`          // Path in the containers
+}
+
+func (d *AdditionalDisk) LocalSSD() bool {
+	return d.DiskType == LocalSSDDiskType
+}
+
+// Blank returns true if the disk must be formatted before mounting.
+func (d *AdditionalDisk) Blank() bool {
+	return d.SourceImage == "" && d.SourceSnapshot == ""
+}
+
+func (d *AdditionalDisk) Validate() error {
+	if !MountPathRegexp.MatchString(d.MountPath) || path.Clean(d.MountPath) == "/" {
+		return fmt.Errorf("Invalid mount_path: %q", d.MountPath)
+	}
+	if d.LocalSSD() {
+		switch {
+		case !d.Blank():
+			return fmt.Errorf("local-ssd disk for %q can't have source_image or source_snapshot", d.MountPath)
+		case d.ReadOnly:
+			return fmt.Errorf("local-ssd disk for %q can't be read_only", d.MountPath)
+		case d.DiskSizeGb != 0 && d.DiskSizeGb != LocalSSDDiskSizeGb:
+			return fmt.Errorf("The size of local-ssd disk for %q must be %d GB", d.MountPath, LocalSSDDiskSizeGb)
+		}
+		switch d.Interface {
+		case "", "SCSI", "NVME":
+		default:
+			return fmt.Errorf("Invalid interface of local-ssd disk for %q: %q", d.MountPath, d.Interface)
+		}
+		return nil
+	}
+	switch {
+	case d.Interface != "":
+		return fmt.Errorf("interface is available only for local-ssd disk but given for %q", d.MountPath)
+	case d.SourceImage != "" && d.SourceSnapshot != "":
+		return fmt.Errorf("Both of source_image and source_snapshot are given for %q", d.MountPath)
+	case d.Blank() && d.ReadOnly:
+		return fmt.Errorf("read_only disk for %q requires source_image or source_snapshot", d.MountPath)
+	case d.Blank() && d.DiskSizeGb <= 0:
+		return fmt.Errorf("disk_size_gb is required for the blank disk for %q", d.MountPath)
+	case d.DiskSizeGb < 0:
+		return fmt.Errorf("Invalid disk_size_gb for %q: %d", d.MountPath, d.DiskSizeGb)
+	}
+	return nil
+}
+
+type AdditionalDisks []AdditionalDisk
+
+func (disks AdditionalDisks) Validate() error {
+	paths := map[string]bool{}
+	for _, d := range disks {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+		p := path.Clean(d.MountPath)
+		if paths[p] {
+			return fmt.Errorf("Duplicated mount_path: %q", d.MountPath)
+		}
+		paths[p] = true
+	}
+	return nil
+}
+
+// DeviceName returns the device name of the idx-th disk.
+func (disks AdditionalDisks) DeviceName(idx int) string {
+	return fmt.Sprintf("data-%d", idx)
+}
+
+// DevicePath returns the path of the device of the idx-th disk on the instance.
+// The local SSDs have the names given by GCE in the order of them.
+func (disks AdditionalDisks) DevicePath(idx int) string {
+	d := &disks[idx]
+	if !d.LocalSSD() {
+		return "/dev/disk/by-id/google-" + disks.DeviceName(idx)
+	}
+	iface := StringWithDefault(d.Interface, "SCSI")
+	n := 0
+	for _, other := range disks[:idx] {
+		if other.LocalSSD() && StringWithDefault(other.Interface, "SCSI") == iface {
+			n++
+		}
+	}
+	if iface == "NVME" {
+		return fmt.Sprintf("/dev/disk/by-id/google-local-nvme-ssd-%d", n)
+	}
+	return fmt.Sprintf("/dev/disk/by-id/google-local-ssd-%d", n)
+}
+
+// HostPath returns the path where the idx-th disk is mounted on the instance.
+func (disks AdditionalDisks) HostPath(idx int) string {
+	return AdditionalDisksMount + "/" + disks.DeviceName(idx)
+}
+
+// MountCommands returns the commands of the startup script to format and mount the disks.
+func (disks AdditionalDisks) MountCommands() []string {
+	r := []string{}
+	for i, d := range disks {
+		dev := disks.DevicePath(i)
+		dir := disks.HostPath(i)
+		r = append(r, "mkdir -p "+dir)
+		if d.Blank() {
+			// Don't format it again when the instance reboots
+			r = append(r, "blkid "+dev+" || mkfs.ext4 -m 0 -F -E lazy_itable_init=0,lazy_journal_init=0,discard "+dev)
+		}
+		if d.ReadOnly {
+			r = append(r, "mount -o ro,noload "+dev+" "+dir)
+		} else {
+			r = append(r,
+				"mount -o discard,defaults "+dev+" "+dir,
+				"chmod a+w "+dir,
+			)
+		}
+	}
+	return r
+}
+
+// DockerVolumeOptions returns the options of docker run to bind the disks into the containers.
+func (disks AdditionalDisks) DockerVolumeOptions() []string {
+	r := []string{}
+	for i, d := range disks {
+		opt := "-v " + disks.HostPath(i) + ":" + d.MountPath
+		if d.ReadOnly {
+			opt += ":ro"
+		}
+		r = append(r, opt)
+	}
+	return r
+}
+
+// TemplateDisks returns the disks in the instance template properties.
+func (disks AdditionalDisks) TemplateDisks() []interface{} {
+	r := []interface{}{}
+	for i, d := range disks {
+		if d.LocalSSD() {
+			r = append(r, map[string]interface{}{
+				"type":       "SCRATCH",
+				"autoDelete": true,
+				"interface":  StringWithDefault(d.Interface, "SCSI"),
+				"initializeParams": map[string]interface{}{
+					"diskType": LocalSSDDiskType,
+				},
+			})
+			continue
+		}
+		initParams := map[string]interface{}{}
+		if d.DiskType != "" {
+			initParams["diskType"] = d.DiskType
+		}
+		if d.DiskSizeGb > 0 {
+			initParams["diskSizeGb"] = d.DiskSizeGb
+		}
+		if d.SourceImage != "" {
+			initParams["sourceImage"] = d.SourceImage
+		}
+		if d.SourceSnapshot != "" {
+			initParams["sourceSnapshot"] = d.SourceSnapshot
+		}
+		mode := "READ_WRITE"
+		if d.ReadOnly {
+			mode = "READ_ONLY"
+		}
+		r = append(r, map[string]interface{}{
+			"deviceName":       disks.DeviceName(i),
+			"type":             "PERSISTENT",
+			"boot":             false,
+			"autoDelete":       true,
+			"mode":             mode,
+			"initializeParams": initParams,
+		})
+	}
+	return r
+}
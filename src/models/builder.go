@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
 
 	"google.golang.org/api/deploymentmanager/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 )
 
@@ -43,6 +46,12 @@ func (b *Builder) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation
 		return nil, err
 	}
 	ope, err := b.deployer.Insert(ctx, pl.ProjectID, deployment)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+		// The deployment was inserted by the previous build_task which failed before Deploying
+		// or by the build_task posted again by Refresher. Wait for the operation of the deployment.
+		log.Warningf(ctx, "Deployment %v already exists. Wait for its operation\n", deployment.Name)
+		ope, err = b.existingOperation(ctx, pl, deployment.Name)
+	}
 	if err != nil {
 		log.Errorf(ctx, "Failed to insert deployment %v\nproject: %v deployment: %v\n", err, pl.ProjectID, deployment)
 		return nil, err
@@ -59,7 +68,7 @@ func (b *Builder) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation
 	operation := &PipelineOperation{
 		Pipeline:      pl,
 		ProjectID:     pl.ProjectID,
-		Zone:          pl.Zone,
+		Zone:          pl.Location(),
 		Service:       "deploymentmanager",
 		Name:          ope.Name,
 		OperationType: ope.OperationType,
@@ -77,6 +86,134 @@ func (b *Builder) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation
 	return operation, nil
 }
 
+// existingOperation returns the latest operation of the deployment.
+// The deployment must have the pipeline ID label of pl because the pipeline names aren't unique.
+// Otherwise the pipeline gets Broken not to use the resources of another pipeline.
+func (b *Builder) existingOperation(ctx context.Context, pl *Pipeline, name string) (*deploymentmanager.Operation, error) {
+	d, err := b.deployer.Get(ctx, pl.ProjectID, name)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get deployment %v/%v because of %v\n", pl.ProjectID, name, err)
+		return nil, err
+	}
+	owned := false
+	for _, label := range d.Labels {
+		if label.Key == PipelineIDLabel && label.Value == LabelValueOfID(pl.ID) {
+			owned = true
+		}
+	}
+	if !owned {
+		if err := pl.FailBuilding(ctx); err != nil {
+			return nil, err
+		}
+		return nil, &InvalidOperation{Msg: fmt.Sprintf("Deployment %v/%v already exists for another pipeline", pl.ProjectID, name)}
+	}
+	if d.Operation == nil {
+		return nil, fmt.Errorf("Deployment %v/%v has no operation", pl.ProjectID, name)
+	}
+	return d.Operation, nil
+}
+
+// Update replaces the instance template of the deployment with the next version
+// of the pipeline's configuration. The instances are replaced by rolling update
+// after the operation is done.
+// It's idempotent for the retry of update_task. The next version and the fingerprint of
+// the deployment are saved before updating the deployment, and the operation already
+// created for the version is returned without updating the deployment again.
+func (b *Builder) Update(ctx context.Context, pl *Pipeline) (*PipelineOperation, error) {
+	if pl.Organization == nil {
+		// The labels of the organization are given to the resources
+		err := pl.LoadOrganization(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Failed to load Organization for Pipeline: %v\npl: %v\n", err, pl)
+			return nil, err
+		}
+	}
+
+	if pl.UpdatingVersion == 0 {
+		current, err := b.deployer.Get(ctx, pl.ProjectID, pl.DeploymentName)
+		if err != nil {
+			log.Errorf(ctx, "Failed to get deployment %v/%v because of %v\n", pl.ProjectID, pl.DeploymentName, err)
+			return nil, err
+		}
+		err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := pl.Reload(ctx); err != nil {
+				return err
+			}
+			if pl.UpdatingVersion != 0 {
+				// Started by another update_task
+				return nil
+			}
+			pl.TemplateVersion += 1
+			pl.UpdatingVersion = pl.TemplateVersion
+			pl.UpdatingFingerprint = current.Fingerprint
+			return pl.Update(ctx)
+		}, GetTransactionOptions())
+		if err != nil {
+			log.Errorf(ctx, "Failed to update Pipeline template version to %d: %v\npl: %v\n", pl.TemplateVersion+1, err, pl)
+			return nil, err
+		}
+	}
+
+	existing, err := pl.UpdateOperationOf(ctx, pl.UpdatingVersion)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		log.Warningf(ctx, "Pipeline %v is already being updated to template version %d by %v\n", pl.ID, pl.UpdatingVersion, existing.Name)
+		return existing, nil
+	}
+
+	deployment, err := b.BuildDeployment(pl)
+	if err != nil {
+		log.Errorf(ctx, "Failed to BuildDeployment: %v\nPipeline: %v\n", err, pl)
+		return nil, err
+	}
+	deployment.Name = pl.DeploymentName
+	// The fingerprint is required to update the deployment.
+	// The deployment updated by the previous update_task doesn't accept it any more.
+	deployment.Fingerprint = pl.UpdatingFingerprint
+
+	ope, err := b.deployer.Update(ctx, pl.ProjectID, deployment)
+	if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusConflict || e.Code == http.StatusPreconditionFailed) {
+		log.Warningf(ctx, "Deployment %v was already updated. Wait for its operation\n", deployment.Name)
+		var d *deploymentmanager.Deployment
+		d, err = b.deployer.Get(ctx, pl.ProjectID, pl.DeploymentName)
+		if err == nil {
+			if d.Operation == nil {
+				err = fmt.Errorf("Deployment %v/%v has no operation", pl.ProjectID, pl.DeploymentName)
+			}
+			ope = d.Operation
+		}
+	}
+	if err != nil {
+		log.Errorf(ctx, "Failed to update deployment %v\nproject: %v deployment: %v\n", err, pl.ProjectID, deployment)
+		return nil, err
+	}
+
+	log.Infof(ctx, "Started updating pipeline %v to template version %d\n", pl.ID, pl.TemplateVersion)
+
+	operation := &PipelineOperation{
+		Pipeline:        pl,
+		ProjectID:       pl.ProjectID,
+		Zone:            pl.Location(),
+		Service:         "deploymentmanager",
+		Name:            ope.Name,
+		OperationType:   ope.OperationType,
+		Status:          ope.Status,
+		TemplateVersion: pl.UpdatingVersion,
+		Logs: []OperationLog{
+			OperationLog{CreatedAt: time.Now(), Message: fmt.Sprintf("Start updating to %s", pl.InstanceTemplateName())},
+		},
+	}
+	err = operation.Create(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to create PipelineOperation: %v because of %v\n", operation, err)
+		return nil, err
+	}
+
+	return operation, nil
+}
+
 func (b *Builder) BuildDeployment(pl *Pipeline) (*deploymentmanager.Deployment, error) {
 	r := b.GenerateDeploymentResources(pl)
 	d, err := json.Marshal(r)
@@ -92,6 +229,9 @@ func (b *Builder) BuildDeployment(pl *Pipeline) (*deploymentmanager.Deployment,
 		Name:   pl.Name,
 		Target: &tc,
 	}
+	for _, label := range pl.MergedLabels() {
+		dm.Labels = append(dm.Labels, &deploymentmanager.DeploymentLabelEntry{Key: label.Key, Value: label.Value})
+	}
 	return &dm, nil
 }
 
@@ -107,38 +247,54 @@ type (
 	}
 )
 
+const (
+	PubsubAPIBaseURL       = "https://pubsub.googleapis.com/v1/"
+	ControlAckDeadline     = 30
+	ControlSubscriptionTTL = "86400s" // The minimum TTL of subscriptions
+)
+
 type (
 	Pubsub struct {
 		Name        string
 		AckDeadline int
+		PerWorker   bool // The subscriptions are created by each worker container at startup
 	}
 )
 
 func (b *Builder) GenerateDeploymentResources(pl *Pipeline) *Resources {
+	labels := pl.MergedLabels()
 	t := []Resource{}
 	pubsubs := []Pubsub{
 		Pubsub{Name: "job", AckDeadline: 600},
 		Pubsub{Name: "progress", AckDeadline: 30},
+		Pubsub{Name: "control", AckDeadline: ControlAckDeadline, PerWorker: true},
 	}
 	for _, pubsub := range pubsubs {
 		topic := pl.Name + "-" + pubsub.Name + "-topic"
 		subscription := pl.Name + "-" + pubsub.Name + "-subscription"
-		t = append(t,
-			Resource{
-				Type:       "pubsub.v1.topic",
-				Name:       topic,
-				Properties: map[string]interface{}{"topic": topic},
-			},
-			Resource{
-				Type: "pubsub.v1.subscription",
-				Name: subscription,
-				Properties: map[string]interface{}{
-					"subscription":       subscription,
-					"topic":              fmt.Sprintf("$(ref.%s.name)", topic),
-					"ackDeadlineSeconds": pubsub.AckDeadline,
-				},
-			},
-		)
+		topicProps := map[string]interface{}{"topic": topic}
+		subscriptionProps := map[string]interface{}{
+			"subscription":       subscription,
+			"topic":              fmt.Sprintf("$(ref.%s.name)", topic),
+			"ackDeadlineSeconds": pubsub.AckDeadline,
+		}
+		if len(labels) > 0 {
+			topicProps["labels"] = b.buildLabels(labels)
+			subscriptionProps["labels"] = b.buildLabels(labels)
+		}
+		t = append(t, Resource{
+			Type:       "pubsub.v1.topic",
+			Name:       topic,
+			Properties: topicProps,
+		})
+		if pubsub.PerWorker {
+			continue
+		}
+		t = append(t, Resource{
+			Type:       "pubsub.v1.subscription",
+			Name:       subscription,
+			Properties: subscriptionProps,
+		})
 	}
 
 	t = append(t,
@@ -149,13 +305,16 @@ func (b *Builder) GenerateDeploymentResources(pl *Pipeline) *Resources {
 }
 
 func (b *Builder) buildItResource(pl *Pipeline) Resource {
+	props := map[string]interface{}{
+		"properties": b.buildItProperties(pl),
+	}
+	if !pl.Regional() {
+		props["zone"] = pl.Zone
+	}
 	return Resource{
-		Type: "compute.v1.instanceTemplate",
-		Name: pl.Name + "-it",
-		Properties: map[string]interface{}{
-			"zone":       pl.Zone,
-			"properties": b.buildItProperties(pl),
-		},
+		Type:       "compute.v1.instanceTemplate",
+		Name:       pl.InstanceTemplateName(),
+		Properties: props,
 	}
 }
 
@@ -172,15 +331,25 @@ func (b *Builder) buildItProperties(pl *Pipeline) map[string]interface{} {
 			},
 		},
 		"networkInterfaces": []interface{}{
-			b.buildDefaultNetwork(pl),
+			b.buildNetworkInterface(pl),
 		},
 		"scheduling": scheduling,
 		"serviceAccounts": []interface{}{
-			b.buildScopes(),
+			b.buildServiceAccount(pl),
 		},
-		"disks": []interface{}{
+		"disks": append([]interface{}{
 			b.buildBootDisk(&pl.BootDisk),
-		},
+		}, pl.AdditionalDisks.TemplateDisks()...),
+	}
+
+	if labels := pl.MergedLabels(); len(labels) > 0 {
+		it_properties["labels"] = b.buildLabels(labels)
+	}
+
+	if len(pl.Network.Tags) > 0 {
+		it_properties["tags"] = map[string]interface{}{
+			"items": stringsToInterfaces(pl.Network.Tags),
+		}
 	}
 
 	if pl.GpuAccelerators.Count > 0 {
@@ -203,16 +372,39 @@ func (b *Builder) buildGuestAccelerators(pl *Pipeline) map[string]interface{} {
 
 func (b *Builder) buildIgmResource(pl *Pipeline) Resource {
 	name := pl.Name + "-igm"
+	props := map[string]interface{}{
+		"name":             name,
+		"baseInstanceName": pl.Name + "-instance",
+		"instanceTemplate": "$(ref." + pl.InstanceTemplateName() + ".selfLink)",
+		"targetSize":       pl.TargetSize,
+	}
+	if !pl.Regional() {
+		props["zone"] = pl.Zone
+		return Resource{
+			Type:       "compute.v1.instanceGroupManagers",
+			Name:       name,
+			Properties: props,
+		}
+	}
+
+	props["region"] = pl.Region
+	// Don't delete the instances running jobs to rebalance them across the zones
+	props["updatePolicy"] = map[string]interface{}{
+		"instanceRedistributionType": InstanceRedistributionNone,
+	}
+	if len(pl.Zones) > 0 {
+		zones := []interface{}{}
+		for _, url := range pl.ZoneURLs() {
+			zones = append(zones, map[string]interface{}{"zone": url})
+		}
+		props["distributionPolicy"] = map[string]interface{}{
+			"zones": zones,
+		}
+	}
 	return Resource{
-		Type: "compute.v1.instanceGroupManagers",
-		Name: name,
-		Properties: map[string]interface{}{
-			"name":             name,
-			"baseInstanceName": pl.Name + "-instance",
-			"instanceTemplate": "$(ref." + pl.Name + "-it.selfLink)",
-			"targetSize":       pl.TargetSize,
-			"zone":             pl.Zone,
-		},
+		Type:       "compute.v1.regionInstanceGroupManagers",
+		Name:       name,
+		Properties: props,
 	}
 }
 
@@ -224,28 +416,51 @@ func (b *Builder) buildStartupScriptMetadataItem(pl *Pipeline) map[string]interf
 	}
 }
 
-func (b *Builder) buildDefaultNetwork(pl *Pipeline) map[string]interface{} {
-	return map[string]interface{}{
-		"network": "https://www.googleapis.com/compute/v1/projects/" + pl.ProjectID + "/global/networks/default",
-		"accessConfigs": []interface{}{
+func (b *Builder) buildNetworkInterface(pl *Pipeline) map[string]interface{} {
+	n := &pl.Network
+	r := map[string]interface{}{}
+	if url := n.NetworkURL(pl.ProjectID); url != "" {
+		r["network"] = url
+	}
+	if url := n.SubnetworkURL(pl.ProjectID, pl.RegionName()); url != "" {
+		r["subnetwork"] = url
+	}
+	if !n.NoExternalIP {
+		r["accessConfigs"] = []interface{}{
 			map[string]interface{}{
 				"name": "External-IP",
 				"type": "ONE_TO_ONE_NAT",
 			},
-		},
+		}
 	}
+	return r
 }
 
-func (b *Builder) buildScopes() map[string]interface{} {
-	return map[string]interface{}{
-		"scopes": []interface{}{
-			"https://www.googleapis.com/auth/devstorage.full_control",
-			"https://www.googleapis.com/auth/pubsub",
-			"https://www.googleapis.com/auth/logging.write",
-			"https://www.googleapis.com/auth/monitoring.write",
-			"https://www.googleapis.com/auth/cloud-platform",
-		},
+func (b *Builder) buildLabels(labels Labels) map[string]interface{} {
+	r := map[string]interface{}{}
+	for _, label := range labels {
+		r[label.Key] = label.Value
 	}
+	return r
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	r := []interface{}{}
+	for _, v := range values {
+		r = append(r, v)
+	}
+	return r
+}
+
+func (b *Builder) buildServiceAccount(pl *Pipeline) map[string]interface{} {
+	sa := &pl.ServiceAccount
+	r := map[string]interface{}{
+		"scopes": stringsToInterfaces(sa.ScopeURLs()),
+	}
+	if sa.Email != "" {
+		r["email"] = sa.Email
+	}
+	return r
 }
 
 func (b *Builder) buildBootDisk(disk *PipelineVmDisk) map[string]interface{} {
@@ -275,6 +490,17 @@ var (
 	GcrImageHostRegexp      = regexp.MustCompile(GcrHostPatternBase)
 )
 
+// ZoneFromMetadata is the shell expression to get the zone of the instance
+// because the zone of an instance in a regional instance group is decided by GCE.
+const ZoneFromMetadata = `$(curl -s -H "Metadata-Flavor: Google" http://metadata.google.internal/computeMetadata/v1/instance/zone | cut -d/ -f4)`
+
+func (b *Builder) buildZoneValue(pl *Pipeline) string {
+	if pl.Regional() {
+		return ZoneFromMetadata
+	}
+	return pl.Zone
+}
+
 const StackdriverAgentCommand = "docker run -d -e MONITOR_HOST=true -v /proc:/mnt/proc:ro --privileged wikiwi/stackdriver-agent"
 
 func (b *Builder) buildStartupScript(pl *Pipeline) string {
@@ -317,24 +543,55 @@ func (b *Builder) buildStartupScript(pl *Pipeline) string {
 		"-e PROJECT=" + pl.ProjectID,
 		"-e DOCKER_HOSTNAME=$(hostname)",
 		"-e PIPELINE=" + pl.Name,
-		"-e ZONE=" + pl.Zone,
+		"-e ZONE=" + b.buildZoneValue(pl),
 		"-e BLOCKS_BATCH_PUBSUB_SUBSCRIPTION=$(ref." + pl.Name + "-job-subscription.name)",
 		"-e BLOCKS_BATCH_PROGRESS_TOPIC=$(ref." + pl.Name + "-progress-topic.name)",
+		"-e BLOCKS_BATCH_CONTROL_SUBSCRIPTION=$CONTROL_SUBSCRIPTION",
 	}
+	docker_run_parts = append(docker_run_parts, pl.AdditionalDisks.DockerVolumeOptions()...)
 	if pl.DockerRunOptions != "" {
 		docker_run_parts = append(docker_run_parts, pl.DockerRunOptions)
 	}
 	docker_run_parts = append(docker_run_parts, pl.ContainerName, pl.Command)
 
+	r = append(r, pl.AdditionalDisks.MountCommands()...)
 	r = append(r,
+		b.buildCreateControlSubscription(pl),
 		"with_backoff "+docker+" pull "+pl.ContainerName,
 		fmt.Sprintf("for i in {1..%v}; do", pl.ContainerSize),
+		"  CONTROL_SUBSCRIPTION="+pl.ControlSubscriptionFqn("$(hostname)-$i"),
+		"  with_backoff create_control_subscription $CONTROL_SUBSCRIPTION",
 		"  "+strings.Join(docker_run_parts, " \\\n    "),
 		"done",
 	)
 	return strings.Join(r, "\n")
 }
 
+// buildCreateControlSubscription returns the shell function to create the control subscription given as $1.
+// Each worker container has its own subscription because Pub/Sub delivers a message
+// to only one of the subscribers of a subscription but to every subscription of the topic.
+// So the worker which runs the job always receives its cancel command.
+// The subscriptions expire after the instances are deleted.
+func (b *Builder) buildCreateControlSubscription(pl *Pipeline) string {
+	body := map[string]interface{}{
+		"topic":              pl.ControlTopicFqn(),
+		"ackDeadlineSeconds": ControlAckDeadline,
+		"expirationPolicy":   map[string]interface{}{"ttl": ControlSubscriptionTTL},
+	}
+	if labels := pl.MergedLabels(); len(labels) > 0 {
+		body["labels"] = b.buildLabels(labels)
+	}
+	data, _ := json.Marshal(body) // It never fails with strings and numbers
+	return strings.Join([]string{
+		"function create_control_subscription {",
+		"  local token=$(curl -sf -H 'Metadata-Flavor: Google' http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token | cut -d'\"' -f 4)",
+		"  local code=$(curl -s -o /dev/null -w '%{http_code}' -X PUT -H \"Authorization: Bearer $token\" -H 'Content-Type: application/json' -d '" + string(data) + "' " + PubsubAPIBaseURL + "$1)",
+		"  # 409 means that it was created before the instance restarted",
+		"  [[ $code == 200 || $code == 409 ]]",
+		"}",
+	}, "\n")
+}
+
 func (b *Builder) buildInstallCuda(pl *Pipeline) string {
 	return `
 if ! dpkg-query -W cuda; then
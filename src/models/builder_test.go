@@ -57,7 +57,7 @@ func TestGenerateContent(t *testing.T) {
 		}
 	}
 	assert.Equal(t, expected, result)
-	props0 := result.Resources[4].Properties
+	props0 := result.Resources[5].Properties
 	assert.IsType(t, map[string]interface{}(nil), props0["properties"])
 	props1 := props0["properties"].(map[string]interface{})
 	assert.IsType(t, map[string]interface{}(nil), props1["scheduling"])
@@ -67,7 +67,7 @@ func TestGenerateContent(t *testing.T) {
 	// preemptible
 	pl.Preemptible = true
 	result = b.GenerateDeploymentResources(&pl)
-	props0 = result.Resources[4].Properties
+	props0 = result.Resources[5].Properties
 	assert.IsType(t, map[string]interface{}(nil), props0["properties"])
 	props1 = props0["properties"].(map[string]interface{})
 	assert.IsType(t, map[string]interface{}(nil), props1["scheduling"])
@@ -164,7 +164,7 @@ func TestBuildDeploymentWithGPU(t *testing.T) {
 	assert.NoError(t, err)
 	actual := b.buildItProperties(pl)
 	assert.NoError(t, err)
-	assert.Equal(t, expected.Resources[4].Properties["properties"], actual)
+	assert.Equal(t, expected.Resources[5].Properties["properties"], actual)
 }
 
 func setupTestBuildStartupScript() (*Builder, *Pipeline) {
@@ -189,15 +189,19 @@ func TestBuildStartupScript1(t *testing.T) {
 	b, pl := setupTestBuildStartupScript()
 	ss := b.buildStartupScript(pl)
 	startupScriptBodyBase :=
-		"with_backoff docker pull groovenauts/batch_type_iot_example:0.3.1\n" +
+		b.buildCreateControlSubscription(pl) + "\n" +
+			"with_backoff docker pull groovenauts/batch_type_iot_example:0.3.1\n" +
 			"for i in {1..2}; do" +
+			"\n  CONTROL_SUBSCRIPTION=projects/dummy-proj-999/subscriptions/pipeline01-control-$(hostname)-$i" +
+			"\n  with_backoff create_control_subscription $CONTROL_SUBSCRIPTION" +
 			"\n  docker run -d" +
 			" \\\n    -e PROJECT=" + pl.ProjectID +
 			" \\\n    -e DOCKER_HOSTNAME=$(hostname)" +
 			" \\\n    -e PIPELINE=" + pl.Name +
 			" \\\n    -e ZONE=" + pl.Zone +
 			" \\\n    -e BLOCKS_BATCH_PUBSUB_SUBSCRIPTION=$(ref." + pl.Name + "-job-subscription.name)" +
-			" \\\n    -e BLOCKS_BATCH_PROGRESS_TOPIC=$(ref." + pl.Name + "-progress-topic.name)"
+			" \\\n    -e BLOCKS_BATCH_PROGRESS_TOPIC=$(ref." + pl.Name + "-progress-topic.name)" +
+			" \\\n    -e BLOCKS_BATCH_CONTROL_SUBSCRIPTION=$CONTROL_SUBSCRIPTION"
 	startupScriptBody0 := startupScriptBodyBase +
 		" \\\n    " + pl.ContainerName +
 		" \\\n    " + pl.Command +
@@ -239,8 +243,11 @@ func TestBuildStartupScript2(t *testing.T) {
 			"\nSVC_ACCT=$METADATA/instance/service-accounts/default" +
 			"\nACCESS_TOKEN=$(curl -H 'Metadata-Flavor: Google' $SVC_ACCT/token | cut -d'\"' -f 4)" +
 			"\nwith_backoff docker --config /home/chronos/.docker login -u oauth2accesstoken -p $ACCESS_TOKEN https://asia.gcr.io" +
+			"\n" + b.buildCreateControlSubscription(pl) +
 			"\nwith_backoff docker --config /home/chronos/.docker pull " + pl.ContainerName +
 			"\nfor i in {1..2}; do" +
+			"\n  CONTROL_SUBSCRIPTION=projects/dummy-proj-999/subscriptions/pipeline01-control-$(hostname)-$i" +
+			"\n  with_backoff create_control_subscription $CONTROL_SUBSCRIPTION" +
 			"\n  docker --config /home/chronos/.docker run -d" +
 			" \\\n    -e PROJECT=" + pl.ProjectID +
 			" \\\n    -e DOCKER_HOSTNAME=$(hostname)" +
@@ -248,6 +255,7 @@ func TestBuildStartupScript2(t *testing.T) {
 			" \\\n    -e ZONE=" + pl.Zone +
 			" \\\n    -e BLOCKS_BATCH_PUBSUB_SUBSCRIPTION=$(ref." + pl.Name + "-job-subscription.name)" +
 			" \\\n    -e BLOCKS_BATCH_PROGRESS_TOPIC=$(ref." + pl.Name + "-progress-topic.name)" +
+			" \\\n    -e BLOCKS_BATCH_CONTROL_SUBSCRIPTION=$CONTROL_SUBSCRIPTION" +
 			" \\\n    " + pl.ContainerName +
 			" \\\n    " + pl.Command +
 			"\ndone"
@@ -264,6 +272,26 @@ func TestBuildStartupScript2(t *testing.T) {
 	assert.Equal(t, expected, ss)
 }
 
+func TestBuildControlSubscriptionPerWorker(t *testing.T) {
+	b, pl := setupTestBuildStartupScript()
+
+	// No subscription shared by the workers
+	for _, r := range b.GenerateDeploymentResources(pl).Resources {
+		assert.NotEqual(t, "pipeline01-control-subscription", r.Name)
+	}
+
+	// Each container creates its own subscription to the control topic and
+	// Pub/Sub delivers every cancel command to all of them including the worker running the job
+	ss := b.buildStartupScript(pl)
+	assert.Contains(t, ss, `"topic":"projects/dummy-proj-999/topics/pipeline01-control-topic"`)
+	assert.Contains(t, ss, "-e DOCKER_HOSTNAME=$(hostname)")
+	assert.Contains(t, ss, "\n  CONTROL_SUBSCRIPTION="+pl.ControlSubscriptionFqn("$(hostname)-$i")+
+		"\n  with_backoff create_control_subscription $CONTROL_SUBSCRIPTION\n")
+	assert.Contains(t, ss, "-e BLOCKS_BATCH_CONTROL_SUBSCRIPTION=$CONTROL_SUBSCRIPTION")
+	assert.NotEqual(t, pl.ControlSubscriptionFqn("worker-1-1"), pl.ControlSubscriptionFqn("worker-1-2"))
+	assert.NotEqual(t, pl.ControlSubscriptionFqn("worker-1-1"), pl.ControlSubscriptionFqn("worker-2-1"))
+}
+
 func TestBuildBootDisk(t *testing.T) {
 	b := &Builder{}
 	d1 := PipelineVmDisk{
@@ -289,6 +317,178 @@ func TestBuildBootDisk(t *testing.T) {
 	assert.Contains(t, p2, "diskType")
 }
 
+func TestBuildNetworkInterface(t *testing.T) {
+	b := &Builder{}
+	pl := &Pipeline{ProjectID: "dummy-proj-999", Zone: "asia-east1-a"}
+	r1 := b.buildNetworkInterface(pl)
+	assert.Equal(t, "https://www.googleapis.com/compute/v1/projects/dummy-proj-999/global/networks/default", r1["network"])
+	assert.NotContains(t, r1, "subnetwork")
+	assert.Contains(t, r1, "accessConfigs")
+
+	err := json.Unmarshal([]byte(`{"network":{"subnetwork":"workers","host_project_id":"host-proj-1","tags":["batch"],"external_ip":false}}`), pl)
+	assert.NoError(t, err)
+	assert.True(t, pl.Network.NoExternalIP)
+	assert.NoError(t, pl.Network.Validate(pl.RegionName()))
+	r2 := b.buildNetworkInterface(pl)
+	assert.NotContains(t, r2, "network")
+	assert.Equal(t, "https://www.googleapis.com/compute/v1/projects/host-proj-1/regions/asia-east1/subnetworks/workers", r2["subnetwork"])
+	assert.NotContains(t, r2, "accessConfigs")
+	p := b.buildItProperties(pl)
+	assert.Equal(t, map[string]interface{}{"items": []interface{}{"batch"}}, p["tags"])
+
+	// Overriding a part of the network keeps the others
+	err = json.Unmarshal([]byte(`{"network":{"network":"vpc1"}}`), pl)
+	assert.NoError(t, err)
+	assert.True(t, pl.Network.NoExternalIP)
+	r3 := b.buildNetworkInterface(pl)
+	assert.Equal(t, "https://www.googleapis.com/compute/v1/projects/host-proj-1/global/networks/vpc1", r3["network"])
+
+	invalids := []PipelineNetwork{
+		{Network: "Invalid_Name"},
+		{HostProjectID: "host-proj-1"},
+		{Subnetwork: "projects/host-proj-1/regions/us-central1/subnetworks/workers"},
+		{Tags: []string{"-invalid"}},
+	}
+	for _, n := range invalids {
+		assert.Error(t, n.Validate(pl.RegionName()), "%v", n)
+	}
+}
+
+func TestBuildServiceAccount(t *testing.T) {
+	b := &Builder{}
+	pl := &Pipeline{}
+	r1 := b.buildServiceAccount(pl)
+	assert.NotContains(t, r1, "email")
+	assert.Equal(t, len(DefaultScopes), len(r1["scopes"].([]interface{})))
+
+	pl.ServiceAccount = ServiceAccount{
+		Email:  "worker@dummy-proj-999.iam.gserviceaccount.com",
+		Scopes: []string{"pubsub", "https://www.googleapis.com/auth/devstorage.read_only"},
+	}
+	r2 := b.buildServiceAccount(pl)
+	assert.Equal(t, "worker@dummy-proj-999.iam.gserviceaccount.com", r2["email"])
+	assert.Equal(t, []interface{}{
+		"https://www.googleapis.com/auth/pubsub",
+		"https://www.googleapis.com/auth/devstorage.read_only",
+	}, r2["scopes"])
+}
+
+func TestBuildRegionalIgmResource(t *testing.T) {
+	b := &Builder{}
+	pl := &Pipeline{
+		Name:       "pipeline01",
+		ProjectID:  "dummy-proj-999",
+		Region:     "asia-east1",
+		Zones:      []string{"asia-east1-a", "asia-east1-b"},
+		TargetSize: 2,
+	}
+	r := b.buildIgmResource(pl)
+	assert.Equal(t, "compute.v1.regionInstanceGroupManagers", r.Type)
+	assert.Equal(t, "asia-east1", r.Properties["region"])
+	assert.NotContains(t, r.Properties, "zone")
+	assert.Equal(t, map[string]interface{}{
+		"zones": []interface{}{
+			map[string]interface{}{"zone": "https://www.googleapis.com/compute/v1/projects/dummy-proj-999/zones/asia-east1-a"},
+			map[string]interface{}{"zone": "https://www.googleapis.com/compute/v1/projects/dummy-proj-999/zones/asia-east1-b"},
+		},
+	}, r.Properties["distributionPolicy"])
+	assert.Equal(t, map[string]interface{}{"instanceRedistributionType": "NONE"}, r.Properties["updatePolicy"])
+	assert.Contains(t, b.buildStartupScript(pl), "-e ZONE="+ZoneFromMetadata)
+
+	assert.True(t, IsRegion("asia-east1"))
+	assert.False(t, IsRegion("asia-east1-a"))
+	assert.Equal(t, "asia-east1", pl.Location())
+	assert.Equal(t, "asia-east1", pl.RegionName())
+
+	validate := func(pl Pipeline) error {
+		pl.Organization = &Organization{Name: "org01"}
+		pl.BootDisk = PipelineVmDisk{SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable"}
+		pl.MachineType = "f1-micro"
+		pl.ContainerSize = 1
+		pl.ContainerName = "groovenauts/batch_type_iot_example:0.3.1"
+		return pl.Validate()
+	}
+	assert.NoError(t, validate(*pl))
+	invalids := []Pipeline{
+		{Name: "p1", ProjectID: "dummy-proj-999", TargetSize: 1},
+		{Name: "p1", ProjectID: "dummy-proj-999", TargetSize: 1, Zone: "asia-east1-a", Region: "asia-east1"},
+		{Name: "p1", ProjectID: "dummy-proj-999", TargetSize: 1, Region: "asia-east1-a"},
+		{Name: "p1", ProjectID: "dummy-proj-999", TargetSize: 1, Zone: "asia-east1-a", Zones: []string{"asia-east1-b"}},
+		{Name: "p1", ProjectID: "dummy-proj-999", TargetSize: 1, Region: "asia-east1", Zones: []string{"us-central1-b"}},
+	}
+	for _, invalid := range invalids {
+		assert.Error(t, validate(invalid), "%v", invalid)
+	}
+}
+
+func TestBuildAdditionalDisks(t *testing.T) {
+	b, pl := setupTestBuildStartupScript()
+	pl.AdditionalDisks = AdditionalDisks{
+		{DiskType: "pd-ssd", DiskSizeGb: 200, MountPath: "/scratch"},
+		{DiskType: "local-ssd", Interface: "NVME", MountPath: "/tmp/work"},
+		{SourceSnapshot: "global/snapshots/models-20180101", ReadOnly: true, MountPath: "/models"},
+	}
+	assert.NoError(t, pl.AdditionalDisks.Validate())
+
+	disks := b.buildItProperties(pl)["disks"].([]interface{})
+	assert.Equal(t, 4, len(disks))
+	assert.Equal(t, map[string]interface{}{
+		"deviceName": "data-0",
+		"type":       "PERSISTENT",
+		"boot":       false,
+		"autoDelete": true,
+		"mode":       "READ_WRITE",
+		"initializeParams": map[string]interface{}{
+			"diskType":   "pd-ssd",
+			"diskSizeGb": 200,
+		},
+	}, disks[1])
+	assert.Equal(t, map[string]interface{}{
+		"type":       "SCRATCH",
+		"autoDelete": true,
+		"interface":  "NVME",
+		"initializeParams": map[string]interface{}{
+			"diskType": "local-ssd",
+		},
+	}, disks[2])
+	assert.Equal(t, "READ_ONLY", disks[3].(map[string]interface{})["mode"])
+
+	ss := b.buildStartupScript(pl)
+	assert.Contains(t, ss, "\nmkdir -p /mnt/disks/data-0\n"+
+		"blkid /dev/disk/by-id/google-data-0 || mkfs.ext4 -m 0 -F -E lazy_itable_init=0,lazy_journal_init=0,discard /dev/disk/by-id/google-data-0\n"+
+		"mount -o discard,defaults /dev/disk/by-id/google-data-0 /mnt/disks/data-0\n"+
+		"chmod a+w /mnt/disks/data-0\n")
+	assert.Contains(t, ss, "mount -o discard,defaults /dev/disk/by-id/google-local-nvme-ssd-0 /mnt/disks/data-1\n")
+	assert.Contains(t, ss, "\nmkdir -p /mnt/disks/data-2\nmount -o ro,noload /dev/disk/by-id/google-data-2 /mnt/disks/data-2\n")
+	assert.Contains(t, ss, " \\\n    -v /mnt/disks/data-0:/scratch"+
+		" \\\n    -v /mnt/disks/data-1:/tmp/work"+
+		" \\\n    -v /mnt/disks/data-2:/models:ro"+
+		" \\\n    "+pl.ContainerName)
+
+	invalids := []AdditionalDisk{
+		{DiskSizeGb: 10, MountPath: "relative"},
+		{DiskSizeGb: 10, MountPath: "/"},
+		{MountPath: "/blank"},
+		{DiskSizeGb: 10, ReadOnly: true, MountPath: "/blank"},
+		{SourceImage: "global/images/foo", SourceSnapshot: "global/snapshots/bar", MountPath: "/data"},
+		{DiskType: "local-ssd", DiskSizeGb: 100, MountPath: "/data"},
+		{DiskType: "local-ssd", Interface: "IDE", MountPath: "/data"},
+		{DiskType: "local-ssd", SourceImage: "global/images/foo", MountPath: "/data"},
+		{DiskSizeGb: 10, MountPath: "/data;rm -rf /"},
+		{DiskSizeGb: 10, MountPath: "/data$(id)"},
+		{DiskSizeGb: 10, MountPath: "/data'quoted'"},
+		{DiskSizeGb: 10, MountPath: "/data dir"},
+	}
+	for _, d := range invalids {
+		assert.Error(t, d.Validate(), "%v", d)
+	}
+	dup := AdditionalDisks{
+		{DiskSizeGb: 10, MountPath: "/data"},
+		{DiskType: "local-ssd", MountPath: "/data/"},
+	}
+	assert.Error(t, dup.Validate())
+}
+
 func TestGoogleapiError(t *testing.T) {
 	// See https://github.com/google/google-api-go-client/blob/master/googleapi/googleapi.go#L114-L135
 	msg := "'projects/optical-hangar-158902/global/deployments/pipeline-mjr-59-20170926-163820' already exists and cannot be created., duplicate"
@@ -36,7 +36,7 @@ func (b *Closer) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation,
 	operation := &PipelineOperation{
 		Pipeline:      pl,
 		ProjectID:     pl.ProjectID,
-		Zone:          pl.Zone,
+		Zone:          pl.Location(),
 		Service:       "deploymentmanager",
 		Name:          ope.Name,
 		OperationType: ope.OperationType,
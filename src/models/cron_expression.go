@@ -0,0 +1,170 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpression is a cron expression with 5 fields: minute, hour, day of month, month and day of week.
+// Each field accepts *, numbers, ranges like 1-5, steps like */15 or 0-30/10 and lists like 1,15.
+// Month and day of week accept the names like JAN and MON too.
+// When both day of month and day of week are restricted, the time matching either of them matches.
+type CronExpression struct {
+	Source string
+
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}},
+	// Both of 0 and 7 are Sunday
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}},
+}
+
+func ParseCronExpression(s string) (*CronExpression, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Cron expression must have %d fields but was %q", len(cronFields), s)
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := cronFields[i].parse(f)
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = (bits[4] | 1) &^ (1 << 7)
+	}
+	return &CronExpression{
+		Source:  s,
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func (f *cronField) parse(s string) (uint64, error) {
+	var res uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("Invalid step of %s: %q", f.name, s)
+			}
+			step = n
+			part = part[:i]
+		}
+		var lo, hi int
+		var err error
+		switch {
+		case part == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(part, "-"):
+			ss := strings.SplitN(part, "-", 2)
+			if lo, err = f.value(ss[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(ss[1]); err != nil {
+				return 0, err
+			}
+		default:
+			if lo, err = f.value(part); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if step > 1 {
+				// 5/15 means 5-max/15
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("Invalid %s: %q", f.name, s)
+		}
+		for v := lo; v <= hi; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+	return res, nil
+}
+
+func (f *cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %q", f.name, s)
+	}
+	return v, nil
+}
+
+func (e *CronExpression) matchDay(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case e.domStar && e.dowStar:
+		return true
+	case e.domStar:
+		return dow
+	case e.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// CronSearchYears is the max years searched for the next time.
+const CronSearchYears = 5
+
+// Next returns the first time matching the expression after t in the location of t.
+// It returns the zero time if no time matches in CronSearchYears like 0 0 30 2 *.
+func (e *CronExpression) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(CronSearchYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case e.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !e.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case e.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case e.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
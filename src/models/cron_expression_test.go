@@ -0,0 +1,44 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronExpressionNext(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(t, err)
+	base := time.Date(2018, 1, 31, 10, 30, 15, 0, time.UTC)
+
+	type Pattern struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}
+	patterns := []Pattern{
+		{"* * * * *", base, time.Date(2018, 1, 31, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", base, time.Date(2018, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", base, time.Date(2018, 2, 1, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", base.In(jst), time.Date(2018, 2, 1, 3, 0, 0, 0, jst)},
+		{"0 9-17/4 * * MON-FRI", base, time.Date(2018, 1, 31, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", base, time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", base, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * JUN 7", base, time.Date(2018, 6, 3, 0, 0, 0, 0, time.UTC)},
+		// Either of day of month or day of week matches when both of them are restricted
+		{"0 0 15 * SAT", base, time.Date(2018, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", base, time.Time{}},
+	}
+	for _, ptn := range patterns {
+		expr, err := ParseCronExpression(ptn.expr)
+		if assert.NoError(t, err, ptn.expr) {
+			assert.Equal(t, ptn.expected, expr.Next(ptn.from), ptn.expr)
+		}
+	}
+
+	for _, invalid := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * FOO *"} {
+		_, err := ParseCronExpression(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"strconv"
 )
 
 type DependencyCondition int
@@ -12,6 +13,20 @@ const (
 	OnFinish // On Failure or Success
 )
 
+var DependencyConditionStrings = map[DependencyCondition]string{
+	OnSuccess: "OnSuccess",
+	OnFailure: "OnFailure",
+	OnFinish:  "OnFinish",
+}
+
+func (dc DependencyCondition) String() string {
+	res, ok := DependencyConditionStrings[dc]
+	if !ok {
+		return "Invalid DependencyCondition: " + strconv.Itoa(int(dc))
+	}
+	return res
+}
+
 type Dependency struct {
 	Condition DependencyCondition `json:"condition"`
 	JobIDs    []string            `json:"job_ids"`
@@ -23,20 +38,102 @@ func (m *Dependency) Satisfied(ctx context.Context) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		var r bool
+		if !m.SatisfiedBy(job) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SatisfiedBy returns whether the job meets the condition.
+func (m *Dependency) SatisfiedBy(job *Job) bool {
+	switch m.Condition {
+	case OnFailure:
+		return job.Status == Failure
+	case OnSuccess:
+		return job.Status == Success
+	case OnFinish:
+		return job.Status.Finished()
+	default:
+		return false
+	}
+}
+
+type DependencyJobStatus struct {
+	ID         string    `json:"id"`
+	IdByClient string    `json:"id_by_client"`
+	Status     JobStatus `json:"status"`
+	Satisfied  bool      `json:"satisfied"`
+}
+
+type DependencyStatus struct {
+	Condition         string                 `json:"condition"`
+	Satisfied         bool                   `json:"satisfied"`
+	Satisfiable       bool                   `json:"satisfiable"`
+	Jobs              []*DependencyJobStatus `json:"jobs"`
+	UnsatisfiedJobIDs []string               `json:"unsatisfied_job_ids"`
+}
+
+// Status returns the status of each job depended on.
+// Satisfiable gets false when a job has been finished or cancelled without
+// meeting the condition, because it never gets satisfied.
+func (m *Dependency) Status(ctx context.Context) (*DependencyStatus, error) {
+	res := &DependencyStatus{
+		Condition:         m.Condition.String(),
+		Satisfied:         true,
+		Satisfiable:       true,
+		Jobs:              []*DependencyJobStatus{},
+		UnsatisfiedJobIDs: []string{},
+	}
+	for _, jobId := range m.JobIDs {
+		job, err := GlobalJobAccessor.Find(ctx, jobId)
+		if err != nil {
+			return nil, err
+		}
+		st := &DependencyJobStatus{
+			ID:         job.ID,
+			IdByClient: job.IdByClient,
+			Status:     job.Status,
+			Satisfied:  m.SatisfiedBy(job),
+		}
+		res.Jobs = append(res.Jobs, st)
+		if !st.Satisfied {
+			res.Satisfied = false
+			res.UnsatisfiedJobIDs = append(res.UnsatisfiedJobIDs, job.ID)
+			if job.Status.Finished() || job.Status == Cancelled {
+				res.Satisfiable = false
+			}
+		}
+	}
+	return res, nil
+}
+
+// Check returns whether all the jobs depended on are finished and the condition is satisfied.
+func (m *Dependency) Check(ctx context.Context) (finished bool, satisfied bool, err error) {
+	satisfied = true
+	for _, jobId := range m.JobIDs {
+		job, err := GlobalJobAccessor.Find(ctx, jobId)
+		if err != nil {
+			return false, false, err
+		}
+		if job.Status == Cancelled {
+			// The cancelled job never satisfies any condition
+			satisfied = false
+			continue
+		}
+		if !job.Status.Finished() {
+			return false, false, nil
+		}
 		switch m.Condition {
 		case OnFailure:
-			r = job.Status == Failure
+			satisfied = satisfied && job.Status == Failure
 		case OnSuccess:
-			r = job.Status == Success
+			satisfied = satisfied && job.Status == Success
 		case OnFinish:
-			r = job.Status.Finished()
+			// satisfied
 		default:
-			r = false
-		}
-		if !r {
-			return false, nil
+			satisfied = false
 		}
 	}
-	return true, nil
+	return true, satisfied, nil
 }
@@ -207,5 +207,249 @@ func TestPipelineAccessorPendingsFor(t *testing.T) {
 			}
 			assert.True(t, matched)
 		}
+
+		// Each pipeline is returned once for the jobs
+		pendingsTo12, err := GlobalPipelineAccessor.PendingsFor(ctx, []string{jobIDs[1], jobIDs[2]})
+		assert.NoError(t, err)
+		assert.Equal(t, 6, len(pendingsTo12))
+
+		// The pipelines which aren't Pending any more are excluded
+		for _, pl := range pipelines {
+			if pl.Name == "B2" {
+				pl.Status = Reserved
+				assert.NoError(t, pl.Update(ctx))
+			}
+		}
+		pendingsTo2, err = GlobalPipelineAccessor.PendingsFor(ctx, []string{jobIDs[2]})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(pendingsTo2))
+
+		none, err := GlobalPipelineAccessor.PendingsFor(ctx, []string{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(none))
+	})
+}
+
+func TestJobResolveDependency(t *testing.T) {
+	SetupDependencyTest(t, func(ctx context.Context, _ *Organization, pipeline *Pipeline, jobs Jobs) {
+		// By IDs by client and job IDs
+		job := &Job{
+			Pipeline:   pipeline,
+			IdByClient: "job-4",
+			Status:     Ready,
+			DependsOn:  Dependency{Condition: OnSuccess, JobIDs: []string{"job-1", jobs[1].ID}},
+		}
+		err := job.ResolveDependency(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{jobs[0].ID, jobs[1].ID}, job.DependsOn.JobIDs)
+		assert.Equal(t, Preparing, job.Status)
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+
+		// Unknown job
+		invalid := &Job{
+			Pipeline:   pipeline,
+			IdByClient: "job-5",
+			DependsOn:  Dependency{Condition: OnSuccess, JobIDs: []string{"unknown-job"}},
+		}
+		err = invalid.ResolveDependency(ctx)
+		assert.IsType(t, &InvalidDependency{}, err)
+
+		// Cycles
+		for _, ref := range []string{"job-4", job.ID} {
+			cyclic := &Job{
+				Pipeline:   pipeline,
+				IdByClient: "job-4",
+				DependsOn:  Dependency{Condition: OnSuccess, JobIDs: []string{"job-1", ref}},
+			}
+			err = cyclic.ResolveDependency(ctx)
+			assert.IsType(t, &InvalidDependency{}, err)
+		}
+
+		// Jobs depended on are finished already
+		for i := 0; i < 2; i++ {
+			jobs[i].Status = Success
+			err := jobs[i].Update(ctx)
+			assert.NoError(t, err)
+		}
+		finished := &Job{
+			Pipeline:   pipeline,
+			IdByClient: "job-6",
+			DependsOn:  Dependency{Condition: OnFailure, JobIDs: []string{"job-1", "job-2"}},
+		}
+		err = finished.ResolveDependency(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, Cancelled, finished.Status)
+		assert.NotEmpty(t, finished.FailureReason)
+	})
+}
+
+func TestPipelinePromoteDependentJobs(t *testing.T) {
+	SetupDependencyTest(t, func(ctx context.Context, _ *Organization, pipeline *Pipeline, jobs Jobs) {
+		children := map[string]*Job{}
+		for name, cond := range map[string]DependencyCondition{"success": OnSuccess, "failure": OnFailure, "finish": OnFinish} {
+			child := &Job{
+				Pipeline:   pipeline,
+				IdByClient: "child-" + name,
+				Status:     Ready,
+				DependsOn:  Dependency{Condition: cond, JobIDs: []string{"job-1", "job-2"}},
+			}
+			err := child.ResolveDependency(ctx)
+			assert.NoError(t, err)
+			err = child.Create(ctx)
+			assert.NoError(t, err)
+			children[name] = child
+		}
+		grandchild := &Job{
+			Pipeline:   pipeline,
+			IdByClient: "grandchild",
+			DependsOn:  Dependency{Condition: OnFinish, JobIDs: []string{"child-failure"}},
+		}
+		err := grandchild.ResolveDependency(ctx)
+		assert.NoError(t, err)
+		err = grandchild.Create(ctx)
+		assert.NoError(t, err)
+
+		// The job created with ready=false isn't promoted
+		notReady := &Job{
+			Pipeline:   pipeline,
+			IdByClient: "not-ready",
+			Status:     Preparing,
+		}
+		err = notReady.Create(ctx)
+		assert.NoError(t, err)
+
+		promoted, cancelled, err := pipeline.PromoteDependentJobs(ctx, Jobs{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(promoted))
+		assert.Equal(t, 0, len(cancelled))
+
+		jobs[0].Status = Success
+		err = jobs[0].Update(ctx)
+		assert.NoError(t, err)
+		promoted, cancelled, err = pipeline.PromoteDependentJobs(ctx, jobs[0:1])
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(promoted))
+		assert.Equal(t, 0, len(cancelled))
+
+		jobs[1].Status = Success
+		err = jobs[1].Update(ctx)
+		assert.NoError(t, err)
+		promoted, cancelled, err = pipeline.PromoteDependentJobs(ctx, jobs[1:2])
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(promoted))
+
+		expected := map[string]JobStatus{"success": Ready, "failure": Cancelled, "finish": Ready}
+		for name, st := range expected {
+			job, err := GlobalJobAccessor.Find(ctx, children[name].ID)
+			assert.NoError(t, err)
+			assert.Equal(t, st, job.Status, name)
+		}
+
+		// The cancellation is propagated
+		if assert.Equal(t, 2, len(cancelled)) {
+			assert.Equal(t, children["failure"].ID, cancelled[0].ID)
+			assert.Equal(t, grandchild.ID, cancelled[1].ID)
+		}
+		reloaded, err := GlobalJobAccessor.Find(ctx, grandchild.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, Cancelled, reloaded.Status)
+
+		reloaded, err = GlobalJobAccessor.Find(ctx, notReady.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, Preparing, reloaded.Status)
+	})
+}
+
+func TestDependencyStatus(t *testing.T) {
+	SetupDependencyTest(t, func(ctx context.Context, _ *Organization, pipeline *Pipeline, jobs Jobs) {
+		for i, st := range []JobStatus{Success, Executing, Failure} {
+			jobs[i].Status = st
+			err := jobs[i].Update(ctx)
+			assert.NoError(t, err)
+		}
+
+		dep := &Dependency{Condition: OnSuccess, JobIDs: jobs[0:2].IDs()}
+		st, err := dep.Status(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "OnSuccess", st.Condition)
+		assert.False(t, st.Satisfied)
+		assert.True(t, st.Satisfiable)
+		assert.Equal(t, []string{jobs[1].ID}, st.UnsatisfiedJobIDs)
+		if assert.Equal(t, 2, len(st.Jobs)) {
+			assert.Equal(t, "job-1", st.Jobs[0].IdByClient)
+			assert.True(t, st.Jobs[0].Satisfied)
+			assert.Equal(t, Executing, st.Jobs[1].Status)
+			assert.False(t, st.Jobs[1].Satisfied)
+		}
+
+		// Failed job never satisfies OnSuccess
+		dep = &Dependency{Condition: OnSuccess, JobIDs: jobs.IDs()}
+		st, err = dep.Status(ctx)
+		assert.NoError(t, err)
+		assert.False(t, st.Satisfied)
+		assert.False(t, st.Satisfiable)
+		assert.Equal(t, []string{jobs[1].ID, jobs[2].ID}, st.UnsatisfiedJobIDs)
+
+		dep = &Dependency{Condition: OnFinish, JobIDs: []string{jobs[0].ID, jobs[2].ID}}
+		st, err = dep.Status(ctx)
+		assert.NoError(t, err)
+		assert.True(t, st.Satisfied)
+		assert.Empty(t, st.UnsatisfiedJobIDs)
+	})
+}
+
+func TestPipelineUpdateIfReserveOrWait(t *testing.T) {
+	SetupDependencyTest(t, func(ctx context.Context, org *Organization, pipeline *Pipeline, jobs Jobs) {
+		pending := &Pipeline{
+			Organization: org,
+			Name:         "pending1",
+			ProjectID:    "dummy-proj-111",
+			Zone:         "asia-northeast1-a",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+			},
+			MachineType:   "f1-micro",
+			TargetSize:    1,
+			ContainerSize: 1,
+			ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+			Dependency: Dependency{
+				Condition: OnSuccess,
+				JobIDs:    []string{jobs[0].ID},
+			},
+		}
+		err := pending.CreateWithReserveOrWait(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, Pending, pending.Status)
+
+		// Still pending
+		err = pending.UpdateIfReserveOrWait(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, Pending, pending.Status)
+
+		jobs[0].Status = Success
+		err = jobs[0].Update(ctx)
+		assert.NoError(t, err)
+
+		pendings, err := GlobalPipelineAccessor.PendingsFor(ctx, jobs[0:1].IDs())
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(pendings)) {
+			pl := pendings[0]
+			err = pl.LoadOrganization(ctx)
+			assert.NoError(t, err)
+
+			// Another one has already reserved it
+			another := *pl
+			err = another.UpdateIfReserveOrWait(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, Reserved, another.Status)
+
+			err = pl.UpdateIfReserveOrWait(ctx)
+			assert.IsType(t, &InvalidStateTransition{}, err)
+		}
+
+		reloaded, err := GlobalPipelineAccessor.Find(ctx, pending.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, Reserved, reloaded.Status)
 	})
 }
@@ -14,6 +14,8 @@ type (
 	DeploymentServicer interface {
 		Delete(ctx context.Context, project string, deployment string) (*deploymentmanager.Operation, error)
 		Insert(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error)
+		Get(ctx context.Context, project string, deployment string) (*deploymentmanager.Deployment, error)
+		Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error)
 		GetOperation(ctx context.Context, project string, operation string) (*deploymentmanager.Operation, error)
 	}
 )
@@ -54,6 +56,14 @@ func (w *DeploymentServiceWrapper) Insert(ctx context.Context, project string, d
 	return w.service.Insert(project, deployment).Context(ctx).Do()
 }
 
+func (w *DeploymentServiceWrapper) Get(ctx context.Context, project string, deployment string) (*deploymentmanager.Deployment, error) {
+	return w.service.Get(project, deployment).Context(ctx).Do()
+}
+
+func (w *DeploymentServiceWrapper) Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	return w.service.Update(project, deployment.Name, deployment).Context(ctx).Do()
+}
+
 func (w *DeploymentServiceWrapper) GetOperation(ctx context.Context, project string, operation string) (*deploymentmanager.Operation, error) {
 	return w.opeService.Get(project, operation).Context(ctx).Do()
 }
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Policies to correct the drift of the instance group size
+const (
+	// DriftPolicyRecord only records the drift.
+	DriftPolicyRecord = "record"
+	// DriftPolicyAdopt sets Pipeline.InstanceSize to the actual size.
+	DriftPolicyAdopt = "adopt"
+	// DriftPolicyRestore resizes the instance group back to Pipeline.InstanceSize.
+	DriftPolicyRestore = "restore"
+)
+
+// DriftGracePeriod is the period after scaled in which no drift is detected
+// because the instance group may be still resizing.
+const DriftGracePeriod = 5 * time.Minute
+
+func ValidateDriftPolicy(policy string) error {
+	switch policy {
+	case "", DriftPolicyRecord, DriftPolicyAdopt, DriftPolicyRestore:
+		return nil
+	default:
+		return fmt.Errorf("Invalid instance_size_drift_policy: %q", policy)
+	}
+}
+
+// InstanceSizeDrift is the event that the actual size of the instance group differs from Pipeline.InstanceSize.
+// It's stored as a child entity of the pipeline like PipelineInstanceSizeLog.
+type InstanceSizeDrift struct {
+	ID        string    `json:"id"                  datastore:"-"`
+	Expected  int       `json:"expected"`
+	Actual    int       `json:"actual"`
+	Policy    string    `json:"policy"`
+	Operation string    `json:"operation,omitempty"`
+	Error     string    `json:"error,omitempty"     datastore:",noindex"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *InstanceSizeDrift) Create(ctx context.Context, pl *Pipeline) error {
+	parentKey, err := datastore.DecodeKey(pl.ID)
+	if err != nil {
+		return err
+	}
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "InstanceSizeDrifts", parentKey), m)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put InstanceSizeDrift %v because of %v\n", m, err)
+		return err
+	}
+	m.ID = key.Encode()
+	return nil
+}
+
+// InstanceSizeDrifts returns the drift events of the pipeline from the latest.
+func (m *Pipeline) InstanceSizeDrifts(ctx context.Context, limit int) ([]*InstanceSizeDrift, error) {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery("InstanceSizeDrifts").Ancestor(key).Order("-CreatedAt")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	res := []*InstanceSizeDrift{}
+	keys, err := q.GetAll(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range res {
+		d.ID = keys[i].Encode()
+	}
+	return res, nil
+}
+
+// InstanceSizeCheckDue returns true if the actual size of the instance group should be checked at now.
+func (m *Pipeline) InstanceSizeCheckDue(now time.Time, interval time.Duration) bool {
+	return !m.Updating && now.Sub(m.InstanceSizeCheckedAt) >= interval
+}
+
+type DriftDetector struct {
+	igServicer InstanceGroupServicer
+}
+
+func NewDriftDetector(ctx context.Context) (*DriftDetector, error) {
+	igServicer, err := DefaultInstanceGroupServicer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DriftDetector{igServicer: igServicer}, nil
+}
+
+func WithDriftDetector(ctx context.Context, f func(*DriftDetector) error) error {
+	detector, err := NewDriftDetector(ctx)
+	if err != nil {
+		return err
+	}
+	return f(detector)
+}
+
+// Process compares Pipeline.InstanceSize with the actual size of the instance group and saves the actual size.
+// When they differ, it records the drift and corrects it by Pipeline.InstanceSizeDriftPolicy.
+// It returns the operation to resize the instance group if the policy is restore.
+// The pipeline is reloaded after getting the instance group not to overwrite the fields
+// updated by the other tasks in the meantime.
+func (d *DriftDetector) Process(ctx context.Context, pl *Pipeline, now time.Time) (*InstanceSizeDrift, *PipelineOperation, error) {
+	ig, err := d.igServicer.GetIg(pl.ProjectID, pl.Location(), pl.InstanceGroupManagerName())
+	if err != nil {
+		log.Errorf(ctx, "Failed to get instance group of %v because of %v\n", pl.ID, err)
+		return nil, nil, err
+	}
+	actual := int(ig.Size)
+
+	var drift *InstanceSizeDrift
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		drift = nil
+		if err := pl.Reload(ctx); err != nil {
+			return err
+		}
+		pl.ActualInstanceSize = actual
+		pl.InstanceSizeCheckedAt = now
+		if actual == pl.InstanceSize || pl.Updating || now.Sub(pl.LastScaledAt) < DriftGracePeriod {
+			return pl.Update(ctx)
+		}
+		drift = &InstanceSizeDrift{
+			Expected:  pl.InstanceSize,
+			Actual:    actual,
+			Policy:    StringWithDefault(pl.InstanceSizeDriftPolicy, DriftPolicyRecord),
+			CreatedAt: now,
+		}
+		if drift.Policy == DriftPolicyAdopt {
+			pl.InstanceSize = actual
+			pl.LogInstanceSize(ctx, now.Format(time.RFC3339), actual) // No error is returned
+		}
+		return pl.Update(ctx)
+	}, GetTransactionOptions())
+	if err != nil {
+		log.Errorf(ctx, "Failed to update the actual instance size of %v because of %v\n", pl.ID, err)
+		return nil, nil, err
+	}
+	if drift == nil {
+		return nil, nil, nil
+	}
+	log.Warningf(ctx, "Instance group of %v has %d instances but InstanceSize is %d\n", pl.ID, actual, drift.Expected)
+
+	var operation *PipelineOperation
+	if drift.Policy == DriftPolicyRestore {
+		// Scaler#resize updates the pipeline
+		operation, err = (&Scaler{igServicer: d.igServicer}).resize(ctx, pl, pl.InstanceSize)
+		if operation != nil {
+			drift.Operation = operation.Name
+		}
+		if err != nil {
+			drift.Error = err.Error()
+		}
+	}
+	if createErr := drift.Create(ctx, pl); createErr != nil {
+		return nil, nil, createErr
+	}
+	return drift, operation, err
+}
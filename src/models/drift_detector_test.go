@@ -0,0 +1,135 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestDriftDetectorProcess(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"InstanceSizeDrifts", "PipelineInstanceSizeLogs", "PipelineOperations", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	type Pattern struct {
+		policy       string
+		lastScaledAt time.Duration // before now
+		drift        bool
+		instanceSize int
+		resized      []int64
+	}
+	patterns := []Pattern{
+		{DriftPolicyRecord, time.Hour, true, 2, nil},
+		{DriftPolicyAdopt, time.Hour, true, 3, nil},
+		{DriftPolicyRestore, time.Hour, true, 2, []int64{2}},
+		// The instance group may be still resizing
+		{DriftPolicyAdopt, time.Minute, false, 2, nil},
+	}
+
+	now := time.Now()
+	for i, ptn := range patterns {
+		pl := &Pipeline{
+			Organization: org1,
+			Name:         "pipeline1",
+			ProjectID:    "dummy-proj-111",
+			Zone:         "asia-northeast1-a",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+			},
+			MachineType:             "f1-micro",
+			TargetSize:              2,
+			ContainerSize:           1,
+			ContainerName:           "groovenauts/batch_type_iot_example:0.3.1",
+			DeploymentName:          "pipeline1",
+			Status:                  Opened,
+			LastScaledAt:            now.Add(-ptn.lastScaledAt),
+			InstanceSizeDriftPolicy: ptn.policy,
+		}
+		err = pl.Create(ctx)
+		assert.NoError(t, err)
+
+		servicer := &DummyInstanceGroupServicer{IgSize: 3}
+		detector := &DriftDetector{igServicer: servicer}
+		drift, ope, err := detector.Process(ctx, pl, now)
+		assert.NoError(t, err, "patterns[%d]", i)
+		assert.Equal(t, ptn.resized, servicer.Sizes, "patterns[%d]", i)
+		assert.Equal(t, ptn.resized != nil, ope != nil, "patterns[%d]", i)
+
+		found, err := GlobalPipelineAccessor.Find(ctx, pl.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, found.ActualInstanceSize, "patterns[%d]", i)
+		assert.Equal(t, ptn.instanceSize, found.InstanceSize, "patterns[%d]", i)
+		assert.WithinDuration(t, now, found.InstanceSizeCheckedAt, time.Millisecond, "patterns[%d]", i)
+
+		drifts, err := pl.InstanceSizeDrifts(ctx, 0)
+		assert.NoError(t, err)
+		if ptn.drift {
+			if assert.NotNil(t, drift, "patterns[%d]", i) && assert.Equal(t, 1, len(drifts), "patterns[%d]", i) {
+				assert.Equal(t, 2, drifts[0].Expected)
+				assert.Equal(t, 3, drifts[0].Actual)
+				assert.Equal(t, ptn.policy, drifts[0].Policy)
+			}
+		} else {
+			assert.Nil(t, drift, "patterns[%d]", i)
+			assert.Equal(t, 0, len(drifts), "patterns[%d]", i)
+		}
+	}
+
+	// The fields updated by the other tasks while getting the instance group are kept
+	stale := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline2",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:             "f1-micro",
+		TargetSize:              2,
+		ContainerSize:           1,
+		ContainerName:           "groovenauts/batch_type_iot_example:0.3.1",
+		DeploymentName:          "pipeline2",
+		Status:                  Opened,
+		InstanceSizeDriftPolicy: DriftPolicyAdopt,
+	}
+	assert.NoError(t, stale.Create(ctx))
+	latest, err := GlobalPipelineAccessor.Find(ctx, stale.ID)
+	assert.NoError(t, err)
+	latest.PullingTaskSize = 4
+	latest.Updating = true
+	assert.NoError(t, latest.Update(ctx))
+
+	detector := &DriftDetector{igServicer: &DummyInstanceGroupServicer{IgSize: 3}}
+	drift, _, err := detector.Process(ctx, stale, now)
+	assert.NoError(t, err)
+	assert.Nil(t, drift)
+	found, err := GlobalPipelineAccessor.Find(ctx, stale.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, found.ActualInstanceSize)
+	assert.Equal(t, 2, found.InstanceSize)
+	assert.Equal(t, 4, found.PullingTaskSize)
+	assert.True(t, found.Updating)
+
+	assert.Error(t, ValidateDriftPolicy("ignore"))
+}
@@ -8,15 +8,28 @@ import (
 )
 
 type PublishInvocation struct {
-	Topic string
-	Req   *pubsub.PublishRequest
+	Topic    string
+	Messages []*pubsub.PubsubMessage
 }
 
 type DummyPublisher struct {
 	Invocations []*PublishInvocation
+	MaxMessages int // Split messages into batches if it's given
+	published   int
 }
 
-func (p *DummyPublisher) Publish(ctx context.Context, topic string, req *pubsub.PublishRequest) (string, error) {
-	p.Invocations = append(p.Invocations, &PublishInvocation{Topic: topic, Req: req})
-	return fmt.Sprintf("DummyMsgId-%v", len(p.Invocations)), nil
+func (p *DummyPublisher) Publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) ([]string, error) {
+	maxMessages := p.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = PubsubMaxMessagesPerPublish
+	}
+	msgIds := []string{}
+	for _, batch := range SplitPubsubMessages(msgs, maxMessages, PubsubMaxBytesPerPublish) {
+		p.Invocations = append(p.Invocations, &PublishInvocation{Topic: topic, Messages: batch})
+		for range batch {
+			p.published++
+			msgIds = append(msgIds, fmt.Sprintf("DummyMsgId-%v", p.published))
+		}
+	}
+	return msgIds, nil
 }
@@ -46,3 +46,27 @@ type SubscriprionNotFound struct {
 func (e *SubscriprionNotFound) Error() string {
 	return fmt.Sprintf("%q not found", e.Subscription)
 }
+
+type InvalidDependency struct {
+	Msg string
+}
+
+func (e *InvalidDependency) Error() string {
+	return e.Msg
+}
+
+type InvalidSearchCondition struct {
+	Msg string
+}
+
+func (e *InvalidSearchCondition) Error() string {
+	return e.Msg
+}
+
+type InvalidReconfiguration struct {
+	Msg string
+}
+
+func (e *InvalidReconfiguration) Error() string {
+	return e.Msg
+}
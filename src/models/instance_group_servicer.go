@@ -8,10 +8,17 @@ import (
 	"google.golang.org/appengine/log"
 )
 
+// InstanceGroupServicer handles the zonal and regional instance groups.
+// location is a zone for the zonal ones or a region for the regional ones.
+// See Pipeline.Location
 type InstanceGroupServicer interface {
-	GetIg(project, zone, instanceGroup string) (*compute.InstanceGroup, error)
-	Resize(project, zone, instanceGroupManager string, size int64) (*compute.Operation, error)
-	GetZoneOp(project, zone, operation string) (*compute.Operation, error)
+	GetIg(project, location, instanceGroup string) (*compute.InstanceGroup, error)
+	Resize(project, location, instanceGroupManager string, size int64) (*compute.Operation, error)
+	GetOp(project, location, operation string) (*compute.Operation, error)
+	GetIgm(project, location, instanceGroupManager string) (*compute.InstanceGroupManager, error)
+	StartRollingUpdate(project, location, instanceGroupManager, instanceTemplate string, policy *RollingUpdatePolicy) (*compute.Operation, error)
+	ListInstances(project, location, instanceGroupManager string) ([]string, error)
+	DeleteInstances(project, location, instanceGroupManager string, instances []string) (*compute.Operation, error)
 }
 
 func DefaultInstanceGroupServicer(ctx context.Context) (InstanceGroupServicer, error) {
@@ -27,9 +34,12 @@ func DefaultInstanceGroupServicer(ctx context.Context) (InstanceGroupServicer, e
 		return nil, err
 	}
 	return &InstanceGroupServiceWrapper{
-		igService:      c.InstanceGroups,
-		igmService:     c.InstanceGroupManagers,
-		zoneOpsService: c.ZoneOperations,
+		igService:        c.InstanceGroups,
+		igmService:       c.InstanceGroupManagers,
+		zoneOpsService:   c.ZoneOperations,
+		regionIgService:  c.RegionInstanceGroups,
+		regionIgmService: c.RegionInstanceGroupManagers,
+		regionOpsService: c.RegionOperations,
 	}, nil
 }
 
@@ -42,19 +52,109 @@ func WithInstanceGroupServicer(ctx context.Context, f func(InstanceGroupServicer
 }
 
 type InstanceGroupServiceWrapper struct {
-	igService      *compute.InstanceGroupsService
-	igmService     *compute.InstanceGroupManagersService
-	zoneOpsService *compute.ZoneOperationsService
+	igService        *compute.InstanceGroupsService
+	igmService       *compute.InstanceGroupManagersService
+	zoneOpsService   *compute.ZoneOperationsService
+	regionIgService  *compute.RegionInstanceGroupsService
+	regionIgmService *compute.RegionInstanceGroupManagersService
+	regionOpsService *compute.RegionOperationsService
 }
 
-func (w *InstanceGroupServiceWrapper) GetIg(project, zone, instanceGroup string) (*compute.InstanceGroup, error) {
-	return w.igService.Get(project, zone, instanceGroup).Do()
+func (w *InstanceGroupServiceWrapper) GetIg(project, location, instanceGroup string) (*compute.InstanceGroup, error) {
+	if IsRegion(location) {
+		return w.regionIgService.Get(project, location, instanceGroup).Do()
+	}
+	return w.igService.Get(project, location, instanceGroup).Do()
+}
+
+func (w *InstanceGroupServiceWrapper) Resize(project, location, instanceGroupManager string, size int64) (*compute.Operation, error) {
+	if IsRegion(location) {
+		return w.regionIgmService.Resize(project, location, instanceGroupManager, size).Do()
+	}
+	return w.igmService.Resize(project, location, instanceGroupManager, size).Do()
+}
+
+func (w *InstanceGroupServiceWrapper) GetOp(project, location, operation string) (*compute.Operation, error) {
+	if IsRegion(location) {
+		return w.regionOpsService.Get(project, location, operation).Do()
+	}
+	return w.zoneOpsService.Get(project, location, operation).Do()
+}
+
+func (w *InstanceGroupServiceWrapper) GetIgm(project, location, instanceGroupManager string) (*compute.InstanceGroupManager, error) {
+	if IsRegion(location) {
+		return w.regionIgmService.Get(project, location, instanceGroupManager).Do()
+	}
+	return w.igmService.Get(project, location, instanceGroupManager).Do()
 }
 
-func (w *InstanceGroupServiceWrapper) Resize(project, zone, instanceGroupManager string, size int64) (*compute.Operation, error) {
-	return w.igmService.Resize(project, zone, instanceGroupManager, size).Do()
+// StartRollingUpdate patches the instance group manager to replace the instances proactively.
+// See https://cloud.google.com/compute/docs/instance-groups/rolling-out-updates-to-managed-instance-groups
+func (w *InstanceGroupServiceWrapper) StartRollingUpdate(project, location, instanceGroupManager, instanceTemplate string, policy *RollingUpdatePolicy) (*compute.Operation, error) {
+	updatePolicy := &compute.InstanceGroupManagerUpdatePolicy{
+		Type:          "PROACTIVE",
+		MinimalAction: policy.EffectiveMinimalAction(),
+	}
+	maxSurge := policy.EffectiveMaxSurge()
+	maxUnavailable := policy.EffectiveMaxUnavailable()
+	if IsRegion(location) {
+		current, err := w.regionIgmService.Get(project, location, instanceGroupManager).Do()
+		if err != nil {
+			return nil, err
+		}
+		zones := 0
+		if current.DistributionPolicy != nil {
+			zones = len(current.DistributionPolicy.Zones)
+		}
+		maxSurge = RegionalFixedOrZero(maxSurge, zones)
+		maxUnavailable = RegionalFixedOrZero(maxUnavailable, zones)
+		updatePolicy.InstanceRedistributionType = InstanceRedistributionNone
+	}
+	updatePolicy.MaxSurge = &compute.FixedOrPercent{Fixed: int64(maxSurge), ForceSendFields: []string{"Fixed"}}
+	updatePolicy.MaxUnavailable = &compute.FixedOrPercent{Fixed: int64(maxUnavailable), ForceSendFields: []string{"Fixed"}}
+
+	igm := &compute.InstanceGroupManager{
+		InstanceTemplate: instanceTemplate,
+		Versions: []*compute.InstanceGroupManagerVersion{
+			&compute.InstanceGroupManagerVersion{InstanceTemplate: instanceTemplate},
+		},
+		UpdatePolicy: updatePolicy,
+	}
+	if IsRegion(location) {
+		return w.regionIgmService.Patch(project, location, instanceGroupManager, igm).Do()
+	}
+	return w.igmService.Patch(project, location, instanceGroupManager, igm).Do()
 }
 
-func (w *InstanceGroupServiceWrapper) GetZoneOp(project, zone, operation string) (*compute.Operation, error) {
-	return w.zoneOpsService.Get(project, zone, operation).Do()
+// ListInstances returns the URLs of the instances managed by the instance group manager.
+func (w *InstanceGroupServiceWrapper) ListInstances(project, location, instanceGroupManager string) ([]string, error) {
+	var managed []*compute.ManagedInstance
+	if IsRegion(location) {
+		res, err := w.regionIgmService.ListManagedInstances(project, location, instanceGroupManager).Do()
+		if err != nil {
+			return nil, err
+		}
+		managed = res.ManagedInstances
+	} else {
+		res, err := w.igmService.ListManagedInstances(project, location, instanceGroupManager).Do()
+		if err != nil {
+			return nil, err
+		}
+		managed = res.ManagedInstances
+	}
+	r := []string{}
+	for _, mi := range managed {
+		r = append(r, mi.Instance)
+	}
+	return r, nil
+}
+
+// DeleteInstances deletes the instances and decreases the target size of the instance group manager.
+func (w *InstanceGroupServiceWrapper) DeleteInstances(project, location, instanceGroupManager string, instances []string) (*compute.Operation, error) {
+	if IsRegion(location) {
+		req := &compute.RegionInstanceGroupManagersDeleteInstancesRequest{Instances: instances}
+		return w.regionIgmService.DeleteInstances(project, location, instanceGroupManager, req).Do()
+	}
+	req := &compute.InstanceGroupManagersDeleteInstancesRequest{Instances: instances}
+	return w.igmService.DeleteInstances(project, location, instanceGroupManager, req).Do()
 }
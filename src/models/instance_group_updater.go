@@ -13,8 +13,9 @@ type InstanceGroupUpdater struct {
 }
 
 // https://godoc.org/google.golang.org/api/compute/v1#Operation
+// operation.Zone has the region of the operation for a regional instance group.
 func (u *InstanceGroupUpdater) Update(ctx context.Context, operation *PipelineOperation, successHandler, errorHandler UpdateHandler) error {
-	newOpe, err := u.Servicer.GetZoneOp(operation.ProjectID, operation.Zone, operation.Name)
+	newOpe, err := u.Servicer.GetOp(operation.ProjectID, operation.Zone, operation.Name)
 	if err != nil {
 		log.Errorf(ctx, "Failed to get compute operation: %v because of %v\n", operation, err)
 		return err
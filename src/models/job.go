@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	pubsub "google.golang.org/api/pubsub/v1"
 	"google.golang.org/appengine/datastore"
@@ -69,6 +72,11 @@ func (js JobStatus) Finished() bool {
 	return js.IncludedIn(FinishedJobStatuses)
 }
 
+// Ended returns true for the finished and the cancelled jobs which never run again.
+func (js JobStatus) Ended() bool {
+	return js.Finished() || js == Cancelled
+}
+
 func (js JobStatus) IncludedIn(statuses []JobStatus) bool {
 	for _, st := range statuses {
 		if js == st {
@@ -91,7 +99,16 @@ type (
 	}
 )
 
-const JobIdKey = "concurrent_batch.job_id"
+const (
+	JobIdKey        = "concurrent_batch.job_id"
+	JobAttemptKey   = "concurrent_batch.job_attempt"
+	JobMessageIdKey = "concurrent_batch.job_message_id"
+	CommandKey      = "concurrent_batch.command"
+)
+
+const (
+	CancelCommand = "cancel"
+)
 
 func (m *JobMessage) MapToEntries() {
 	entries := []KeyValuePair{}
@@ -109,23 +126,52 @@ func (m *JobMessage) EntriesToMap() {
 	m.AttributeMap = kv
 }
 
+func (m *JobMessage) SetAttribute(name, value string) {
+	found := false
+	for i, entry := range m.AttributeEntries {
+		if entry.Name == name {
+			m.AttributeEntries[i].Value = value
+			found = true
+		}
+	}
+	if !found {
+		m.AttributeEntries = append(m.AttributeEntries, KeyValuePair{Name: name, Value: value})
+	}
+	if len(m.AttributeMap) == 0 {
+		m.EntriesToMap()
+	} else {
+		m.AttributeMap[name] = value
+	}
+}
+
 type (
 	Job struct {
-		ID          string         `json:"id"  datastore:"-"`
-		PipelineKey *datastore.Key `json:"-"   datastore:"pipeline_key"`
-		Pipeline    *Pipeline      `json:"-"   validate:"required" datastore:"-"`
-		IdByClient  string         `json:"id_by_client" validate:"required" datastore:"id_by_client"`
-		Status      JobStatus      `json:"status"       datastore:"status" `
-		Zone        string         `json:"zone" datastore:"zone"`
-		Hostname    string         `json:"hostname" datastore:"hostname"`
-		Message     JobMessage     `json:"message" datastore:"message"`
-		MessageID   string         `json:"message_id"   datastore:"message_id"`
-		Output      string         `json:"output,omitempty"       datastore:"output,noindex"`
-		PublishedAt time.Time      `json:"published_at,omitempty"`
-		StartTime   string         `json:"start_time"`
-		FinishTime  string         `json:"finish_time"`
-		CreatedAt   time.Time      `json:"created_at"`
-		UpdatedAt   time.Time      `json:"updated_at"`
+		ID                string         `json:"id"  datastore:"-"`
+		PipelineKey       *datastore.Key `json:"-"   datastore:"pipeline_key"`
+		Pipeline          *Pipeline      `json:"-"   validate:"required" datastore:"-"`
+		IdByClient        string         `json:"id_by_client" validate:"required" datastore:"id_by_client"`
+		Status            JobStatus      `json:"status"       datastore:"status" `
+		Priority          int            `json:"priority"     datastore:"priority"`
+		DependsOn         Dependency     `json:"depends_on,omitempty" datastore:"depends_on"`
+		Zone              string         `json:"zone" datastore:"zone"`
+		Hostname          string         `json:"hostname" datastore:"hostname"`
+		Message           JobMessage     `json:"message" datastore:"message"`
+		MessageID         string         `json:"message_id"   datastore:"message_id"`
+		Output            string         `json:"output,omitempty"       datastore:"output,noindex"`
+		OutputChunkCount  int            `json:"output_chunk_count,omitempty" datastore:"output_chunk_count,noindex"`
+		RetryPolicy       RetryPolicy    `json:"retry_policy,omitempty" datastore:"retry_policy"`
+		Attempt           int            `json:"attempt"                datastore:"attempt"`
+		AttemptHistory    []JobAttempt   `json:"attempts,omitempty"     datastore:"attempt_history,noindex"`
+		RetryAt           time.Time      `json:"retry_at,omitempty"     datastore:"retry_at,noindex"`
+		FailedStep        string         `json:"failed_step,omitempty"  datastore:"failed_step"`
+		FailureReason     string         `json:"failure_reason,omitempty" datastore:"failure_reason,noindex"`
+		CancelRequested   bool           `json:"cancel_requested,omitempty"    datastore:"cancel_requested"`
+		CancelRequestedAt time.Time      `json:"cancel_requested_at,omitempty" datastore:"cancel_requested_at,noindex"`
+		PublishedAt       time.Time      `json:"published_at,omitempty"`
+		StartTime         string         `json:"start_time"`
+		FinishTime        string         `json:"finish_time"`
+		CreatedAt         time.Time      `json:"created_at"`
+		UpdatedAt         time.Time      `json:"updated_at"`
 	}
 )
 
@@ -134,8 +180,20 @@ func (m *Job) CopyFrom(src *Job) {
 	m.Pipeline = src.Pipeline
 	m.IdByClient = src.IdByClient
 	m.Status = src.Status
+	m.Priority = src.Priority
+	m.DependsOn = src.DependsOn
 	m.Message = src.Message
 	m.MessageID = src.MessageID
+	m.Output = src.Output
+	m.OutputChunkCount = src.OutputChunkCount
+	m.RetryPolicy = src.RetryPolicy
+	m.Attempt = src.Attempt
+	m.AttemptHistory = src.AttemptHistory
+	m.RetryAt = src.RetryAt
+	m.FailedStep = src.FailedStep
+	m.FailureReason = src.FailureReason
+	m.CancelRequested = src.CancelRequested
+	m.CancelRequestedAt = src.CancelRequestedAt
 	m.CreatedAt = src.CreatedAt
 	m.UpdatedAt = src.UpdatedAt
 }
@@ -148,6 +206,9 @@ func (m *Job) Validate(ctx context.Context) error {
 	if err := v.Struct(m); err != nil {
 		return err
 	}
+	if err := m.RetryPolicy.Validate(); err != nil {
+		return err
+	}
 
 	if m.PipelineKey == nil {
 		if m.Pipeline == nil {
@@ -187,22 +248,9 @@ func (m *Job) Key(ctx context.Context, prefix string) *datastore.Key {
 }
 
 func (m *Job) Create(ctx context.Context) error {
-	t := time.Now()
-	if m.CreatedAt.IsZero() {
-		m.CreatedAt = t
-	}
-	if m.UpdatedAt.IsZero() {
-		m.UpdatedAt = t
-	}
-
-	if len(m.Message.AttributeEntries) == 0 {
-		msg := &m.Message
-		msg.MapToEntries()
-	}
-
 	log.Debugf(ctx, "Job#Create: %v\n", m)
 
-	err := m.Validate(ctx)
+	err := m.PrepareToCreate(ctx, time.Now())
 	if err != nil {
 		return err
 	}
@@ -216,6 +264,26 @@ func (m *Job) Create(ctx context.Context) error {
 	return nil
 }
 
+// PrepareToCreate sets the default values and validates the job before it's put.
+func (m *Job) PrepareToCreate(ctx context.Context, t time.Time) error {
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = t
+	}
+	if m.UpdatedAt.IsZero() {
+		m.UpdatedAt = t
+	}
+	if m.Attempt == 0 {
+		m.Attempt = 1
+	}
+
+	if len(m.Message.AttributeEntries) == 0 {
+		msg := &m.Message
+		msg.MapToEntries()
+	}
+
+	return m.Validate(ctx)
+}
+
 func (m *Job) LoadBy(ctx context.Context, key *datastore.Key) error {
 	tmp := &Job{}
 	err := datastore.Get(ctx, key, tmp)
@@ -313,14 +381,9 @@ func (m *Job) LoadPipeline(ctx context.Context) error {
 }
 
 func (m *Job) JobMessage() *pubsub.PubsubMessage {
-	entry := KeyValuePair{Name: JobIdKey, Value: m.ID}
-	m.Message.AttributeEntries = append(m.Message.AttributeEntries, entry)
-	if len(m.Message.AttributeMap) == 0 {
-		msg := &m.Message
-		msg.EntriesToMap()
-	} else {
-		m.Message.AttributeMap[JobIdKey] = m.ID
-	}
+	msg := &m.Message
+	msg.SetAttribute(JobIdKey, m.ID)
+	msg.SetAttribute(JobAttemptKey, strconv.Itoa(m.CurrentAttempt()))
 	return &pubsub.PubsubMessage{
 		Attributes: m.Message.AttributeMap,
 		Data:       base64.StdEncoding.EncodeToString([]byte(m.Message.Data)),
@@ -333,15 +396,15 @@ func (m *Job) Publish(ctx context.Context) (string, error) {
 	topic := m.Pipeline.JobTopicFqn()
 	log.Debugf(ctx, "Sending message to %v: %v\n", topic, msg)
 
-	req := &pubsub.PublishRequest{
-		Messages: []*pubsub.PubsubMessage{msg},
-	}
-
-	msgId, err := GlobalPublisher.Publish(ctx, topic, req)
+	msgIds, err := GlobalPublisher.Publish(ctx, topic, []*pubsub.PubsubMessage{msg})
 	if err != nil {
 		return "", err
 	}
+	if len(msgIds) == 0 {
+		return "", fmt.Errorf("No message ID returned for job %v from %v", m.ID, topic)
+	}
 
+	msgId := msgIds[0]
 	m.MessageID = msgId
 	m.PublishedAt = time.Now()
 	err = m.Update(ctx)
@@ -386,6 +449,7 @@ func (m *Job) DoAndPublishIfPossible(ctx context.Context, f func(ctx context.Con
 		switch {
 		case StatusesNotDeployedYet.Include(pl.Status) ||
 			StatusesNowDeploying.Include(pl.Status) ||
+			StatusesPaused.Include(pl.Status) ||
 			StatusesHibernationInProgresss.Include(pl.Status) ||
 			StatusesHibernating.Include(pl.Status):
 			m.Status = Ready
@@ -426,11 +490,16 @@ func (m *Job) ApplyStatusIfGreaterThanBefore(ctx context.Context, completed bool
 		case CLEANUP:
 			// Do nothing
 		case CANCELLING:
-			newStatus = Failure
+			if m.CancelRequested {
+				newStatus = Cancelled
+			} else {
+				newStatus = Failure
+			}
 		case ACKSENDING:
 			newStatus = Success
 		}
 	case FAILURE:
+		m.FailedStep = step.String()
 		switch step {
 		case INITIALIZING, DOWNLOADING, EXECUTING, UPLOADING:
 			newStatus = Executing
@@ -458,7 +527,237 @@ func (m *Job) UpdateStatusIfGreaterThanBefore(ctx context.Context, completed boo
 	return nil
 }
 
+// CancelRequestTimeout is how long the job waits for the worker to report CANCELLING.
+const CancelRequestTimeout = 10 * time.Minute
+
+// Cancel cancels the job.
+// The job being executed by a worker gets CancelRequested and the cancel command is
+// published to the control topic. Its status becomes Cancelled when the worker reports
+// CANCELLING or CancelRequestTimeout passes.
+// The Published job may not be pulled by any worker yet, so it becomes Cancelled
+// immediately after the cancel command is published to stop the worker which pulled it.
+// The job which isn't published yet becomes Cancelled immediately.
 func (m *Job) Cancel(ctx context.Context) error {
-	m.Status = Cancelled
+	switch m.Status {
+	case Published:
+		if err := m.PublishCancelCommand(ctx); err != nil {
+			log.Warningf(ctx, "Cancel job %v without notifying the worker because of %v\n", m.ID, err)
+		}
+		m.Status = Cancelled
+		return m.Update(ctx)
+	case Executing:
+		if m.CancelRequested {
+			return nil
+		}
+		err := m.PublishCancelCommand(ctx)
+		if err != nil {
+			// The pipeline deployed without the control topic can't receive the command
+			log.Warningf(ctx, "Cancel job %v without notifying the worker because of %v\n", m.ID, err)
+			m.Status = Cancelled
+			return m.Update(ctx)
+		}
+		m.CancelRequested = true
+		m.CancelRequestedAt = time.Now()
+		return m.Update(ctx)
+	default:
+		m.Status = Cancelled
+		return m.Update(ctx)
+	}
+}
+
+// CancelRequestExpiresAt returns the time when the job gets Cancelled without the report of the worker.
+func (m *Job) CancelRequestExpiresAt() time.Time {
+	return m.CancelRequestedAt.Add(CancelRequestTimeout)
+}
+
+// ExpireCancelRequest makes the CancelRequested job Cancelled in a transaction
+// if the worker doesn't report CANCELLING until CancelRequestExpiresAt.
+// It returns true if the job gets Cancelled.
+func (m *Job) ExpireCancelRequest(ctx context.Context, now time.Time) (bool, error) {
+	expired := false
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		expired = false
+		job, err := GlobalJobAccessor.Find(ctx, m.ID)
+		if err != nil {
+			return err
+		}
+		job.Pipeline = m.Pipeline
+		*m = *job
+		if !m.CancelRequested || m.Status.Ended() || now.Before(m.CancelRequestExpiresAt()) {
+			return nil
+		}
+		log.Warningf(ctx, "Job %v is cancelled because the worker didn't report CANCELLING since %v\n", m.ID, m.CancelRequestedAt)
+		m.Status = Cancelled
+		m.FailureReason = fmt.Sprintf("Not cancelled by the worker in %v since requested at %v", CancelRequestTimeout, m.CancelRequestedAt.Format(time.RFC3339))
+		expired = true
+		return m.Update(ctx)
+	}, GetTransactionOptions())
+	if err != nil {
+		return false, err
+	}
+	return expired, nil
+}
+
+func (m *Job) CancelCommandMessage() *pubsub.PubsubMessage {
+	return &pubsub.PubsubMessage{
+		Attributes: map[string]string{
+			CommandKey:      CancelCommand,
+			JobIdKey:        m.ID,
+			JobAttemptKey:   strconv.Itoa(m.CurrentAttempt()),
+			JobMessageIdKey: m.MessageID,
+		},
+	}
+}
+
+func (m *Job) PublishCancelCommand(ctx context.Context) error {
+	if m.Pipeline == nil {
+		err := m.LoadPipeline(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	topic := m.Pipeline.ControlTopicFqn()
+	_, err := GlobalPublisher.Publish(ctx, topic, []*pubsub.PubsubMessage{m.CancelCommandMessage()})
+	if err != nil {
+		log.Errorf(ctx, "Failed to publish cancel command of job %v to %v because of %v\n", m.ID, topic, err)
+		return err
+	}
+	log.Infof(ctx, "Published cancel command of job %v to %v\n", m.ID, topic)
+	return nil
+}
+
+// CurrentAttempt returns 1 for jobs created before attempts were counted.
+func (m *Job) CurrentAttempt() int {
+	if m.Attempt < 1 {
+		return 1
+	}
+	return m.Attempt
+}
+
+// EffectiveRetryPolicy returns the RetryPolicy of the job if it's given, otherwise the pipeline's one.
+func (m *Job) EffectiveRetryPolicy() *RetryPolicy {
+	if m.RetryPolicy.MaxAttempts > 0 || m.Pipeline == nil {
+		return &m.RetryPolicy
+	}
+	return &m.Pipeline.RetryPolicy
+}
+
+// IsProgressOfCurrentAttempt returns false for progress messages sent by an earlier attempt.
+// The messages without the attempt attribute are judged by their publishTime.
+func (m *Job) IsProgressOfCurrentAttempt(attrs map[string]string, publishTime string) bool {
+	if v, ok := attrs[JobAttemptKey]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n == m.CurrentAttempt()
+		}
+	}
+	if len(m.AttemptHistory) == 0 || publishTime == "" {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, publishTime)
+	if err != nil {
+		return true
+	}
+	return t.After(m.AttemptHistory[len(m.AttemptHistory)-1].FinishedAt)
+}
+
+// PrepareRetryIfPossible makes the failed job Ready again for the next attempt
+// when its RetryPolicy allows. It returns true if the job is going to be retried.
+func (m *Job) PrepareRetryIfPossible(ctx context.Context) bool {
+	if m.Status != Failure {
+		return false
+	}
+	attempt := m.CurrentAttempt()
+	policy := m.EffectiveRetryPolicy()
+	if !policy.Retryable(attempt, m.FailedStep) {
+		log.Debugf(ctx, "Job %v isn't retried at attempt %d failed at %q with %v\n", m.ID, attempt, m.FailedStep, policy)
+		return false
+	}
+
+	m.startNextAttempt()
+	m.RetryAt = time.Now().Add(m.RetryBackoff())
+	log.Infof(ctx, "Job %v is going to be retried as attempt %d at %v\n", m.ID, m.Attempt, m.RetryAt)
+	return true
+}
+
+// Requeue makes the dead letter Ready again as the next attempt regardless of its RetryPolicy.
+func (m *Job) Requeue(ctx context.Context) error {
+	if !m.IsDeadLetter() {
+		return &InvalidStateTransition{
+			Msg: fmt.Sprintf("Job %v can't be requeued because it's %v", m.ID, m.Status),
+		}
+	}
+	m.startNextAttempt()
+	log.Infof(ctx, "Job %v is requeued as attempt %d\n", m.ID, m.Attempt)
 	return m.Update(ctx)
 }
+
+func (m *Job) startNextAttempt() {
+	attempt := m.CurrentAttempt()
+	m.AttemptHistory = append(m.AttemptHistory, JobAttempt{
+		Number:      attempt,
+		MessageID:   m.MessageID,
+		Zone:        m.Zone,
+		Hostname:    m.Hostname,
+		FailedStep:  m.FailedStep,
+		Reason:      m.FailureReason,
+		PublishedAt: m.PublishedAt,
+		StartTime:   m.StartTime,
+		FinishTime:  m.FinishTime,
+		FinishedAt:  time.Now(),
+	})
+	m.Attempt = attempt + 1
+	m.RetryAt = time.Time{}
+	m.Status = Ready
+	m.MessageID = ""
+	m.Zone = ""
+	m.Hostname = ""
+	m.FailedStep = ""
+	m.FailureReason = ""
+	m.PublishedAt = time.Time{}
+	m.StartTime = ""
+	m.FinishTime = ""
+}
+
+// IsDeadLetter returns true for the job which failed and won't be retried any more.
+// PrepareRetryIfPossible makes retryable jobs Ready, so Failure jobs are dead letters.
+func (m *Job) IsDeadLetter() bool {
+	return m.Status == Failure
+}
+
+const FailureReasonOutputTailSize = 1024
+
+// CaptureFailureReason records the last step, the host and the tail of the output
+// as FailureReason unless the reason is already given.
+func (m *Job) CaptureFailureReason(step JobStep) {
+	if m.FailureReason != "" {
+		return
+	}
+	lastStep := m.FailedStep
+	if lastStep == "" {
+		lastStep = step.String()
+	}
+	m.FailureReason = fmt.Sprintf("Failed at %s on %s: %s", lastStep, m.Hostname, m.OutputTail(FailureReasonOutputTailSize))
+}
+
+// OutputTail returns the last size bytes of Output.
+func (m *Job) OutputTail(size int) string {
+	return tailOf(strings.TrimSpace(m.Output), size)
+}
+
+// tailOf returns the last size bytes of s without breaking a multibyte character.
+func tailOf(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	start := len(s) - size
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+// RetryBackoff returns the interval to wait before publishing the current attempt.
+func (m *Job) RetryBackoff() time.Duration {
+	policy := m.EffectiveRetryPolicy()
+	return policy.Backoff(m.CurrentAttempt() - 1)
+}
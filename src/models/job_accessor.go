@@ -3,6 +3,7 @@ package models
 import (
 	"context"
 	"errors"
+	"time"
 
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
@@ -116,3 +117,59 @@ func (aa *JobAccessor) WorkingCount(ctx context.Context) (int, error) {
 
 	return cnt, nil
 }
+
+// ExecutingHostCount returns the number of hosts which have Executing jobs.
+func (aa *JobAccessor) ExecutingHostCount(ctx context.Context) (int, error) {
+	hosts, err := aa.ExecutingHosts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(hosts), nil
+}
+
+// ExecutingHosts returns the set of the hostnames which have Executing jobs.
+func (aa *JobAccessor) ExecutingHosts(ctx context.Context) (map[string]bool, error) {
+	jobs, err := aa.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+		return q.Filter("status =", int(Executing)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, job := range jobs {
+		hosts[job.Hostname] = true
+	}
+	return hosts, nil
+}
+
+func (aa *JobAccessor) DeadLetters(ctx context.Context) (Jobs, error) {
+	return aa.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+		return q.Filter("status =", int(Failure)), nil
+	})
+}
+
+// HasWaitingJobPrioritizedOver returns true if there is a Ready job which
+// isn't published yet and whose Priority is higher than the given job's.
+// The jobs waiting for the backoff of their retry don't block the given job.
+func (aa *JobAccessor) HasWaitingJobPrioritizedOver(ctx context.Context, job *Job) (bool, error) {
+	q := aa.Query().
+		Filter("status =", int(Ready)).
+		Filter("message_id =", "").
+		Filter("priority >", job.Priority)
+	now := time.Now()
+	iter := q.Run(ctx)
+	for {
+		m := Job{}
+		_, err := iter.Next(&m)
+		if err == datastore.Done {
+			return false, nil
+		}
+		if err != nil {
+			log.Errorf(ctx, "Failed to get Job with query %v because of %v\n", q, err)
+			return false, err
+		}
+		if !m.RetryAt.After(now) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+func (m *Job) HasDependency() bool {
+	return len(m.DependsOn.JobIDs) > 0
+}
+
+// ResolveDependency replaces the IDs by client in DependsOn with the job IDs,
+// rejects the dependency cycle and makes the job Preparing until the jobs depended on finish.
+// The jobs depended on must belong to the same pipeline and exist before the job is created.
+func (m *Job) ResolveDependency(ctx context.Context) error {
+	if !m.HasDependency() {
+		return nil
+	}
+
+	jobIds := []string{}
+	for _, ref := range m.DependsOn.JobIDs {
+		job, err := m.findJobDependedOn(ctx, ref)
+		if err != nil {
+			return err
+		}
+		jobIds = append(jobIds, job.ID)
+	}
+	m.DependsOn.JobIDs = jobIds
+
+	if err := m.checkDependencyCycle(ctx); err != nil {
+		return err
+	}
+
+	return m.ApplyDependency(ctx)
+}
+
+func (m *Job) findJobDependedOn(ctx context.Context, ref string) (*Job, error) {
+	accessor := m.Pipeline.JobAccessor()
+	if key, err := datastore.DecodeKey(ref); err == nil && key.Kind() == "Jobs" {
+		job, err := accessor.Find(ctx, ref)
+		if err == nil {
+			return job, nil
+		}
+		if err != ErrNoSuchJob {
+			if _, ok := err.(*InvalidReference); !ok {
+				return nil, err
+			}
+		}
+	}
+
+	jobs, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+		return q.Filter("id_by_client =", ref).KeysOnly(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch len(jobs) {
+	case 0:
+		return nil, &InvalidDependency{Msg: fmt.Sprintf("No job found for depends_on %q", ref)}
+	case 1:
+		return jobs[0], nil
+	default:
+		return nil, &InvalidDependency{Msg: fmt.Sprintf("%d jobs found for depends_on %q", len(jobs), ref)}
+	}
+}
+
+// checkDependencyCycle follows the jobs depended on and returns an error if it reaches the job itself.
+func (m *Job) checkDependencyCycle(ctx context.Context) error {
+	self := map[string]bool{}
+	if m.ID != "" {
+		self[m.ID] = true
+	}
+	if m.IdByClient != "" {
+		key := datastore.NewKey(ctx, "Jobs", fmt.Sprintf("%s-%s", m.Pipeline.Name, m.IdByClient), 0, nil)
+		self[key.Encode()] = true
+	}
+
+	visited := map[string]bool{}
+	queue := append([]string{}, m.DependsOn.JobIDs...)
+	for len(queue) > 0 {
+		jobId := queue[0]
+		queue = queue[1:]
+		if self[jobId] {
+			return &InvalidDependency{Msg: fmt.Sprintf("Dependency cycle found at %q", jobId)}
+		}
+		if visited[jobId] {
+			continue
+		}
+		visited[jobId] = true
+		job, err := GlobalJobAccessor.Find(ctx, jobId)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, job.DependsOn.JobIDs...)
+	}
+	return nil
+}
+
+// ApplyDependency makes the job Preparing while the jobs depended on are running,
+// Ready when the condition is satisfied, or Cancelled when it is never satisfied.
+func (m *Job) ApplyDependency(ctx context.Context) error {
+	finished, satisfied, err := m.DependsOn.Check(ctx)
+	if err != nil {
+		return err
+	}
+	m.SetStatusByDependency(finished, satisfied)
+	log.Debugf(ctx, "Job %v is %v by dependency %v\n", m.ID, m.Status, m.DependsOn)
+	return nil
+}
+
+func (m *Job) SetStatusByDependency(finished, satisfied bool) {
+	switch {
+	case !finished:
+		m.Status = Preparing
+	case satisfied:
+		m.Status = Ready
+	default:
+		m.Status = Cancelled
+		m.FailureReason = fmt.Sprintf("Dependency %v isn't satisfied", m.DependsOn.Condition)
+	}
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// JobEvent is a progress message received for the job.
+// It's stored as a child entity of the job.
+type JobEvent struct {
+	ID          string    `json:"id"           datastore:"-"`
+	MessageID   string    `json:"message_id"   datastore:"message_id,noindex"`
+	Attempt     int       `json:"attempt"      datastore:"attempt,noindex"`
+	Step        string    `json:"step"         datastore:"step,noindex"`
+	StepStatus  string    `json:"step_status"  datastore:"step_status,noindex"`
+	Completed   bool      `json:"completed"    datastore:"completed,noindex"`
+	Host        string    `json:"host"         datastore:"host,noindex"`
+	Zone        string    `json:"zone"         datastore:"zone,noindex"`
+	PublishTime time.Time `json:"publish_time" datastore:"publish_time,noindex"`
+	CreatedAt   time.Time `json:"created_at"   datastore:"created_at,noindex"`
+
+	job *Job
+}
+
+func NewJobEvent(job *Job, msg *pubsub.PubsubMessage, completed bool, step JobStep, stepStatus JobStepStatus) *JobEvent {
+	attrs := msg.Attributes
+	publishTime, err := time.Parse(time.RFC3339Nano, msg.PublishTime)
+	if err != nil {
+		publishTime = time.Now()
+	}
+	return &JobEvent{
+		job:         job,
+		MessageID:   msg.MessageId,
+		Attempt:     job.CurrentAttempt(),
+		Step:        step.String(),
+		StepStatus:  stepStatus.String(),
+		Completed:   completed,
+		Host:        attrs["host"],
+		Zone:        attrs["zone"],
+		PublishTime: publishTime,
+	}
+}
+
+// Create puts the event with the message ID as its key name,
+// so the message delivered again doesn't make another event.
+func (m *JobEvent) Create(ctx context.Context) error {
+	if m.job == nil || m.job.ID == "" {
+		return fmt.Errorf("No job to create JobEvent: %v\n", m)
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+	parentKey, err := datastore.DecodeKey(m.job.ID)
+	if err != nil {
+		return err
+	}
+	var key *datastore.Key
+	if m.MessageID != "" {
+		key = datastore.NewKey(ctx, "JobEvents", m.MessageID, 0, parentKey)
+	} else {
+		key = datastore.NewIncompleteKey(ctx, "JobEvents", parentKey)
+	}
+	res, err := datastore.Put(ctx, key, m)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put JobEvent %v because of %v\n", m, err)
+		return err
+	}
+	m.ID = res.Encode()
+	return nil
+}
+
+type JobEvents []*JobEvent
+
+// Events returns the events of the job in order of their publish time.
+func (m *Job) Events(ctx context.Context) (JobEvents, error) {
+	parentKey, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery("JobEvents").Ancestor(parentKey)
+	iter := q.Run(ctx)
+	res := JobEvents{}
+	for {
+		event := JobEvent{}
+		key, err := iter.Next(&event)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		event.ID = key.Encode()
+		event.job = m
+		res = append(res, &event)
+	}
+	res.SortByPublishTime()
+	return res, nil
+}
+
+func (events JobEvents) SortByPublishTime() {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].PublishTime.Before(events[j].PublishTime)
+	})
+}
+
+// JobStepDuration is the duration of a step in an attempt.
+// Status is empty and FinishedAt is zero while the step is running.
+type JobStepDuration struct {
+	Attempt         int       `json:"attempt"`
+	Step            string    `json:"step"`
+	Host            string    `json:"host"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// StepDurations returns the durations of the steps from STARTING to SUCCESS or FAILURE.
+// The events must be sorted by publish time.
+func (events JobEvents) StepDurations() []*JobStepDuration {
+	res := []*JobStepDuration{}
+	running := map[string]*JobStepDuration{}
+	for _, event := range events {
+		k := fmt.Sprintf("%d-%s", event.Attempt, event.Step)
+		switch event.StepStatus {
+		case STARTING.String():
+			d := &JobStepDuration{
+				Attempt:   event.Attempt,
+				Step:      event.Step,
+				Host:      event.Host,
+				StartedAt: event.PublishTime,
+			}
+			running[k] = d
+			res = append(res, d)
+		case SUCCESS.String(), FAILURE.String():
+			d, ok := running[k]
+			if !ok {
+				continue
+			}
+			d.Status = event.StepStatus
+			d.FinishedAt = event.PublishTime
+			d.DurationSeconds = d.FinishedAt.Sub(d.StartedAt).Seconds()
+			delete(running, k)
+		}
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pubsub "google.golang.org/api/pubsub/v1"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestJobEvents(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"JobEvents", "Jobs", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	job := &Job{
+		Pipeline:   pl,
+		IdByClient: "job-1",
+		Status:     Published,
+	}
+	err = job.Create(ctx)
+	assert.NoError(t, err)
+
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	type Progress struct {
+		Step       string
+		StepStatus string
+		Seconds    int
+	}
+	progresses := []Progress{
+		{"DOWNLOADING", "STARTING", 0},
+		{"DOWNLOADING", "SUCCESS", 3},
+		{"EXECUTING", "STARTING", 4},
+		{"EXECUTING", "SUCCESS", 14},
+		{"UPLOADING", "STARTING", 15},
+	}
+	msgs := []*pubsub.ReceivedMessage{}
+	for i, p := range progresses {
+		msgs = append(msgs, &pubsub.ReceivedMessage{
+			Message: &pubsub.PubsubMessage{
+				MessageId:   fmt.Sprintf("msg-%d", i),
+				PublishTime: base.Add(time.Duration(p.Seconds) * time.Second).Format(time.RFC3339Nano),
+				Attributes: map[string]string{
+					"completed":   "false",
+					"step":        p.Step,
+					"step_status": p.StepStatus,
+					"host":        "host-1",
+					"zone":        "asia-northeast1-a",
+				},
+			},
+		})
+	}
+	// The message delivered again
+	msgs = append(msgs, msgs[3])
+
+	err = pl.OverwriteJobByMessages(ctx, job, msgs)
+	assert.NoError(t, err)
+
+	events, err := job.Events(ctx)
+	assert.NoError(t, err)
+	if assert.Equal(t, 5, len(events)) {
+		assert.Equal(t, "DOWNLOADING", events[0].Step)
+		assert.Equal(t, "STARTING", events[0].StepStatus)
+		assert.Equal(t, "host-1", events[0].Host)
+		assert.Equal(t, 1, events[0].Attempt)
+		assert.Equal(t, "msg-4", events[4].MessageID)
+	}
+
+	durations := events.StepDurations()
+	if assert.Equal(t, 3, len(durations)) {
+		assert.Equal(t, "DOWNLOADING", durations[0].Step)
+		assert.Equal(t, "SUCCESS", durations[0].Status)
+		assert.Equal(t, float64(3), durations[0].DurationSeconds)
+		assert.Equal(t, "EXECUTING", durations[1].Step)
+		assert.Equal(t, float64(10), durations[1].DurationSeconds)
+		// Still running
+		assert.Equal(t, "UPLOADING", durations[2].Step)
+		assert.Empty(t, durations[2].Status)
+		assert.True(t, durations[2].FinishedAt.IsZero())
+	}
+}
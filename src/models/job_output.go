@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// OutputInlineTailSize is the size of the output kept in Job.Output
+// when the output chunks are written to an OutputStore.
+const OutputInlineTailSize = FailureReasonOutputTailSize
+
+const outputChunkSeparator = "\n\n"
+
+// JobOutputChunk is the reference to an output chunk written to the OutputStore.
+// It's stored as a child entity of the job not to make the job entity grow.
+type JobOutputChunk struct {
+	Name      string    `json:"name"       datastore:"name,noindex"`
+	CreatedAt time.Time `json:"created_at" datastore:"created_at"`
+}
+
+// OutputChunkName returns the object name of the output chunk for the message.
+func (m *Job) OutputChunkName(msgID string) string {
+	return fmt.Sprintf("jobs/%s/output/%s", m.ID, m.outputChunkKeyName(msgID))
+}
+
+func (m *Job) outputChunkKeyName(msgID string) string {
+	if msgID == "" {
+		return fmt.Sprintf("chunk-%06d", m.OutputChunkCount)
+	}
+	return msgID
+}
+
+// AppendOutput appends data to the output of the job.
+// Without store, data is appended to Output as before.
+// With store, data is written as a chunk named by msgID and Output keeps only its tail.
+// The chunk which is already appended is ignored because the message can be delivered again.
+func (m *Job) AppendOutput(ctx context.Context, store OutputStore, msgID string, data []byte) error {
+	if store == nil {
+		m.Output += outputChunkSeparator + string(data)
+		return nil
+	}
+
+	parentKey, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return err
+	}
+	key := datastore.NewKey(ctx, "JobOutputChunks", m.outputChunkKeyName(msgID), 0, parentKey)
+	chunk := &JobOutputChunk{}
+	err = datastore.Get(ctx, key, chunk)
+	switch {
+	case err == nil:
+		log.Infof(ctx, "Ignore output chunk %q because it's already written\n", chunk.Name)
+		return nil
+	case err != datastore.ErrNoSuchEntity:
+		return err
+	}
+
+	chunk = &JobOutputChunk{Name: m.OutputChunkName(msgID), CreatedAt: time.Now()}
+	err = store.Write(ctx, chunk.Name, data)
+	if err != nil {
+		log.Errorf(ctx, "Failed to write output chunk %q because of %v\n", chunk.Name, err)
+		return err
+	}
+	_, err = datastore.Put(ctx, key, chunk)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put JobOutputChunk %v because of %v\n", chunk, err)
+		return err
+	}
+	m.OutputChunkCount++
+	m.Output = tailOf(m.Output+outputChunkSeparator+string(data), OutputInlineTailSize)
+	return nil
+}
+
+// OutputChunks returns the output chunks of the job in the order they were written.
+func (m *Job) OutputChunks(ctx context.Context) ([]*JobOutputChunk, error) {
+	parentKey, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := []*JobOutputChunk{}
+	_, err = datastore.NewQuery("JobOutputChunks").Ancestor(parentKey).GetAll(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// WriteOutputTo writes the whole output of the job to w.
+func (m *Job) WriteOutputTo(ctx context.Context, store OutputStore, w io.Writer) error {
+	if m.OutputChunkCount == 0 {
+		_, err := io.WriteString(w, m.Output)
+		return err
+	}
+	if store == nil {
+		return &InvalidOperation{
+			Msg: fmt.Sprintf("Job %v has %d output chunks but no output store is configured", m.ID, m.OutputChunkCount),
+		}
+	}
+	chunks, err := m.OutputChunks(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get the output chunks of job %v because of %v\n", m.ID, err)
+		return err
+	}
+	for _, chunk := range chunks {
+		err := m.copyOutputChunk(ctx, store, chunk.Name, w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Job) copyOutputChunk(ctx context.Context, store OutputStore, name string, w io.Writer) error {
+	r, err := store.Open(ctx, name)
+	if err != nil {
+		log.Errorf(ctx, "Failed to open output chunk %q because of %v\n", name, err)
+		return err
+	}
+	defer r.Close()
+	_, err = io.WriteString(w, outputChunkSeparator)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const MaxJobSearchLimit = 1000
+
+// JobProjectionFields maps the JSON field names which can be projected to the property names.
+// The fields are projected from the loaded jobs but not by the datastore projection query
+// because it requires a composite index for each combination of the fields and the filters.
+var JobProjectionFields = map[string]string{
+	"id_by_client": "id_by_client",
+	"status":       "status",
+	"priority":     "priority",
+	"message_id":   "message_id",
+	"zone":         "zone",
+	"hostname":     "hostname",
+	"attempt":      "attempt",
+	"created_at":   "CreatedAt",
+	"updated_at":   "UpdatedAt",
+}
+
+// JobSearchCondition is the condition of the job listing.
+// The jobs are ordered by id_by_client with IdByClientPrefix or by CreatedAt otherwise.
+type JobSearchCondition struct {
+	Status           *JobStatus
+	IdByClientPrefix string
+	CreatedAfter     time.Time
+	CreatedBefore    time.Time
+	Limit            int // No limit if it's 0
+	Cursor           string
+	Fields           []string // JSON field names to project
+}
+
+// ParseJobStatus parses the name or the number of JobStatus.
+func ParseJobStatus(s string) (JobStatus, error) {
+	for st, name := range JobStatusToString {
+		if name == s {
+			return st, nil
+		}
+	}
+	i, err := strconv.Atoi(s)
+	if err == nil {
+		st := JobStatus(i)
+		if _, ok := JobStatusToString[st]; ok {
+			return st, nil
+		}
+	}
+	return Preparing, fmt.Errorf("Invalid JobStatus: %q", s)
+}
+
+func (c *JobSearchCondition) Validate() error {
+	if c.Limit < 0 || c.Limit > MaxJobSearchLimit {
+		return &InvalidSearchCondition{Msg: fmt.Sprintf("limit must be less than or equal to %d but was %d", MaxJobSearchLimit, c.Limit)}
+	}
+	if c.IdByClientPrefix != "" && (!c.CreatedAfter.IsZero() || !c.CreatedBefore.IsZero()) {
+		// Datastore allows inequality filters on only one property
+		return &InvalidSearchCondition{Msg: "id_by_client prefix can't be combined with created_after or created_before"}
+	}
+	for _, f := range c.Fields {
+		if _, ok := JobProjectionFields[f]; !ok {
+			return &InvalidSearchCondition{Msg: fmt.Sprintf("Unsupported field to project: %q", f)}
+		}
+	}
+	return nil
+}
+
+func (c *JobSearchCondition) apply(q *datastore.Query) (*datastore.Query, error) {
+	if c.Status != nil {
+		q = q.Filter("status =", int(*c.Status))
+	}
+	if c.IdByClientPrefix != "" {
+		q = q.Filter("id_by_client >=", c.IdByClientPrefix).
+			Filter("id_by_client <", c.IdByClientPrefix+"\ufffd").
+			Order("id_by_client")
+	} else {
+		if !c.CreatedAfter.IsZero() {
+			q = q.Filter("CreatedAt >", c.CreatedAfter)
+		}
+		if !c.CreatedBefore.IsZero() {
+			q = q.Filter("CreatedAt <", c.CreatedBefore)
+		}
+		q = q.Order("CreatedAt")
+	}
+	if c.Limit > 0 {
+		q = q.Limit(c.Limit)
+	}
+	if c.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(c.Cursor)
+		if err != nil {
+			return nil, &InvalidSearchCondition{Msg: fmt.Sprintf("Invalid cursor: %q", c.Cursor)}
+		}
+		q = q.Start(cursor)
+	}
+	return q, nil
+}
+
+// Search returns the jobs which match the condition and the cursor for the next page.
+// The cursor is empty when the jobs are not limited or less than the limit.
+// The pages are ordered by CreatedAt or id_by_client but not by priority.
+func (aa *JobAccessor) Search(ctx context.Context, c *JobSearchCondition) (Jobs, string, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := c.apply(aa.Query())
+	if err != nil {
+		return nil, "", err
+	}
+	iter := q.Run(ctx)
+	res := Jobs{}
+	for {
+		m := Job{}
+		key, err := iter.Next(&m)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Errorf(ctx, "Failed to search jobs because of %v\n", err)
+			return nil, "", err
+		}
+		m.ID = key.Encode()
+		msg := &m.Message
+		msg.EntriesToMap()
+		res = append(res, &m)
+	}
+
+	if c.Limit == 0 || len(res) < c.Limit {
+		return res, "", nil
+	}
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return res, cursor.String(), nil
+}
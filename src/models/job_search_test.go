@@ -0,0 +1,147 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestParseJobStatus(t *testing.T) {
+	for _, s := range []string{"Ready", "1"} {
+		st, err := ParseJobStatus(s)
+		assert.NoError(t, err)
+		assert.Equal(t, Ready, st)
+	}
+	for _, s := range []string{"ready", "99", ""} {
+		_, err := ParseJobStatus(s)
+		assert.Error(t, err)
+	}
+}
+
+func TestJobAccessorSearch(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Jobs", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	jobs := Jobs{}
+	for i, st := range []JobStatus{Ready, Success, Ready, Failure, Ready} {
+		prefix := "a"
+		if i >= 3 {
+			prefix = "b"
+		}
+		job := &Job{
+			Pipeline:   pl,
+			IdByClient: fmt.Sprintf("%s-job-%d", prefix, i),
+			Status:     st,
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+		jobs = append(jobs, job)
+	}
+	accessor := pl.JobAccessor()
+
+	idsByClient := func(jobs Jobs) []string {
+		res := []string{}
+		for _, job := range jobs {
+			res = append(res, job.IdByClient)
+		}
+		return res
+	}
+
+	// No condition
+	res, cursor, err := accessor.Search(ctx, &JobSearchCondition{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(res))
+	assert.Empty(t, cursor)
+
+	// Status
+	ready := Ready
+	res, _, err = accessor.Search(ctx, &JobSearchCondition{Status: &ready})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-job-0", "a-job-2", "b-job-4"}, idsByClient(res))
+
+	// Prefix of id_by_client
+	res, _, err = accessor.Search(ctx, &JobSearchCondition{IdByClientPrefix: "b-"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b-job-3", "b-job-4"}, idsByClient(res))
+
+	// Created time range
+	res, _, err = accessor.Search(ctx, &JobSearchCondition{
+		CreatedAfter:  jobs[0].CreatedAt,
+		CreatedBefore: jobs[4].CreatedAt,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-job-1", "a-job-2", "b-job-3"}, idsByClient(res))
+
+	// Pagination
+	cond := &JobSearchCondition{Limit: 2}
+	pages := [][]string{}
+	for {
+		res, cursor, err = accessor.Search(ctx, cond)
+		assert.NoError(t, err)
+		pages = append(pages, idsByClient(res))
+		if cursor == "" {
+			break
+		}
+		cond.Cursor = cursor
+	}
+	assert.Equal(t, [][]string{{"a-job-0", "a-job-1"}, {"a-job-2", "b-job-3"}, {"b-job-4"}}, pages)
+
+	// Fields are projected from the loaded jobs by the handler
+	res, _, err = accessor.Search(ctx, &JobSearchCondition{Status: &ready, Fields: []string{"status"}})
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(res)) {
+		assert.Equal(t, Ready, res[2].Status)
+		assert.Equal(t, jobs[4].ID, res[2].ID)
+		assert.Equal(t, "b-job-4", res[2].IdByClient)
+	}
+
+	// Invalid conditions
+	invalids := []*JobSearchCondition{
+		{Limit: MaxJobSearchLimit + 1},
+		{IdByClientPrefix: "a-", CreatedAfter: jobs[0].CreatedAt},
+		{Fields: []string{"output"}},
+		{Cursor: "invalid-cursor"},
+	}
+	for _, cond := range invalids {
+		_, _, err = accessor.Search(ctx, cond)
+		assert.IsType(t, &InvalidSearchCondition{}, err, "condition: %v", cond)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/appengine"
@@ -158,13 +159,16 @@ func TestJobCRUD(t *testing.T) {
 
 		saved, err := GlobalJobAccessor.Find(ctx, job.ID)
 		assert.NoError(t, err)
-		assert.Equal(t, 2, len(saved.Message.AttributeEntries))
+		assert.Equal(t, 3, len(saved.Message.AttributeEntries))
 		entry0 := saved.Message.AttributeEntries[0]
 		assert.Equal(t, "download_files", entry0.Name)
 		assert.Equal(t, string(download_files_json), entry0.Value)
 		entry1 := saved.Message.AttributeEntries[1]
 		assert.Equal(t, JobIdKey, entry1.Name)
 		assert.Equal(t, saved.ID, entry1.Value)
+		entry2 := saved.Message.AttributeEntries[2]
+		assert.Equal(t, JobAttemptKey, entry2.Name)
+		assert.Equal(t, "1", entry2.Value)
 	}
 
 	test_utils.ClearDatastore(t, ctx, "Jobs")
@@ -335,3 +339,171 @@ func TestJobUpdateStatusIfGreaterThanBefore(t *testing.T) {
 		}
 	}
 }
+
+func TestJobCaptureFailureReason(t *testing.T) {
+	job := &Job{Hostname: "host-1", Output: "\n\nline1\nline2\n"}
+	job.CaptureFailureReason(CANCELLING)
+	assert.Equal(t, "Failed at CANCELLING on host-1: line1\nline2", job.FailureReason)
+
+	// Keep the reason given before
+	job.CaptureFailureReason(EXECUTING)
+	assert.Equal(t, "Failed at CANCELLING on host-1: line1\nline2", job.FailureReason)
+
+	// The step which failed last is preferred
+	job = &Job{Hostname: "host-2", FailedStep: "DOWNLOADING", Output: "error"}
+	job.CaptureFailureReason(CANCELLING)
+	assert.Equal(t, "Failed at DOWNLOADING on host-2: error", job.FailureReason)
+
+	job = &Job{Output: "0123456789"}
+	assert.Equal(t, "789", job.OutputTail(3))
+	job = &Job{Output: "あいう"}
+	assert.Equal(t, "う", job.OutputTail(4))
+}
+
+func TestJobCancel(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Jobs", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	originalPublisher := GlobalPublisher
+	dummyPublisher := &DummyPublisher{}
+	GlobalPublisher = dummyPublisher
+	defer func() {
+		GlobalPublisher = originalPublisher
+	}()
+
+	// The job published to the workers
+	executing := &Job{
+		Pipeline:   pl,
+		IdByClient: "job-executing",
+		Status:     Executing,
+		MessageID:  "msg-1",
+	}
+	err = executing.Create(ctx)
+	assert.NoError(t, err)
+
+	err = executing.Cancel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Executing, executing.Status)
+	assert.True(t, executing.CancelRequested)
+	assert.False(t, executing.CancelRequestedAt.IsZero())
+	if assert.Equal(t, 1, len(dummyPublisher.Invocations)) {
+		inv := dummyPublisher.Invocations[0]
+		assert.Equal(t, "projects/dummy-proj-111/topics/pipeline1-control-topic", inv.Topic)
+		attrs := inv.Messages[0].Attributes
+		assert.Equal(t, CancelCommand, attrs[CommandKey])
+		assert.Equal(t, executing.ID, attrs[JobIdKey])
+		assert.Equal(t, "1", attrs[JobAttemptKey])
+		assert.Equal(t, "msg-1", attrs[JobMessageIdKey])
+	}
+
+	// Cancel again doesn't publish the command
+	err = executing.Cancel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dummyPublisher.Invocations))
+
+	// The worker reports CANCELLING
+	err = executing.UpdateStatusIfGreaterThanBefore(ctx, false, CANCELLING, SUCCESS)
+	assert.NoError(t, err)
+	saved, err := GlobalJobAccessor.Find(ctx, executing.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, saved.Status)
+	assert.True(t, saved.CancelRequested)
+
+	// The job not published yet
+	ready := &Job{
+		Pipeline:   pl,
+		IdByClient: "job-ready",
+		Status:     Ready,
+	}
+	err = ready.Create(ctx)
+	assert.NoError(t, err)
+
+	err = ready.Cancel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, ready.Status)
+	assert.False(t, ready.CancelRequested)
+	assert.Equal(t, 1, len(dummyPublisher.Invocations))
+
+	// The job published but not started is cancelled immediately with the command
+	published := &Job{
+		Pipeline:   pl,
+		IdByClient: "job-published",
+		Status:     Published,
+		MessageID:  "msg-2",
+	}
+	err = published.Create(ctx)
+	assert.NoError(t, err)
+
+	err = published.Cancel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, published.Status)
+	if assert.Equal(t, 2, len(dummyPublisher.Invocations)) {
+		attrs := dummyPublisher.Invocations[1].Messages[0].Attributes
+		assert.Equal(t, published.ID, attrs[JobIdKey])
+	}
+
+	// The worker which never reports CANCELLING
+	silent := &Job{
+		Pipeline:   pl,
+		IdByClient: "job-silent",
+		Status:     Executing,
+		MessageID:  "msg-3",
+	}
+	err = silent.Create(ctx)
+	assert.NoError(t, err)
+	err = silent.Cancel(ctx)
+	assert.NoError(t, err)
+	assert.True(t, silent.CancelRequested)
+
+	expired, err := silent.ExpireCancelRequest(ctx, silent.CancelRequestExpiresAt().Add(-time.Second))
+	assert.NoError(t, err)
+	assert.False(t, expired)
+	assert.Equal(t, Executing, silent.Status)
+
+	expired, err = silent.ExpireCancelRequest(ctx, silent.CancelRequestExpiresAt())
+	assert.NoError(t, err)
+	assert.True(t, expired)
+	saved, err = GlobalJobAccessor.Find(ctx, silent.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, saved.Status)
+	assert.NotEmpty(t, saved.FailureReason)
+
+	// The job cancelled by the worker isn't changed
+	expired, err = executing.ExpireCancelRequest(ctx, executing.CancelRequestExpiresAt())
+	assert.NoError(t, err)
+	assert.False(t, expired)
+}
@@ -1,5 +1,9 @@
 package models
 
+import (
+	"sort"
+)
+
 type Jobs []*Job
 
 func (jobs Jobs) AllFinished() bool {
@@ -35,3 +39,20 @@ func (jobs Jobs) IDs() []string {
 	}
 	return jobIDs
 }
+
+// ByPriority sorts jobs in the order to be published.
+// Jobs with higher Priority come first and older jobs come first in the same Priority.
+type ByPriority Jobs
+
+func (a ByPriority) Len() int      { return len(a) }
+func (a ByPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByPriority) Less(i, j int) bool {
+	if a[i].Priority != a[j].Priority {
+		return a[i].Priority > a[j].Priority
+	}
+	return a[i].CreatedAt.Before(a[j].CreatedAt)
+}
+
+func (jobs Jobs) SortByPriority() {
+	sort.Stable(ByPriority(jobs))
+}
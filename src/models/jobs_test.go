@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -56,3 +57,21 @@ func TestJobsAllFinished(t *testing.T) {
 		}
 	}
 }
+
+func TestJobsSortByPriority(t *testing.T) {
+	base := time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+	jobs := Jobs{
+		&Job{IdByClient: "low-old", Priority: 0, CreatedAt: base},
+		&Job{IdByClient: "high-new", Priority: 10, CreatedAt: base.Add(2 * time.Minute)},
+		&Job{IdByClient: "low-new", Priority: 0, CreatedAt: base.Add(1 * time.Minute)},
+		&Job{IdByClient: "high-old", Priority: 10, CreatedAt: base.Add(1 * time.Minute)},
+		&Job{IdByClient: "negative", Priority: -1, CreatedAt: base},
+	}
+	jobs.SortByPriority()
+
+	result := []string{}
+	for _, job := range jobs {
+		result = append(result, job.IdByClient)
+	}
+	assert.Equal(t, []string{"high-old", "high-new", "low-old", "low-new", "negative"}, result)
+}
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	MaxLabels           = 64
+	OrganizationIDLabel = "blocks-batch-org-id"
+	PipelineIDLabel     = "blocks-batch-pipeline-id"
+)
+
+// See https://cloud.google.com/compute/docs/labeling-resources
+var (
+	LabelKeyRegexp   = regexp.MustCompile(`\A\p{Ll}[\p{Ll}\p{Lo}\p{N}_-]{0,62}\z`)
+	LabelValueRegexp = regexp.MustCompile(`\A[\p{Ll}\p{Lo}\p{N}_-]{0,63}\z`)
+)
+
+// ReservedLabelKeys are the keys of the labels given automatically.
+var ReservedLabelKeys = []string{OrganizationIDLabel, PipelineIDLabel}
+
+type Label struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Labels are the labels of GCP resources sorted by Key.
+// They are stored as a list of Label in datastore and represented as an object in JSON.
+type Labels []Label
+
+func NewLabels(m map[string]string) Labels {
+	r := Labels{}
+	for k, v := range m {
+		r = append(r, Label{Key: k, Value: v})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Key < r[j].Key })
+	return r
+}
+
+func (l Labels) Map() map[string]string {
+	r := map[string]string{}
+	for _, label := range l {
+		r[label.Key] = label.Value
+	}
+	return r
+}
+
+func (l Labels) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Map())
+}
+
+func (l *Labels) UnmarshalJSON(data []byte) error {
+	m := map[string]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*l = NewLabels(m)
+	return nil
+}
+
+// UnmarshalParam parses the lines of "key=value" from the form of the admin console.
+func (l *Labels) UnmarshalParam(src string) error {
+	m := map[string]string{}
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 {
+			return fmt.Errorf("Invalid label %q. It must be key=value", line)
+		}
+		m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	*l = NewLabels(m)
+	return nil
+}
+
+// Text returns the lines of "key=value" for the form of the admin console.
+func (l Labels) Text() string {
+	lines := []string{}
+	for _, label := range l {
+		lines = append(lines, label.Key+"="+label.Value)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (l Labels) Validate() error {
+	if len(l) > MaxLabels {
+		return fmt.Errorf("Too many labels: %d labels given but the limit is %d", len(l), MaxLabels)
+	}
+	keys := map[string]bool{}
+	for _, label := range l {
+		if !LabelKeyRegexp.MatchString(label.Key) {
+			return fmt.Errorf("Invalid label key: %q", label.Key)
+		}
+		if !LabelValueRegexp.MatchString(label.Value) {
+			return fmt.Errorf("Invalid label value of %q: %q", label.Key, label.Value)
+		}
+		for _, reserved := range ReservedLabelKeys {
+			if label.Key == reserved {
+				return fmt.Errorf("Label key %q is reserved", label.Key)
+			}
+		}
+		if keys[label.Key] {
+			return fmt.Errorf("Duplicated label key: %q", label.Key)
+		}
+		keys[label.Key] = true
+	}
+	return nil
+}
+
+// Merge returns the labels which have the labels of others.
+// The latter one wins when the same key is given.
+func (l Labels) Merge(others ...Labels) Labels {
+	m := l.Map()
+	for _, other := range others {
+		for _, label := range other {
+			m[label.Key] = label.Value
+		}
+	}
+	return NewLabels(m)
+}
+
+var invalidLabelValueChars = regexp.MustCompile(`[^\p{Ll}\p{Lo}\p{N}_-]`)
+
+// LabelValueOfID returns the label value for the encoded key id.
+// It's the integer ID or the name converted to satisfy the label rules.
+func LabelValueOfID(id string) string {
+	if id == "" {
+		return ""
+	}
+	key, err := datastore.DecodeKey(id)
+	if err != nil || key == nil {
+		return ""
+	}
+	if key.IntID() != 0 {
+		return strconv.FormatInt(key.IntID(), 10)
+	}
+	v := []rune(invalidLabelValueChars.ReplaceAllString(strings.ToLower(key.StringID()), "_"))
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return string(v)
+}
+
+// MergedLabels returns the labels given to the resources of the pipeline.
+// The labels of the pipeline override the ones of the organization
+// and the IDs of them are given automatically.
+func (m *Pipeline) MergedLabels() Labels {
+	auto := Labels{}
+	base := Labels{}
+	if m.Organization != nil {
+		base = m.Organization.Labels
+		if v := LabelValueOfID(m.Organization.ID); v != "" {
+			auto = append(auto, Label{Key: OrganizationIDLabel, Value: v})
+		}
+	}
+	if v := LabelValueOfID(m.ID); v != "" {
+		auto = append(auto, Label{Key: PipelineIDLabel, Value: v})
+	}
+	return base.Merge(m.Labels, auto)
+}
+
+// ValidateMergedLabels returns an error if MergedLabels exceeds MaxLabels.
+// The reserved labels are counted even before the pipeline has its ID.
+func (m *Pipeline) ValidateMergedLabels() error {
+	base := Labels{}
+	if m.Organization != nil {
+		base = m.Organization.Labels
+	}
+	n := len(base.Merge(m.Labels)) + len(ReservedLabelKeys)
+	if n > MaxLabels {
+		return fmt.Errorf("Too many labels: %d labels given with the ones of the organization and reserved ones but the limit is %d", n, MaxLabels)
+	}
+	return nil
+}
+
+// ValidateLabelsOfPipelines returns an error if the labels of the organization make
+// the labels of its pipelines which aren't closed exceed MaxLabels.
+func (m *Organization) ValidateLabelsOfPipelines(ctx context.Context) error {
+	pipelines, err := m.PipelineAccessor().GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pl := range pipelines {
+		if StatusesAlreadyClosing.Include(pl.Status) {
+			continue
+		}
+		pl.Organization = m
+		if err := pl.ValidateMergedLabels(); err != nil {
+			return fmt.Errorf("Pipeline %v: %v", pl.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestLabelsValidate(t *testing.T) {
+	valids := []Labels{
+		nil,
+		{{Key: "team", Value: "image-processing"}},
+		{{Key: "cost_center", Value: ""}, {Key: "env", Value: "prod1"}},
+	}
+	for _, l := range valids {
+		assert.NoError(t, l.Validate(), "%v", l)
+	}
+
+	invalids := []Labels{
+		{{Key: "Team", Value: "a"}},
+		{{Key: "1team", Value: "a"}},
+		{{Key: "team", Value: "Image"}},
+		{{Key: "team", Value: "a.b"}},
+		{{Key: "a0123456789012345678901234567890123456789012345678901234567890123", Value: "a"}},
+		{{Key: OrganizationIDLabel, Value: "1"}},
+		{{Key: "team", Value: "a"}, {Key: "team", Value: "b"}},
+	}
+	for _, l := range invalids {
+		assert.Error(t, l.Validate(), "%v", l)
+	}
+}
+
+func TestLabelsJSONAndParam(t *testing.T) {
+	pl := &Pipeline{}
+	err := json.Unmarshal([]byte(`{"labels":{"team":"ml","env":"prod"}}`), pl)
+	assert.NoError(t, err)
+	assert.Equal(t, Labels{{Key: "env", Value: "prod"}, {Key: "team", Value: "ml"}}, pl.Labels)
+
+	b, err := json.Marshal(pl.Labels)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":"prod","team":"ml"}`, string(b))
+
+	l := Labels{}
+	err = l.UnmarshalParam("team = ml\r\n\nenv=prod\n")
+	assert.NoError(t, err)
+	assert.Equal(t, Labels{{Key: "env", Value: "prod"}, {Key: "team", Value: "ml"}}, l)
+	assert.Equal(t, "env=prod\nteam=ml", l.Text())
+
+	err = l.UnmarshalParam("team")
+	assert.Error(t, err)
+}
+
+func TestPipelineMergedLabels(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	assert.NoError(t, err)
+	defer done()
+
+	orgKey := datastore.NewKey(ctx, "Organizations", "", 12, nil)
+	plKey := datastore.NewKey(ctx, "Pipelines", "", 345, orgKey)
+	org := &Organization{
+		ID:     orgKey.Encode(),
+		Name:   "org01",
+		Labels: Labels{{Key: "env", Value: "prod"}, {Key: "team", Value: "ml"}},
+	}
+	b, pl := setupForBuildDeployment()
+	pl.ID = plKey.Encode()
+	pl.Organization = org
+	pl.Labels = Labels{{Key: "team", Value: "vision"}}
+
+	expected := map[string]interface{}{
+		"env":               "prod",
+		"team":              "vision",
+		OrganizationIDLabel: "12",
+		PipelineIDLabel:     "345",
+	}
+	assert.Equal(t, expected, b.buildLabels(pl.MergedLabels()))
+
+	for _, r := range b.GenerateDeploymentResources(pl).Resources {
+		switch r.Type {
+		case "pubsub.v1.topic", "pubsub.v1.subscription":
+			assert.Equal(t, expected, r.Properties["labels"], r.Name)
+		case "compute.v1.instanceTemplate":
+			props := r.Properties["properties"].(map[string]interface{})
+			assert.Equal(t, expected, props["labels"])
+		}
+	}
+
+	d, err := b.BuildDeployment(pl)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(d.Labels))
+
+	assert.NoError(t, pl.ValidateMergedLabels())
+
+	// The labels of the organization and the reserved ones are counted
+	many := map[string]string{}
+	for i := 0; i < MaxLabels-len(ReservedLabelKeys); i++ {
+		many[fmt.Sprintf("org-label-%d", i)] = "v"
+	}
+	org.Labels = NewLabels(many)
+	assert.NoError(t, org.Labels.Validate())
+	pl.Labels = Labels{{Key: "org-label-0", Value: "overridden"}}
+	assert.NoError(t, pl.ValidateMergedLabels())
+	pl.Labels = Labels{{Key: "team", Value: "vision"}}
+	assert.NoError(t, pl.Labels.Validate())
+	assert.Error(t, pl.ValidateMergedLabels())
+	// Checked only at creation not to block the running pipelines
+	assert.NoError(t, pl.Validate())
+	_, ok := pl.CreateWith(ctx, func(ctx context.Context) error { return nil }).(*InvalidOperation)
+	assert.True(t, ok)
+
+	// Checked for the running pipelines when the labels of the organization are updated
+	pl.Status = Opened
+	_, err = datastore.Put(ctx, plKey, pl)
+	assert.NoError(t, err)
+	assert.Error(t, org.ValidateLabelsOfPipelines(ctx))
+	org.Labels = Labels{{Key: "env", Value: "prod"}}
+	assert.NoError(t, org.ValidateLabelsOfPipelines(ctx))
+
+	assert.Equal(t, "pipeline_01", LabelValueOfID(datastore.NewKey(ctx, "Pipelines", "Pipeline.01", 0, nil).Encode()))
+}
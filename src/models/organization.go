@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"google.golang.org/appengine/datastore"
@@ -15,8 +17,13 @@ type (
 		Name        string    `json:"name" form:"name" validate:"required"`
 		Memo        string    `json:"memo" form:"memo"`
 		TokenAmount int       `json:"token_amount" form:"token_amount"`
+		Labels      Labels    `json:"labels" form:"labels"`
 		CreatedAt   time.Time `json:"created_at"`
 		UpdatedAt   time.Time `json:"updated_at"`
+
+		// AllowedServiceAccounts are the emails of the service accounts which
+		// the pipelines of the organization can use besides the default one.
+		AllowedServiceAccounts []string `json:"allowed_service_accounts" form:"allowed_service_accounts"`
 	}
 )
 
@@ -31,7 +38,36 @@ func (m *Organization) Validate() error {
 
 	validator := validator.New()
 	err := validator.Struct(m)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := m.Labels.Validate(); err != nil {
+		return err
+	}
+
+	// Blank entries come from the blank input of the admin form
+	emails := []string{}
+	for _, email := range m.AllowedServiceAccounts {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		if !ServiceAccountEmailRegexp.MatchString(email) {
+			return fmt.Errorf("Invalid service account email: %q", email)
+		}
+		emails = append(emails, email)
+	}
+	m.AllowedServiceAccounts = emails
+	return nil
+}
+
+func (m *Organization) ServiceAccountAllowed(email string) bool {
+	for _, allowed := range m.AllowedServiceAccounts {
+		if allowed == email {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *Organization) Create(ctx context.Context) error {
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2/google"
+
+	storage "google.golang.org/api/storage/v1"
+	"google.golang.org/appengine/log"
+)
+
+// OutputStore stores the output chunks of jobs as named objects.
+type OutputStore interface {
+	Write(ctx context.Context, name string, data []byte) error
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// GcsOutputStore stores the output chunks in the Cloud Storage bucket.
+type GcsOutputStore struct {
+	Bucket  string
+	Prefix  string
+	mutex   sync.Mutex
+	service *storage.Service
+}
+
+// Service returns the storage.Service which is created at the first call and reused after that.
+func (s *GcsOutputStore) Service(ctx context.Context) (*storage.Service, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.service != nil {
+		return s.service, nil
+	}
+
+	client, err := google.DefaultClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		log.Criticalf(ctx, "Failed to get google.DefaultClient for storage scope because of %v\n", err)
+		return nil, err
+	}
+
+	service, err := storage.New(client)
+	if err != nil {
+		log.Criticalf(ctx, "Failed to create storage.Service: %v\n", err)
+		return nil, err
+	}
+	s.service = service
+	return service, nil
+}
+
+func (s *GcsOutputStore) Write(ctx context.Context, name string, data []byte) error {
+	service, err := s.Service(ctx)
+	if err != nil {
+		return err
+	}
+	obj := &storage.Object{Name: s.Prefix + name, ContentType: "text/plain"}
+	_, err = service.Objects.Insert(s.Bucket, obj).Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		log.Errorf(ctx, "Failed to write gs://%s/%s%s because of %v\n", s.Bucket, s.Prefix, name, err)
+		return err
+	}
+	return nil
+}
+
+func (s *GcsOutputStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	service, err := s.Service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := service.Objects.Get(s.Bucket, s.Prefix+name).Context(ctx).Download()
+	if err != nil {
+		log.Errorf(ctx, "Failed to read gs://%s/%s%s because of %v\n", s.Bucket, s.Prefix, name, err)
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// LocalOutputStore stores the output chunks as files under Dir.
+type LocalOutputStore struct {
+	Dir string
+}
+
+func (s *LocalOutputStore) Write(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s *LocalOutputStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.FromSlash(name)))
+}
+
+// MemoryOutputStore keeps the output chunks in memory. It's for testing.
+type MemoryOutputStore struct {
+	mutex   sync.Mutex
+	Objects map[string][]byte
+}
+
+func (s *MemoryOutputStore) Write(ctx context.Context, name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Objects == nil {
+		s.Objects = map[string][]byte{}
+	}
+	b := make([]byte, len(data))
+	copy(b, data)
+	s.Objects[name] = b
+	return nil
+}
+
+func (s *MemoryOutputStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, ok := s.Objects[name]
+	if !ok {
+		return nil, fmt.Errorf("No such output object: %q", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// NewOutputStore returns the OutputStore for the URL.
+//
+//	gs://bucket/prefix/  GcsOutputStore
+//	file:///path/to/dir  LocalOutputStore
+//	memory:              MemoryOutputStore
+//
+// It returns nil for an empty string and the outputs are kept in Job.Output.
+func NewOutputStore(rawurl string) (OutputStore, error) {
+	if rawurl == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("No bucket given in %q", rawurl)
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &GcsOutputStore{Bucket: u.Host, Prefix: prefix}, nil
+	case "file":
+		return &LocalOutputStore{Dir: u.Path}, nil
+	case "memory":
+		return &MemoryOutputStore{}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported output store %q", rawurl)
+	}
+}
+
+func GetOutputStoreFromEnv() (OutputStore, error) {
+	return NewOutputStore(os.Getenv("OUTPUT_STORE_URL"))
+}
+
+// GlobalOutputStore is nil unless OUTPUT_STORE_URL is given.
+var GlobalOutputStore, globalOutputStoreErr = GetOutputStoreFromEnv()
+
+// CurrentOutputStore returns GlobalOutputStore and logs the error of OUTPUT_STORE_URL if it's invalid.
+// The outputs are kept in Job.Output in that case.
+func CurrentOutputStore(ctx context.Context) OutputStore {
+	if globalOutputStoreErr != nil {
+		log.Errorf(ctx, "Ignore OUTPUT_STORE_URL because of %v\n", globalOutputStoreErr)
+	}
+	return GlobalOutputStore
+}
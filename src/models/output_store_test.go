@@ -0,0 +1,112 @@
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestNewOutputStore(t *testing.T) {
+	store, err := NewOutputStore("")
+	assert.NoError(t, err)
+	assert.Nil(t, store)
+
+	store, err = NewOutputStore("gs://bucket1/path/to")
+	assert.NoError(t, err)
+	if gcs, ok := store.(*GcsOutputStore); assert.True(t, ok) {
+		assert.Equal(t, "bucket1", gcs.Bucket)
+		assert.Equal(t, "path/to/", gcs.Prefix)
+	}
+
+	store, err = NewOutputStore("file:///tmp/outputs")
+	assert.NoError(t, err)
+	if local, ok := store.(*LocalOutputStore); assert.True(t, ok) {
+		assert.Equal(t, "/tmp/outputs", local.Dir)
+	}
+
+	store, err = NewOutputStore("memory:")
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryOutputStore{}, store)
+
+	_, err = NewOutputStore("gs:///no-bucket")
+	assert.Error(t, err)
+	_, err = NewOutputStore("s3://bucket1")
+	assert.Error(t, err)
+}
+
+func TestJobAppendOutput(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	assert.NoError(t, err)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "output_store_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]OutputStore{
+		"memory": &MemoryOutputStore{},
+		"local":  &LocalOutputStore{Dir: dir},
+	}
+	jobID := func(id int64) string {
+		return datastore.NewKey(ctx, "Jobs", "", id, nil).Encode()
+	}
+	for i, name := range []string{"memory", "local"} {
+		store := stores[name]
+		job := &Job{ID: jobID(int64(i + 1))}
+		assert.NoError(t, job.AppendOutput(ctx, store, "msg-1", []byte("line1")), name)
+		assert.NoError(t, job.AppendOutput(ctx, store, "msg-2", []byte("line2")), name)
+		// The message delivered again
+		assert.NoError(t, job.AppendOutput(ctx, store, "msg-2", []byte("line2")), name)
+		assert.Equal(t, 2, job.OutputChunkCount, name)
+		assert.Equal(t, "\n\nline1\n\nline2", job.Output, name)
+
+		chunks, err := job.OutputChunks(ctx)
+		assert.NoError(t, err, name)
+		if assert.Equal(t, 2, len(chunks), name) {
+			assert.Equal(t, "jobs/"+job.ID+"/output/msg-1", chunks[0].Name, name)
+			assert.Equal(t, "jobs/"+job.ID+"/output/msg-2", chunks[1].Name, name)
+		}
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, job.WriteOutputTo(ctx, store, buf), name)
+		assert.Equal(t, "\n\nline1\n\nline2", buf.String(), name)
+	}
+
+	// Only the tail is kept in the entity
+	store := &MemoryOutputStore{}
+	job := &Job{ID: jobID(3)}
+	large := strings.Repeat("a", OutputInlineTailSize)
+	assert.NoError(t, job.AppendOutput(ctx, store, "msg-1", []byte(large)))
+	assert.NoError(t, job.AppendOutput(ctx, store, "msg-2", []byte("tail")))
+	assert.Equal(t, OutputInlineTailSize, len(job.Output))
+	assert.True(t, strings.HasSuffix(job.Output, "\n\ntail"))
+	buf := &bytes.Buffer{}
+	assert.NoError(t, job.WriteOutputTo(ctx, store, buf))
+	assert.Equal(t, "\n\n"+large+"\n\ntail", buf.String())
+
+	// The chunks can't be read without the store
+	assert.Error(t, job.WriteOutputTo(ctx, nil, &bytes.Buffer{}))
+
+	// Without store, the output is kept in the entity as before
+	job = &Job{ID: jobID(4)}
+	assert.NoError(t, job.AppendOutput(ctx, nil, "msg-1", []byte("line1")))
+	assert.Equal(t, 0, job.OutputChunkCount)
+	assert.Equal(t, "\n\nline1", job.Output)
+	buf = &bytes.Buffer{}
+	assert.NoError(t, job.WriteOutputTo(ctx, nil, buf))
+	assert.Equal(t, "\n\nline1", buf.String())
+}
+
+func TestJobCopyFromOutput(t *testing.T) {
+	src := &Job{Output: "line1\n", OutputChunkCount: 2}
+	job := &Job{}
+	job.CopyFrom(src)
+	assert.Equal(t, src.Output, job.Output)
+	assert.Equal(t, src.OutputChunkCount, job.OutputChunkCount)
+}
@@ -13,6 +13,7 @@ import (
 
 	pubsub "google.golang.org/api/pubsub/v1"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 
@@ -39,6 +40,7 @@ const (
 	Closing
 	ClosingError
 	Closed
+	Paused
 )
 
 var StatusStrings = map[Status]string{
@@ -58,6 +60,7 @@ var StatusStrings = map[Status]string{
 	Closing:               "closing",
 	ClosingError:          "closing_error",
 	Closed:                "closed",
+	Paused:                "paused", // Go Opened when the pipeline is resumed
 }
 
 func (st Status) String() string {
@@ -77,6 +80,7 @@ var (
 	StatusesAlreadyClosing         = Statuses{Closing, ClosingError, Closed}
 	StatusesHibernationInProgresss = Statuses{HibernationStarting, HibernationProcessing, HibernationError}
 	StatusesHibernating            = Statuses{Hibernating}
+	StatusesPaused                 = Statuses{Paused}
 )
 
 func (sts Statuses) Include(t Status) bool {
@@ -101,9 +105,15 @@ type (
 		Type  string `json:"type"`
 	}
 
+	// JobScaler is marshaled to JSON by jobScalerJSON to distinguish 0 given explicitly from the default.
 	JobScaler struct {
-		Enabled         bool `json:"enabled"`
-		MaxInstanceSize int  `json:"max_instance_size"`
+		Enabled         bool
+		MaxInstanceSize int
+		MinInstanceSize int `validate:"min=0"`
+		ScaleInCooldown int `validate:"min=0"` // seconds
+		// MinInstanceSizeGiven and ScaleInCooldownGiven are true when the values are given even if they're 0
+		MinInstanceSizeGiven bool
+		ScaleInCooldownGiven bool
 	}
 
 	Pulling struct {
@@ -113,37 +123,62 @@ type (
 	}
 
 	Pipeline struct {
-		ID                   string `json:"id"             datastore:"-"`
-		key                  *datastore.Key
-		Organization         *Organization  `json:"-"              validate:"required" datastore:"-"`
-		Name                 string         `json:"name"           validate:"required"`
-		ProjectID            string         `json:"project_id"     validate:"required"`
-		Zone                 string         `json:"zone"           validate:"required"`
-		BootDisk             PipelineVmDisk `json:"boot_disk"`
-		MachineType          string         `json:"machine_type"   validate:"required"`
-		GpuAccelerators      Accelerators   `json:"gpu_accelerators,omitempty"`
-		Preemptible          bool           `json:"preemptible,omitempty"`
-		StackdriverAgent     bool           `json:"stackdriver_agent,omitempty"`
-		TargetSize           int            `json:"target_size"    validate:"required"`
-		ContainerSize        int            `json:"container_size" validate:"required"`
-		ContainerName        string         `json:"container_name" validate:"required"`
-		Command              string         `json:"command"` // allow blank
-		DockerRunOptions     string         `json:"docker_run_options"`
-		Status               Status         `json:"status"`
-		Cancelled            bool           `json:"cancelled"`
-		Dryrun               bool           `json:"dryrun"`
-		DeploymentName       string         `json:"deployment_name"`
-		TokenConsumption     int            `json:"token_consumption"`
-		Dependency           Dependency     `json:"dependency,omitempty"`
-		ClosePolicy          ClosePolicy    `json:"close_policy,omitempty"`
-		HibernationDelay     int            `json:"hibernation_delay,omitempty"` // seconds
-		HibernationStartedAt time.Time      `json:"hibernation_started_at,omitempty"`
-		JobScaler            JobScaler      `json:"job_scaler,omitempty"`
-		Pulling              Pulling        `json:"pulling"`
-		PullingTaskSize      int            `json:"pulling_task_size"`
-		InstanceSize         int            `json:"-"`
-		CreatedAt            time.Time      `json:"created_at"`
-		UpdatedAt            time.Time      `json:"updated_at"`
+		ID                      string `json:"id"             datastore:"-"`
+		key                     *datastore.Key
+		Organization            *Organization       `json:"-"              validate:"required" datastore:"-"`
+		Name                    string              `json:"name"           validate:"required"`
+		ProjectID               string              `json:"project_id"     validate:"required"`
+		Zone                    string              `json:"zone,omitempty"` // required unless Region is given
+		Region                  string              `json:"region,omitempty"`
+		Zones                   []string            `json:"zones,omitempty"` // zones of Region to distribute the instances
+		BootDisk                PipelineVmDisk      `json:"boot_disk"`
+		AdditionalDisks         AdditionalDisks     `json:"additional_disks,omitempty"`
+		Network                 PipelineNetwork     `json:"network,omitempty"`
+		ServiceAccount          ServiceAccount      `json:"service_account,omitempty"`
+		Labels                  Labels              `json:"labels,omitempty"`
+		MachineType             string              `json:"machine_type"   validate:"required"`
+		GpuAccelerators         Accelerators        `json:"gpu_accelerators,omitempty"`
+		Preemptible             bool                `json:"preemptible,omitempty"`
+		StackdriverAgent        bool                `json:"stackdriver_agent,omitempty"`
+		TargetSize              int                 `json:"target_size"    validate:"required"`
+		ContainerSize           int                 `json:"container_size" validate:"required"`
+		ContainerName           string              `json:"container_name" validate:"required"`
+		Command                 string              `json:"command"` // allow blank
+		DockerRunOptions        string              `json:"docker_run_options"`
+		Status                  Status              `json:"status"`
+		Cancelled               bool                `json:"cancelled"`
+		Dryrun                  bool                `json:"dryrun"`
+		DeploymentName          string              `json:"deployment_name"`
+		TokenConsumption        int                 `json:"token_consumption"`
+		Dependency              Dependency          `json:"dependency,omitempty"`
+		ClosePolicy             ClosePolicy         `json:"close_policy,omitempty"`
+		HibernationDelay        int                 `json:"hibernation_delay,omitempty"` // seconds
+		HibernationStartedAt    time.Time           `json:"hibernation_started_at,omitempty"`
+		PausedAt                time.Time           `json:"paused_at,omitempty"`
+		JobScaler               JobScaler           `json:"job_scaler,omitempty"`
+		LastScaledAt            time.Time           `json:"last_scaled_at,omitempty"`
+		RetryPolicy             RetryPolicy         `json:"retry_policy,omitempty"`
+		MaxQueueSeconds         int                 `json:"max_queue_seconds,omitempty"     validate:"min=0"`
+		MaxExecutionSeconds     int                 `json:"max_execution_seconds,omitempty" validate:"min=0"`
+		Pulling                 Pulling             `json:"pulling"`
+		PullingTaskSize         int                 `json:"pulling_task_size"`
+		InstanceSize            int                 `json:"-"`
+		ActualInstanceSize      int                 `json:"actual_instance_size"`
+		InstanceSizeCheckedAt   time.Time           `json:"instance_size_checked_at,omitempty"`
+		InstanceSizeDriftPolicy string              `json:"instance_size_drift_policy,omitempty"`
+		TemplateVersion         int                 `json:"template_version"`
+		TemplateUpdatedAt       time.Time           `json:"template_updated_at,omitempty"`
+		RollingUpdate           RollingUpdatePolicy `json:"rolling_update,omitempty"`
+		Updating                bool                `json:"updating"`
+		UpdatingVersion         int                 `json:"updating_version,omitempty"` // TemplateVersion being deployed by update_task
+		UpdatingFingerprint     string              `json:"-" datastore:",noindex"`
+		PipelineTemplateID      string              `json:"pipeline_template_id,omitempty"`
+		PipelineTemplateVersion int                 `json:"pipeline_template_version,omitempty"`
+		ScheduleID              string              `json:"schedule_id,omitempty"`
+		BuildReposts            int                 `json:"build_reposts,omitempty"` // build_task posted again by Refresher
+		BuildRepostedAt         time.Time           `json:"build_reposted_at,omitempty"`
+		CreatedAt               time.Time           `json:"created_at"`
+		UpdatedAt               time.Time           `json:"updated_at"`
 	}
 )
 
@@ -158,6 +193,7 @@ var Ubuntu1604Regexp = regexp.MustCompile(`ubuntu.*1604`)
 
 func PipelineStructLevelValidation(sl validator.StructLevel) {
 	pl := sl.Current().Interface().(Pipeline)
+	validateLocation(sl, &pl)
 	bd := pl.BootDisk
 	if pl.GpuAccelerators.Count > 0 {
 		if !Ubuntu1604Regexp.MatchString(bd.SourceImage) {
@@ -170,7 +206,28 @@ func (m *Pipeline) Validate() error {
 	validator := validator.New()
 	validator.RegisterStructValidation(PipelineStructLevelValidation, Pipeline{})
 	err := validator.Struct(m)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := ValidateDriftPolicy(m.InstanceSizeDriftPolicy); err != nil {
+		return err
+	}
+	if err := m.Network.Validate(m.RegionName()); err != nil {
+		return err
+	}
+	if err := m.ServiceAccount.Validate(); err != nil {
+		return err
+	}
+	if err := m.AdditionalDisks.Validate(); err != nil {
+		return err
+	}
+	if err := m.Labels.Validate(); err != nil {
+		return err
+	}
+	if err := m.RollingUpdate.Validate(); err != nil {
+		return err
+	}
+	return m.RetryPolicy.Validate()
 }
 
 func (m *Pipeline) Create(ctx context.Context) error {
@@ -194,18 +251,28 @@ func (m *Pipeline) CreateWith(ctx context.Context, f func(ctx context.Context) e
 	if err != nil {
 		return err
 	}
+	// Check it only at creation not to block the running pipelines
+	// when the service account is removed from the organization.
+	if !m.ServiceAccount.Allowed(m.Organization) {
+		return &InvalidOperation{Msg: fmt.Sprintf("Service account %q isn't allowed for organization %q", m.ServiceAccount.Email, m.Organization.Name)}
+	}
+	// The labels of the organization are checked by Organization.ValidateLabelsOfPipelines when they're updated.
+	if err := m.ValidateMergedLabels(); err != nil {
+		return &InvalidOperation{Msg: err.Error()}
+	}
 
 	return f(ctx)
 }
 
 func (m *Pipeline) ReserveOrWait(ctx context.Context, f func(context.Context) error) error {
 	log.Debugf(ctx, "Start ReserveOrWait pipeline: %v", m)
-	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		dep := &m.Dependency
-		sat, err := dep.Satisfied(ctx)
-		if err != nil {
-			return err
-		}
+	// The jobs depended on don't belong to the entity group of the pipeline,
+	// so check them out of the transaction.
+	sat, err := m.Dependency.Satisfied(ctx)
+	if err != nil {
+		return err
+	}
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		if !sat {
 			m.Status = Pending
 		} else {
@@ -269,6 +336,15 @@ func (m *Pipeline) UpdateIfReserveOrWait(ctx context.Context) error {
 		if original == m.Status {
 			return nil
 		}
+		stored, err := GlobalPipelineAccessor.Find(ctx, m.ID)
+		if err != nil {
+			return err
+		}
+		if stored.Status != original {
+			return &InvalidStateTransition{
+				Msg: fmt.Sprintf("Pipeline %v has already been changed from %v to %v", m.ID, original, stored.Status),
+			}
+		}
 		return m.Update(ctx)
 	})
 	return err
@@ -362,9 +438,14 @@ func (m *Pipeline) StartBuilding(ctx context.Context) error {
 
 func (m *Pipeline) StartDeploying(ctx context.Context, deploymentName string) error {
 	m.DeploymentName = deploymentName
+	m.BuildReposts = 0
 	return m.StateTransition(ctx, []Status{Building}, Deploying)
 }
 
+func (m *Pipeline) FailBuilding(ctx context.Context) error {
+	return m.StateTransition(ctx, []Status{Building}, Broken)
+}
+
 func (m *Pipeline) FailDeploying(ctx context.Context) error {
 	return m.StateTransition(ctx, []Status{Deploying}, Broken)
 }
@@ -405,8 +486,20 @@ func (m *Pipeline) BackToBeReserved(ctx context.Context) error {
 	return m.StateTransition(ctx, []Status{Hibernating}, Reserved)
 }
 
+// Pause stops publishing jobs and suspends hibernation.
+// The jobs already published are still subscribed.
+func (m *Pipeline) Pause(ctx context.Context) error {
+	m.PausedAt = time.Now()
+	return m.StateTransition(ctx, StatusesOpened, Paused)
+}
+
+func (m *Pipeline) Resume(ctx context.Context) error {
+	m.PausedAt = time.Time{}
+	return m.StateTransition(ctx, StatusesPaused, Opened)
+}
+
 func (m *Pipeline) StartClosing(ctx context.Context) error {
-	return m.StateTransition(ctx, []Status{Opened, Closing}, Closing)
+	return m.StateTransition(ctx, []Status{Opened, Paused, Closing}, Closing)
 }
 
 func (m *Pipeline) FailClosing(ctx context.Context) error {
@@ -501,47 +594,375 @@ func (m *Pipeline) Reload(ctx context.Context) error {
 	return nil
 }
 
+// AcceptsReadyJobs returns true if Ready jobs can be added to the pipeline.
+func (m *Pipeline) AcceptsReadyJobs() bool {
+	return StatusesNotDeployedYet.Include(m.Status) ||
+		StatusesNowDeploying.Include(m.Status) ||
+		StatusesOpened.Include(m.Status) ||
+		StatusesPaused.Include(m.Status) ||
+		StatusesHibernationInProgresss.Include(m.Status) ||
+		StatusesHibernating.Include(m.Status)
+}
+
+const CreateJobsBatchSize = 500 // The limit of entities for datastore.PutMulti
+
+// CreateJobs puts the jobs with batched datastore.GetMulti and datastore.PutMulti.
+// A job whose IdByClient already exists isn't overwritten but loaded like Job#LoadOrCreate
+// in the transaction for every CreateJobsTransactionSize jobs.
+// The jobs aren't published here even if they are Ready, so call PublishJobs after this.
+// It returns the errors for each job.
+func (m *Pipeline) CreateJobs(ctx context.Context, jobs Jobs) []error {
+	errors := make([]error, len(jobs))
+	for start := 0; start < len(jobs); start += CreateJobsBatchSize {
+		end := start + CreateJobsBatchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+		m.createJobsBatch(ctx, jobs[start:end], errors[start:end])
+	}
+	return errors
+}
+
+func (m *Pipeline) createJobsBatch(ctx context.Context, jobs Jobs, errors []error) {
+	now := time.Now()
+
+	keys := make([]*datastore.Key, len(jobs))
+	firstIndexes := map[string]int{}
+	duplicates := map[int]int{}
+	namedKeys := []*datastore.Key{}
+	namedIndexes := []int{}
+	newIndexes := []int{} // The jobs with incomplete keys
+	for i, job := range jobs {
+		job.Pipeline = m
+		if job.Status == Ready && !m.AcceptsReadyJobs() {
+			errors[i] = &InvalidOperation{Msg: fmt.Sprintf("Can't create and publish a job to a pipeline which is %v", m.Status)}
+			continue
+		}
+		if err := job.ResolveDependency(ctx); err != nil {
+			errors[i] = err
+			continue
+		}
+		if err := job.PrepareToCreate(ctx, now); err != nil {
+			errors[i] = err
+			continue
+		}
+		key := job.Key(ctx, m.Name)
+		keys[i] = key
+		switch {
+		case key.Incomplete():
+			newIndexes = append(newIndexes, i)
+		default:
+			if first, ok := firstIndexes[key.StringID()]; ok {
+				duplicates[i] = first
+				continue
+			}
+			firstIndexes[key.StringID()] = i
+			namedKeys = append(namedKeys, key)
+			namedIndexes = append(namedIndexes, i)
+		}
+	}
+
+	// Load the jobs which already exist or create them in transactions
+	// so that a job created by another request at the same time isn't overwritten.
+	for start := 0; start < len(namedIndexes); start += CreateJobsTransactionSize {
+		end := start + CreateJobsTransactionSize
+		if end > len(namedIndexes) {
+			end = len(namedIndexes)
+		}
+		m.loadOrCreateJobs(ctx, jobs, namedKeys[start:end], namedIndexes[start:end], errors)
+	}
+
+	if len(newIndexes) > 0 {
+		newKeys := make([]*datastore.Key, len(newIndexes))
+		newJobs := make(Jobs, len(newIndexes))
+		for j, i := range newIndexes {
+			newKeys[j] = keys[i]
+			newJobs[j] = jobs[i]
+		}
+		resKeys, err := datastore.PutMulti(ctx, newKeys, newJobs)
+		// No job is put when PutMulti returns an error
+		multiErr, isMultiErr := err.(appengine.MultiError)
+		for j, i := range newIndexes {
+			switch {
+			case err == nil:
+				jobs[i].ID = resKeys[j].Encode()
+			case isMultiErr && multiErr[j] != nil:
+				errors[i] = multiErr[j]
+			default:
+				errors[i] = err
+			}
+		}
+	}
+
+	for i, first := range duplicates {
+		jobs[i].CopyFrom(jobs[first])
+		errors[i] = errors[first]
+	}
+}
+
+// The number of jobs loaded or created in a transaction.
+// Each job belongs to its own entity group and XG transactions can access up to 25 entity groups.
+const CreateJobsTransactionSize = 25
+
+// loadOrCreateJobs loads the jobs of keys at indexes of jobs if they exist
+// and puts the others in an XG transaction.
+func (m *Pipeline) loadOrCreateJobs(ctx context.Context, jobs Jobs, keys []*datastore.Key, indexes []int, errors []error) {
+	var jobErrors []error
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		jobErrors = make([]error, len(indexes))
+		found := make([]Job, len(keys))
+		err := datastore.GetMulti(ctx, keys, found)
+		multiErr, isMultiErr := err.(appengine.MultiError)
+		if err != nil && !isMultiErr {
+			return err
+		}
+		newKeys := []*datastore.Key{}
+		newJobs := Jobs{}
+		for j, i := range indexes {
+			var jobErr error
+			if isMultiErr {
+				jobErr = multiErr[j]
+			}
+			switch jobErr {
+			case nil:
+				jobs[i].CopyFrom(&found[j])
+				jobs[i].Pipeline = m
+				msg := &jobs[i].Message
+				msg.EntriesToMap()
+			case datastore.ErrNoSuchEntity:
+				newKeys = append(newKeys, keys[j])
+				newJobs = append(newJobs, jobs[i])
+			default:
+				log.Errorf(ctx, "Failed at GetMulti %v id: %q\n", jobErr, keys[j].Encode())
+				jobErrors[j] = jobErr
+			}
+		}
+		if len(newKeys) == 0 {
+			return nil
+		}
+		_, err = datastore.PutMulti(ctx, newKeys, newJobs)
+		return err
+	}, GetTransactionOptionsWithXG())
+
+	for j, i := range indexes {
+		switch {
+		case err != nil:
+			log.Errorf(ctx, "Failed to create job %q because of %v\n", keys[j].Encode(), err)
+			errors[i] = err
+		case jobErrors[j] != nil:
+			errors[i] = jobErrors[j]
+		default:
+			jobs[i].ID = keys[j].Encode()
+		}
+	}
+}
+
+// The number of jobs claimed and recorded in a transaction.
+// Each job belongs to its own entity group and XG transactions can access up to 25 entity groups.
+const PublishJobsBatchSize = 25
+
+// PublishJobs publishes the Ready jobs of the pipeline.
+// The jobs waiting for the retry backoff are skipped. They are published by their own wait_task at RetryAt.
 func (m *Pipeline) PublishJobs(ctx context.Context) error {
 	accessor := m.JobAccessor()
-	jobs, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
-		return q.Project("status"), nil
+	now := time.Now()
+	readies, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+		return q.Filter("status =", int(Ready)), nil
 	})
 	if err != nil {
 		log.Errorf(ctx, "Failed to get jobs for %v because of %v\n", m.ID, err)
 		return err
 	}
+	jobs := Jobs{}
+	for _, job := range readies {
+		if !job.RetryAt.After(now) {
+			jobs = append(jobs, job)
+		}
+	}
+	jobs.SortByPriority()
+
+	// Claim the jobs in XG transactions and publish them up to the limit of messages per publish.
+	// The publisher splits them into the requests within the limits of Pub/Sub.
+	targets := Jobs{}
+	for start := 0; start < len(jobs); start += PublishJobsBatchSize {
+		end := start + PublishJobsBatchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+		jobIds := jobs[start:end].IDs()
+		claimed, err := m.claimJobsToPublish(ctx, jobIds, now)
+		if err != nil {
+			log.Errorf(ctx, "Failed to claim jobs %v to publish because of %v\n", jobIds, err)
+			return err
+		}
+		targets = append(targets, claimed...)
+		if len(targets)+PublishJobsBatchSize > PubsubMaxMessagesPerPublish {
+			if err := m.publishClaimedJobs(ctx, targets); err != nil {
+				return err
+			}
+			targets = Jobs{}
+		}
+	}
+	if len(targets) > 0 {
+		return m.publishClaimedJobs(ctx, targets)
+	}
+	return nil
+}
+
+// publishClaimedJobs publishes the Publishing jobs and records their message IDs.
+// Publish outside of the transaction not to publish the jobs again when it's retried.
+// If the request dies before recording them, the Refresher gets them back to Ready
+// after PublishingTimeout.
+func (m *Pipeline) publishClaimedJobs(ctx context.Context, targets Jobs) error {
+	msgs := []*pubsub.PubsubMessage{}
+	for _, job := range targets {
+		msgs = append(msgs, job.JobMessage())
+	}
+	msgIds, publishErr := GlobalPublisher.Publish(ctx, m.JobTopicFqn(), msgs)
+	if publishErr != nil {
+		// Save the message IDs of the jobs published before the error
+		log.Warningf(ctx, "Failed to publish %d jobs of %d because of %v\n", len(msgs)-len(msgIds), len(msgs), publishErr)
+	}
+
+	for start := 0; start < len(targets); start += PublishJobsBatchSize {
+		end := start + PublishJobsBatchSize
+		if end > len(targets) {
+			end = len(targets)
+		}
+		var chunkIds []string
+		if start < len(msgIds) {
+			idEnd := end
+			if idEnd > len(msgIds) {
+				idEnd = len(msgIds)
+			}
+			chunkIds = msgIds[start:idEnd]
+		}
+		err := m.recordPublishedJobs(ctx, targets[start:end], chunkIds)
+		if err != nil {
+			log.Errorf(ctx, "Failed to record the message IDs of jobs %v because of %v\n", targets[start:end].IDs(), err)
+			return err
+		}
+	}
+	return publishErr
+}
+
+// claimJobsToPublish makes the Ready jobs of jobIds Publishing in a transaction
+// so that the other requests don't publish them too. It returns the claimed jobs.
+func (m *Pipeline) claimJobsToPublish(ctx context.Context, jobIds []string, now time.Time) (Jobs, error) {
+	accessor := m.JobAccessor()
+	var targets Jobs
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		targets = Jobs{}
+		for _, jobId := range jobIds {
+			job, err := accessor.Find(ctx, jobId)
+			if err != nil {
+				log.Warningf(ctx, "Failed to get job %v because of %v\n", jobId, err)
+				return err
+			}
+			if job.Status != Ready || job.MessageID != "" || job.RetryAt.After(now) {
+				continue
+			}
+			job.Pipeline = m
+			job.Status = Publishing
+			if err := job.Update(ctx); err != nil {
+				log.Errorf(ctx, "Failed to update job %v because of %v\n", job.ID, err)
+				return err
+			}
+			targets = append(targets, job)
+		}
+		return nil
+	}, GetTransactionOptionsWithXG())
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// recordPublishedJobs saves msgIds to the Publishing jobs in a transaction.
+// The jobs after msgIds weren't published, so they get back to Ready.
+func (m *Pipeline) recordPublishedJobs(ctx context.Context, targets Jobs, msgIds []string) error {
+	accessor := m.JobAccessor()
+	now := time.Now()
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		for i, target := range targets {
+			job, err := accessor.Find(ctx, target.ID)
+			if err != nil {
+				log.Warningf(ctx, "Failed to get job %v because of %v\n", target.ID, err)
+				return err
+			}
+			if job.Status != Publishing {
+				log.Warningf(ctx, "Job %v is already %v\n", job.ID, job.Status)
+				continue
+			}
+			job.Pipeline = m
+			if i < len(msgIds) {
+				job.MessageID = msgIds[i]
+				job.PublishedAt = now
+				job.Status = Published
+			} else {
+				job.Status = Ready
+			}
+			if err := job.Update(ctx); err != nil {
+				log.Errorf(ctx, "Failed to update job %v because of %v\n", job.ID, err)
+				return err
+			}
+		}
+		return nil
+	}, GetTransactionOptionsWithXG())
+}
 
-	for _, j := range jobs {
-		switch j.Status {
-		case Preparing:
-			log.Debugf(ctx, "The job isn't published because it's preparing now: %v\n", j)
-		case Ready:
-			jobId := j.ID
-			err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+// RecoverPublishingJobs gets the jobs Publishing since before back to Ready and returns the number of them.
+// They are left Publishing when the request dies between claiming the jobs and recording their message IDs.
+// A job published just before the request died is published again, so the worker may run it twice.
+func (m *Pipeline) RecoverPublishingJobs(ctx context.Context, before time.Time) (int, error) {
+	accessor := m.JobAccessor()
+	publishings, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+		return q.Filter("status =", int(Publishing)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	jobIds := []string{}
+	for _, job := range publishings {
+		if job.UpdatedAt.Before(before) {
+			jobIds = append(jobIds, job.ID)
+		}
+	}
+
+	recovered := 0
+	for start := 0; start < len(jobIds); start += PublishJobsBatchSize {
+		end := start + PublishJobsBatchSize
+		if end > len(jobIds) {
+			end = len(jobIds)
+		}
+		count := 0
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			count = 0
+			for _, jobId := range jobIds[start:end] {
 				job, err := accessor.Find(ctx, jobId)
 				if err != nil {
 					log.Warningf(ctx, "Failed to get job %v because of %v\n", jobId, err)
 					return err
 				}
-				if job.Status != Ready {
-					return nil
+				if job.Status != Publishing || job.MessageID != "" || !job.UpdatedAt.Before(before) {
+					continue
 				}
 				job.Pipeline = m
-				_, err = job.Publish(ctx)
-				if err != nil {
-					log.Warningf(ctx, "Failed to publish job %v because of %v\n", job, err)
+				job.Status = Ready
+				if err := job.Update(ctx); err != nil {
+					log.Errorf(ctx, "Failed to update job %v because of %v\n", job.ID, err)
 					return err
 				}
-				return nil
-			}, nil)
-			if err != nil {
-				log.Errorf(ctx, "Failed to Publish job %v because of %v\n", jobId, err)
-				return err
+				count++
 			}
+			return nil
+		}, GetTransactionOptionsWithXG())
+		if err != nil {
+			return recovered, err
 		}
+		recovered += count
 	}
-
-	return nil
+	return recovered, nil
 }
 
 func (m *Pipeline) JobTopicName() string {
@@ -552,6 +973,20 @@ func (m *Pipeline) JobTopicFqn() string {
 	return fmt.Sprintf("projects/%s/topics/%s", m.ProjectID, m.JobTopicName())
 }
 
+func (m *Pipeline) ControlTopicName() string {
+	return fmt.Sprintf("%s-control-topic", m.Name)
+}
+
+func (m *Pipeline) ControlTopicFqn() string {
+	return fmt.Sprintf("projects/%s/topics/%s", m.ProjectID, m.ControlTopicName())
+}
+
+// ControlSubscriptionFqn returns the name of the control subscription of the worker container.
+// suffix identifies the container like "$(hostname)-$i" in the startup script.
+func (m *Pipeline) ControlSubscriptionFqn(suffix string) string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s-control-%s", m.ProjectID, m.Name, suffix)
+}
+
 func (m *Pipeline) ProgressSubscriptionName() string {
 	return fmt.Sprintf("%s-progress-subscription", m.Name)
 }
@@ -581,14 +1016,16 @@ func (em ErrorMessages) Error() error {
 	return nil
 }
 
-func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context) error {
+// PullAndUpdateJobStatus applies the progress messages to the jobs.
+// It returns the jobs which ended by the messages in this call.
+func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context, retryHandler func(*Job) error) (Jobs, error) {
 	log.Infof(ctx, "PullAndUpdateJobStatus start\n")
 	defer log.Infof(ctx, "PullAndUpdateJobStatus end\n")
 
 	s := &PubsubSubscriber{MessagePerPull: Int64WithDefault(m.Pulling.MessagePerPull, 100)}
 	err := s.setup(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// log.Debugf(ctx, "PullAndUpdateJobStatus #1\n")
@@ -608,7 +1045,7 @@ func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// log.Debugf(ctx, "PullAndUpdateJobStatus #2\n")
@@ -624,8 +1061,11 @@ func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context) error {
 		Attempts: GetTransactionAttemptsFromEnvWithName("SUBSCRIBE_TRANSACTION_ATTEMPTS"),
 	}
 	errors := ErrorMessages{}
+	ended := Jobs{}
 	for jobId, recvMsgs := range messagesForJob {
+		var endedJob *Job
 		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			endedJob = nil
 			// log.Debugf(ctx, "PullAndUpdateJobStatus #4.1\n")
 			job, err := accessor.Find(ctx, jobId)
 			if err != nil {
@@ -635,24 +1075,39 @@ func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context) error {
 
 			// To reduce DB access on Update
 			job.Pipeline = m
+			wasEnded := job.Status.Ended()
 
 			if err := m.OverwriteJobByMessages(ctx, job, recvMsgs); err != nil {
 				return err
 			}
 			// log.Debugf(ctx, "PullAndUpdateJobStatus #4.3\n")
 
+			retrying := job.PrepareRetryIfPossible(ctx)
+
 			if err := job.Update(ctx); err != nil {
 				return err
 			}
+			if !wasEnded && job.Status.Ended() {
+				endedJob = job
+			}
+
+			if retrying && retryHandler != nil {
+				if err := retryHandler(job); err != nil {
+					return err
+				}
+			}
 			// log.Debugf(ctx, "PullAndUpdateJobStatus #4.4\n")
 			return nil
 		}, txOpts)
 		if err != nil {
 			if err == datastore.ErrConcurrentTransaction {
-				return err
+				return nil, err
 			}
 			errors = append(errors, err.Error())
 		}
+		if endedJob != nil {
+			ended = append(ended, endedJob)
+		}
 		// log.Debugf(ctx, "PullAndUpdateJobStatus #4.5\n")
 		for _, recvMsg := range recvMsgs {
 			err := s.sendAck(ctx, subscription, recvMsg)
@@ -663,7 +1118,7 @@ func (m *Pipeline) PullAndUpdateJobStatus(ctx context.Context) error {
 		}
 	}
 
-	return errors.Error()
+	return ended, errors.Error()
 }
 
 func (m *Pipeline) OverwriteJobByMessages(ctx context.Context, job *Job, recvMsgs []*pubsub.ReceivedMessage) error {
@@ -678,19 +1133,27 @@ func (m *Pipeline) OverwriteJobByMessages(ctx context.Context, job *Job, recvMsg
 }
 
 func (m *Pipeline) OverwriteJob(ctx context.Context, job *Job, recvMsg *pubsub.ReceivedMessage) error {
+	attrs := recvMsg.Message.Attributes
+	if !job.IsProgressOfCurrentAttempt(attrs, recvMsg.Message.PublishTime) {
+		log.Infof(ctx, "Ignore the progress of an earlier attempt of job %v: %v\n", job.ID, attrs)
+		return nil
+	}
+
 	if len(recvMsg.Message.Data) > 0 {
 		b, err := base64.StdEncoding.DecodeString(recvMsg.Message.Data)
 		if err != nil {
 			return err
 		}
-		job.Output += "\n\n" + string(b)
+		err = job.AppendOutput(ctx, CurrentOutputStore(ctx), recvMsg.Message.MessageId, b)
+		if err != nil {
+			return err
+		}
 	}
 
 	if job.Status == Success {
 		return nil
 	}
 
-	attrs := recvMsg.Message.Attributes
 	completed, err := strconv.ParseBool(attrs["completed"])
 	if err != nil {
 		return err
@@ -707,6 +1170,12 @@ func (m *Pipeline) OverwriteJob(ctx context.Context, job *Job, recvMsg *pubsub.R
 	if err != nil {
 		return err
 	}
+	event := NewJobEvent(job, recvMsg.Message, completed, step, stepStatus)
+	err = event.Create(ctx)
+	if err != nil {
+		return err
+	}
+
 	job.Hostname = m.stringFromMapWithDefault(attrs, "host", "unknown")
 	job.Zone = m.stringFromMapWithDefault(attrs, "zone", "unknown")
 	job.StartTime = m.stringFromMapWithDefault(attrs, "job.start-time", "")
@@ -714,10 +1183,208 @@ func (m *Pipeline) OverwriteJob(ctx context.Context, job *Job, recvMsg *pubsub.R
 
 	// log.Debugf(ctx, "PullAndUpdateJobStatus len(recvMsg.Message.Data): %v\n", len(recvMsg.Message.Data))
 
-	job.ApplyStatusIfGreaterThanBefore(ctx, completed, step, stepStatus)
+	if job.ApplyStatusIfGreaterThanBefore(ctx, completed, step, stepStatus) && job.Status == Failure {
+		job.CaptureFailureReason(step)
+	}
 	return nil
 }
 
+// PromoteDependentJobs applies the dependency to the Preparing jobs which depend on the ended jobs.
+// The jobs cancelled by their dependency are followed in the same way.
+// It returns the jobs which become Ready and the ones which become Cancelled.
+func (m *Pipeline) PromoteDependentJobs(ctx context.Context, ended Jobs) (Jobs, Jobs, error) {
+	accessor := m.JobAccessor()
+	promoted := Jobs{}
+	cancelled := Jobs{}
+	applied := map[string]bool{}
+	queue := ended.IDs()
+	for len(queue) > 0 {
+		endedId := queue[0]
+		queue = queue[1:]
+		dependents, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+			return q.Filter("status =", int(Preparing)).Filter("depends_on.JobIDs =", endedId), nil
+		})
+		if err != nil {
+			log.Errorf(ctx, "Failed to get jobs depending on %v because of %v\n", endedId, err)
+			return nil, nil, err
+		}
+
+		for _, dependent := range dependents {
+			if applied[dependent.ID] {
+				continue
+			}
+			// The jobs depended on are checked out of the transaction because
+			// they belong to their own entity groups and the finished jobs don't go back.
+			finished, satisfied, err := dependent.DependsOn.Check(ctx)
+			if err != nil {
+				log.Errorf(ctx, "Failed to check dependency of job %v because of %v\n", dependent.ID, err)
+				return nil, nil, err
+			}
+			if !finished {
+				continue
+			}
+			job, err := m.applyDependencyTo(ctx, dependent.ID, finished, satisfied)
+			if err != nil {
+				log.Errorf(ctx, "Failed to apply dependency to job %v because of %v\n", dependent.ID, err)
+				return nil, nil, err
+			}
+			applied[dependent.ID] = true
+			switch {
+			case job == nil:
+			case job.Status == Ready:
+				promoted = append(promoted, job)
+			case job.Status == Cancelled:
+				cancelled = append(cancelled, job)
+				queue = append(queue, job.ID)
+			}
+		}
+	}
+	return promoted, cancelled, nil
+}
+
+// applyDependencyTo updates the status of the Preparing job by the result of the dependency check.
+// It returns nil if the job isn't Preparing any more.
+func (m *Pipeline) applyDependencyTo(ctx context.Context, jobId string, finished, satisfied bool) (*Job, error) {
+	var applied *Job
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		applied = nil
+		job, err := m.JobAccessor().Find(ctx, jobId)
+		if err != nil {
+			return err
+		}
+		if job.Status != Preparing {
+			return nil
+		}
+		job.Pipeline = m
+		job.SetStatusByDependency(finished, satisfied)
+		log.Infof(ctx, "Job %v is %v by dependency %v\n", job.ID, job.Status, job.DependsOn)
+		if err := job.Update(ctx); err != nil {
+			return err
+		}
+		applied = job
+		return nil
+	}, GetTransactionOptions())
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// HasJobDeadline returns true when stuck jobs should be checked.
+func (m *Pipeline) HasJobDeadline() bool {
+	return m.MaxQueueSeconds > 0 || m.MaxExecutionSeconds > 0
+}
+
+// StuckReason returns the reason why the job is regarded as stuck at now.
+// It returns blank if the job isn't stuck.
+// Published jobs are judged by PublishedAt and Executing jobs are judged by
+// UpdatedAt which is updated whenever a progress message arrives.
+func (m *Pipeline) StuckReason(job *Job, now time.Time) string {
+	switch job.Status {
+	case Published:
+		if m.MaxQueueSeconds > 0 && !job.PublishedAt.IsZero() &&
+			now.Sub(job.PublishedAt) > time.Duration(m.MaxQueueSeconds)*time.Second {
+			return fmt.Sprintf("Not started in %d seconds since published at %v", m.MaxQueueSeconds, job.PublishedAt.Format(time.RFC3339))
+		}
+	case Executing:
+		if m.MaxExecutionSeconds > 0 &&
+			now.Sub(job.UpdatedAt) > time.Duration(m.MaxExecutionSeconds)*time.Second {
+			return fmt.Sprintf("No progress in %d seconds since %v on %v", m.MaxExecutionSeconds, job.UpdatedAt.Format(time.RFC3339), job.Hostname)
+		}
+	}
+	return ""
+}
+
+func (m *Pipeline) StuckJobs(ctx context.Context, now time.Time) (Jobs, error) {
+	accessor := m.JobAccessor()
+	res := Jobs{}
+	for _, st := range []JobStatus{Published, Executing} {
+		jobs, err := accessor.AllWith(ctx, func(q *datastore.Query) (*datastore.Query, error) {
+			return q.Filter("status =", int(st)), nil
+		})
+		if err != nil {
+			log.Errorf(ctx, "Failed to get %v jobs for %v because of %v\n", st, m.ID, err)
+			return nil, err
+		}
+		for _, job := range jobs {
+			if m.StuckReason(job, now) != "" {
+				res = append(res, job)
+			}
+		}
+	}
+	return res, nil
+}
+
+// FailStuckJobs makes the stuck jobs Failure with the reason.
+// The jobs are published again if their RetryPolicy allows and
+// retryHandler is called for them in the transaction.
+// The message of the stuck attempt may be still held by a worker, so the cancel
+// command for the attempt is published not to run the job twice. The worker which
+// pulls the message after the command can still run it, but its progress is ignored
+// because it belongs to the earlier attempt.
+func (m *Pipeline) FailStuckJobs(ctx context.Context, now time.Time, retryHandler func(*Job) error) (Jobs, error) {
+	stucks, err := m.StuckJobs(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	accessor := m.JobAccessor()
+	res := Jobs{}
+	for _, stuck := range stucks {
+		jobId := stuck.ID
+		var failed *Job
+		var cancelMsg *pubsub.PubsubMessage
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			failed = nil
+			job, err := accessor.Find(ctx, jobId)
+			if err != nil {
+				return err
+			}
+			job.Pipeline = m
+
+			reason := m.StuckReason(job, now)
+			if reason == "" {
+				return nil
+			}
+			log.Warningf(ctx, "Job %v is stuck: %v\n", job.ID, reason)
+			cancelMsg = job.CancelCommandMessage()
+			job.Status = Failure
+			if job.CancelRequested {
+				// The worker didn't report the cancellation in time
+				job.Status = Cancelled
+			}
+			job.FailureReason = reason
+
+			retrying := job.PrepareRetryIfPossible(ctx)
+
+			if err := job.Update(ctx); err != nil {
+				return err
+			}
+			failed = job
+
+			if retrying && retryHandler != nil {
+				if err := retryHandler(job); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			log.Errorf(ctx, "Failed to fail stuck job %v because of %v\n", jobId, err)
+			return nil, err
+		}
+		if failed != nil {
+			res = append(res, failed)
+			// Publish out of the transaction not to publish it again when the transaction is retried
+			topic := m.ControlTopicFqn()
+			if _, err := GlobalPublisher.Publish(ctx, topic, []*pubsub.PubsubMessage{cancelMsg}); err != nil {
+				log.Warningf(ctx, "Failed to publish cancel command of the stuck attempt of job %v to %v because of %v\n", failed.ID, topic, err)
+			}
+		}
+	}
+	return res, nil
+}
+
 func (m *Pipeline) stringFromMapWithDefault(src map[string]string, key, defaultValue string) string {
 	r, ok := src[key]
 	if !ok {
@@ -813,7 +1480,34 @@ func (m *Pipeline) HasNewTaskSince(ctx context.Context, t time.Time) (bool, erro
 }
 
 func (m *Pipeline) CanScale() bool {
-	return m.JobScaler.Enabled && (m.InstanceSize < m.JobScaler.MaxInstanceSize)
+	return m.JobScaler.Enabled && (m.CanScaleOut() || m.CanScaleIn())
+}
+
+func (m *Pipeline) CanScaleOut() bool {
+	return m.InstanceSize < m.JobScaler.MaxInstanceSize
+}
+
+func (m *Pipeline) CanScaleIn() bool {
+	return m.InstanceSize > m.MinInstanceSize()
+}
+
+// MinInstanceSize returns TargetSize when JobScaler.MinInstanceSize isn't given
+// so that the pipeline doesn't shrink below the size it was deployed with.
+func (m *Pipeline) MinInstanceSize() int {
+	if m.JobScaler.MinInstanceSizeGiven {
+		return m.JobScaler.MinInstanceSize
+	}
+	return IntWithDefault(m.JobScaler.MinInstanceSize, m.TargetSize)
+}
+
+const DefaultScaleInCooldown = 300 // seconds
+
+func (m *Pipeline) ScaleInCooldownPassed(now time.Time) bool {
+	cooldown := IntWithDefault(m.JobScaler.ScaleInCooldown, DefaultScaleInCooldown)
+	if m.JobScaler.ScaleInCooldownGiven {
+		cooldown = m.JobScaler.ScaleInCooldown
+	}
+	return now.After(m.LastScaledAt.Add(time.Duration(cooldown) * time.Second))
 }
 
 func (m *Pipeline) LogInstanceSizeWithError(ctx context.Context, endTime string, size int) error {
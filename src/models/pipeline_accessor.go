@@ -96,12 +96,25 @@ func (pa *PipelineAccessor) GetByStatus(ctx context.Context, st Status) ([]*Pipe
 }
 
 func (pa *PipelineAccessor) GetByQuery(ctx context.Context, q *datastore.Query) ([]*Pipeline, error) {
+	var res = []*Pipeline{}
+	_, err := pa.EachByQuery(ctx, q, func(pl *Pipeline) bool {
+		res = append(res, pl)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// EachByQuery calls f with each pipeline until f returns false.
+// It returns the iterator to get the cursor after the last pipeline.
+func (pa *PipelineAccessor) EachByQuery(ctx context.Context, q *datastore.Query, f func(*Pipeline) bool) (*datastore.Iterator, error) {
 	q, err := pa.considerParent(q)
 	if err != nil {
 		return nil, err
 	}
 	iter := q.Run(ctx)
-	var res = []*Pipeline{}
 	for {
 		pl := Pipeline{}
 		key, err := iter.Next(&pl)
@@ -113,9 +126,11 @@ func (pa *PipelineAccessor) GetByQuery(ctx context.Context, q *datastore.Query)
 		}
 		pl.key = key
 		pl.ID = key.Encode()
-		res = append(res, &pl)
+		if !f(&pl) {
+			break
+		}
 	}
-	return res, nil
+	return iter, nil
 }
 
 func (pa *PipelineAccessor) WaitingQuery() (*datastore.Query, error) {
@@ -168,36 +183,42 @@ type Subscription struct {
 
 func (pa *PipelineAccessor) GetActiveSubscriptions(ctx context.Context) ([]*Subscription, error) {
 	r := []*Subscription{}
-	pipelines, err := pa.GetByStatus(ctx, Opened)
-	if err != nil {
-		return nil, err
-	}
-	for _, pipeline := range pipelines {
-		r = append(r, &Subscription{
-			PipelineID: pipeline.ID,
-			Pipeline:   pipeline.Name,
-			Name:       fmt.Sprintf("projects/%v/subscriptions/%v-progress-subscription", pipeline.ProjectID, pipeline.Name),
-		})
+	// Paused pipelines are still subscribed for the jobs published before paused
+	for _, st := range []Status{Opened, Paused} {
+		pipelines, err := pa.GetByStatus(ctx, st)
+		if err != nil {
+			return nil, err
+		}
+		for _, pipeline := range pipelines {
+			r = append(r, &Subscription{
+				PipelineID: pipeline.ID,
+				Pipeline:   pipeline.Name,
+				Name:       fmt.Sprintf("projects/%v/subscriptions/%v-progress-subscription", pipeline.ProjectID, pipeline.Name),
+			})
+		}
 	}
 	return r, nil
 }
 
+// PendingsFor returns the Pending pipelines which depend on any of the jobs.
+// They are queried for each job by the built-in index of Dependency.JobIDs
+// and filtered by the status not to need a composite index.
 func (pa *PipelineAccessor) PendingsFor(ctx context.Context, jobIDs []string) ([]*Pipeline, error) {
-	pipelines := map[string]*Pipeline{}
+	result := []*Pipeline{}
+	found := map[string]bool{}
 	for _, jobID := range jobIDs {
-		q := datastore.NewQuery("Pipelines").Filter("Status =", Pending).Filter("Dependency.JobIDs =", jobID)
-		r, err := pa.GetByQuery(ctx, q)
+		q := datastore.NewQuery("Pipelines").Filter("Dependency.JobIDs =", jobID)
+		pipelines, err := pa.GetByQuery(ctx, q)
 		if err != nil {
 			return nil, err
 		}
-		for _, pl := range r {
-			pipelines[pl.ID] = pl
+		for _, pl := range pipelines {
+			if pl.Status != Pending || found[pl.ID] {
+				continue
+			}
+			found[pl.ID] = true
+			result = append(result, pl)
 		}
 	}
-
-	result := []*Pipeline{}
-	for _, pl := range pipelines {
-		result = append(result, pl)
-	}
 	return result, nil
 }
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// InstanceRedistributionNone stops a regional managed instance group from deleting
+// the instances to rebalance them across the zones.
+const InstanceRedistributionNone = "NONE"
+
+var (
+	RegionRegexp = regexp.MustCompile(`\A[a-z]+-[a-z]+[0-9]+\z`)
+	ZoneRegexp   = regexp.MustCompile(`\A[a-z]+-[a-z]+[0-9]+-[a-z]\z`)
+)
+
+// RegionOf returns the region of zone. e.g. "us-central1" for "us-central1-f"
+func RegionOf(zone string) string {
+	i := strings.LastIndex(zone, "-")
+	if i < 0 {
+		return zone
+	}
+	return zone[:i]
+}
+
+// IsRegion returns true if location is a region like "us-central1" but not a zone like "us-central1-f".
+func IsRegion(location string) bool {
+	return RegionRegexp.MatchString(location)
+}
+
+// Regional returns true if the instances are distributed over the zones of Region
+// by a regional managed instance group.
+func (m *Pipeline) Regional() bool {
+	return m.Region != ""
+}
+
+// Location returns Region for a regional pipeline or Zone for a zonal one.
+func (m *Pipeline) Location() string {
+	if m.Regional() {
+		return m.Region
+	}
+	return m.Zone
+}
+
+// RegionName returns the region where the instances run.
+func (m *Pipeline) RegionName() string {
+	if m.Regional() {
+		return m.Region
+	}
+	return RegionOf(m.Zone)
+}
+
+func (m *Pipeline) ZoneURLs() []string {
+	r := []string{}
+	for _, zone := range m.Zones {
+		r = append(r, ComputeAPIBaseURL+"projects/"+m.ProjectID+"/zones/"+zone)
+	}
+	return r
+}
+
+// validateLocation requires either Zone or Region.
+// Zones are available only with Region and they must be in Region.
+func validateLocation(sl validator.StructLevel, pl *Pipeline) {
+	switch {
+	case pl.Zone == "" && pl.Region == "":
+		sl.ReportError(pl.Zone, "Zone", "zone", "required", "")
+	case pl.Zone != "" && pl.Region != "":
+		sl.ReportError(pl.Zone, "Zone", "zone", "excluded_with", "Region")
+	case pl.Region != "" && !IsRegion(pl.Region):
+		sl.ReportError(pl.Region, "Region", "region", "region", "")
+	}
+	for _, zone := range pl.Zones {
+		if pl.Region == "" || !ZoneRegexp.MatchString(zone) || RegionOf(zone) != pl.Region {
+			sl.ReportError(pl.Zones, "Zones", "zones", "zones", zone)
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ComputeAPIBaseURL  = "https://www.googleapis.com/compute/v1/"
+	DefaultNetworkName = "default"
+	MaxNetworkTags     = 64
+)
+
+var (
+	NetworkNameRegexp    = regexp.MustCompile(`\A[a-z]([-a-z0-9]{0,61}[a-z0-9])?\z`)
+	NetworkURLRegexp     = regexp.MustCompile(`\A(https://www\.googleapis\.com/compute/v1/)?projects/[^/]+/global/networks/[^/]+\z`)
+	SubnetworkURLRegexp  = regexp.MustCompile(`\A(https://www\.googleapis\.com/compute/v1/)?projects/[^/]+/regions/([^/]+)/subnetworks/[^/]+\z`)
+	NetworkTagNameRegexp = NetworkNameRegexp
+)
+
+// PipelineNetwork is the network configuration of the instances of the pipeline.
+// The instances are attached to the default network of the project with
+// an external IP when nothing is given.
+//
+// Set ExternalIP false to run the instances without any external IP.
+// They need Cloud NAT or Private Google Access to pull the container image
+// and to access Pub/Sub in that case.
+type PipelineNetwork struct {
+	Network       string   `json:"network,omitempty"`         // Name or URL
+	Subnetwork    string   `json:"subnetwork,omitempty"`      // Name or URL
+	HostProjectID string   `json:"host_project_id,omitempty"` // Shared VPC host project of the network and the subnetwork
+	Tags          []string `json:"tags,omitempty"`
+	NoExternalIP  bool     `json:"-"`
+}
+
+// pipelineNetworkJSON is the JSON representation of PipelineNetwork.
+// external_ip is true unless it's given as false explicitly.
+type pipelineNetworkJSON struct {
+	Network       string   `json:"network,omitempty"`
+	Subnetwork    string   `json:"subnetwork,omitempty"`
+	HostProjectID string   `json:"host_project_id,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	ExternalIP    *bool    `json:"external_ip,omitempty"`
+}
+
+func (n PipelineNetwork) toJSON() *pipelineNetworkJSON {
+	externalIP := !n.NoExternalIP
+	return &pipelineNetworkJSON{
+		Network:       n.Network,
+		Subnetwork:    n.Subnetwork,
+		HostProjectID: n.HostProjectID,
+		Tags:          n.Tags,
+		ExternalIP:    &externalIP,
+	}
+}
+
+func (n PipelineNetwork) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.toJSON())
+}
+
+// UnmarshalJSON overwrites only the given attributes
+// so that a pipeline can override a part of the network of its template.
+func (n *PipelineNetwork) UnmarshalJSON(data []byte) error {
+	v := n.toJSON()
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	n.Network = v.Network
+	n.Subnetwork = v.Subnetwork
+	n.HostProjectID = v.HostProjectID
+	n.Tags = v.Tags
+	n.NoExternalIP = v.ExternalIP != nil && !*v.ExternalIP
+	return nil
+}
+
+func (n *PipelineNetwork) Validate(region string) error {
+	if n.Network != "" && !NetworkNameRegexp.MatchString(n.Network) && !NetworkURLRegexp.MatchString(n.Network) {
+		return fmt.Errorf("Invalid network: %q", n.Network)
+	}
+	if n.Subnetwork != "" {
+		if m := SubnetworkURLRegexp.FindStringSubmatch(n.Subnetwork); m != nil {
+			if m[2] != region {
+				return fmt.Errorf("Invalid subnetwork: %q isn't in region %q", n.Subnetwork, region)
+			}
+		} else if !NetworkNameRegexp.MatchString(n.Subnetwork) {
+			return fmt.Errorf("Invalid subnetwork: %q", n.Subnetwork)
+		}
+	}
+	if n.HostProjectID != "" && n.Subnetwork == "" {
+		return fmt.Errorf("subnetwork is required with host_project_id %q", n.HostProjectID)
+	}
+	if len(n.Tags) > MaxNetworkTags {
+		return fmt.Errorf("Too many tags: %d tags given but the limit is %d", len(n.Tags), MaxNetworkTags)
+	}
+	for _, tag := range n.Tags {
+		if !NetworkTagNameRegexp.MatchString(tag) {
+			return fmt.Errorf("Invalid tag: %q", tag)
+		}
+	}
+	return nil
+}
+
+// NetworkURL returns the URL of the network.
+// It returns blank when only the subnetwork is given because GCE finds the network from the subnetwork.
+func (n *PipelineNetwork) NetworkURL(projectID string) string {
+	if n.Network == "" && n.Subnetwork != "" {
+		return ""
+	}
+	if NetworkURLRegexp.MatchString(n.Network) {
+		return completeComputeURL(n.Network)
+	}
+	return ComputeAPIBaseURL + "projects/" + StringWithDefault(n.HostProjectID, projectID) +
+		"/global/networks/" + StringWithDefault(n.Network, DefaultNetworkName)
+}
+
+// SubnetworkURL returns the URL of the subnetwork in the region.
+func (n *PipelineNetwork) SubnetworkURL(projectID, region string) string {
+	if n.Subnetwork == "" {
+		return ""
+	}
+	if SubnetworkURLRegexp.MatchString(n.Subnetwork) {
+		return completeComputeURL(n.Subnetwork)
+	}
+	return ComputeAPIBaseURL + "projects/" + StringWithDefault(n.HostProjectID, projectID) +
+		"/regions/" + region + "/subnetworks/" + n.Subnetwork
+}
+
+func completeComputeURL(s string) string {
+	if strings.HasPrefix(s, ComputeAPIBaseURL) {
+		return s
+	}
+	return ComputeAPIBaseURL + s
+}
@@ -43,6 +43,10 @@ type PipelineOperation struct {
 	Status        string           `json:"status"`
 	Errors        []OperationError `json:"errors"`
 	Logs          []OperationLog   `json:"logs"`
+
+	// TemplateVersion is the version of the pipeline deployed by update_task
+	TemplateVersion int `json:"template_version,omitempty"`
+
 	CreatedAt     time.Time        `json:"created_at"`
 	UpdatedAt     time.Time        `json:"updated_at"`
 }
@@ -168,6 +172,33 @@ func (m *PipelineOperation) ProcessClosing(ctx context.Context, updater Updater,
 	)
 }
 
+func (m *PipelineOperation) ProcessUpdating(ctx context.Context, updater Updater, completeHandler func(*Pipeline) error) error {
+	return updater.Update(ctx, m,
+		func(_ string) error {
+			return m.LoadPipelineWith(ctx, completeHandler)
+		},
+		func(_ string) error {
+			return m.LoadPipelineWith(ctx, func(pl *Pipeline) error {
+				return pl.CompleteUpdating(ctx)
+			})
+		},
+	)
+}
+
+func (m *PipelineOperation) ProcessRollingUpdate(ctx context.Context, updater Updater) error {
+	return updater.Update(ctx, m,
+		func(_ string) error {
+			// The instances are still being replaced after the operation is done
+			return nil
+		},
+		func(_ string) error {
+			return m.LoadPipelineWith(ctx, func(pl *Pipeline) error {
+				return pl.CompleteUpdating(ctx)
+			})
+		},
+	)
+}
+
 func (m *PipelineOperation) Done() bool {
 	return m.Status == "DONE"
 }
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	RollingUpdateReplace = "REPLACE"
+	RollingUpdateRestart = "RESTART"
+
+	DefaultRollingUpdateMaxSurge       = 1 // for REPLACE
+	DefaultRollingUpdateMaxUnavailable = 1 // for RESTART
+)
+
+// RollingUpdatePolicy is how the instances are replaced after the instance template is updated.
+// See https://cloud.google.com/compute/docs/instance-groups/rolling-out-updates-to-managed-instance-groups
+//
+// The instances are deleted or restarted without waiting for the jobs running on them.
+// Those jobs aren't acknowledged, so Pub/Sub redelivers their messages to the other workers
+// after the ack deadline. If the pipeline has max_execution_seconds, check_stuck_jobs_task
+// also fails and retries the jobs which stop sending progress.
+type RollingUpdatePolicy struct {
+	MinimalAction  string `json:"minimal_action,omitempty"`  // REPLACE by default
+	MaxSurge       int    `json:"max_surge,omitempty"`       // Must be 0 for RESTART
+	MaxUnavailable int    `json:"max_unavailable,omitempty"` // No instance is stopped before the new one is created if it's 0
+}
+
+func (p *RollingUpdatePolicy) Validate() error {
+	switch p.MinimalAction {
+	case "", RollingUpdateReplace, RollingUpdateRestart:
+	default:
+		return fmt.Errorf("Invalid minimal_action: %q", p.MinimalAction)
+	}
+	if p.MaxSurge < 0 || p.MaxUnavailable < 0 {
+		return fmt.Errorf("max_surge and max_unavailable must be greater than or equal to 0")
+	}
+	if p.EffectiveMinimalAction() == RollingUpdateRestart && p.MaxSurge > 0 {
+		return fmt.Errorf("max_surge must be 0 for minimal_action RESTART because no instance is created")
+	}
+	return nil
+}
+
+func (p *RollingUpdatePolicy) EffectiveMinimalAction() string {
+	return StringWithDefault(p.MinimalAction, RollingUpdateReplace)
+}
+
+// EffectiveMaxSurge returns 0 for RESTART. For REPLACE it returns
+// DefaultRollingUpdateMaxSurge only if both of max_surge and max_unavailable are 0
+// because Compute Engine requires either of them to be positive.
+func (p *RollingUpdatePolicy) EffectiveMaxSurge() int {
+	if p.EffectiveMinimalAction() == RollingUpdateRestart {
+		return 0
+	}
+	if p.MaxUnavailable > 0 {
+		return p.MaxSurge
+	}
+	return IntWithDefault(p.MaxSurge, DefaultRollingUpdateMaxSurge)
+}
+
+// EffectiveMaxUnavailable returns DefaultRollingUpdateMaxUnavailable for RESTART
+// if max_unavailable is 0 because the instances are restarted in place.
+func (p *RollingUpdatePolicy) EffectiveMaxUnavailable() int {
+	if p.EffectiveMinimalAction() == RollingUpdateRestart {
+		return IntWithDefault(p.MaxUnavailable, DefaultRollingUpdateMaxUnavailable)
+	}
+	return p.MaxUnavailable
+}
+
+// RegionalFixedOrZero returns the number of zones instead of v if v is between 0 and it
+// because a fixed max_surge or max_unavailable of a regional managed instance group
+// must be 0 or at least the number of its zones.
+func RegionalFixedOrZero(v, zones int) int {
+	if v > 0 && v < zones {
+		return zones
+	}
+	return v
+}
+
+// PipelineReconfiguration has the fields of the pipeline which can be changed in place.
+// The fields which are nil aren't changed.
+type PipelineReconfiguration struct {
+	ContainerName    *string              `json:"container_name,omitempty"`
+	Command          *string              `json:"command,omitempty"`
+	DockerRunOptions *string              `json:"docker_run_options,omitempty"`
+	MachineType      *string              `json:"machine_type,omitempty"`
+	ContainerSize    *int                 `json:"container_size,omitempty"`
+	Preemptible      *bool                `json:"preemptible,omitempty"`
+	StackdriverAgent *bool                `json:"stackdriver_agent,omitempty"`
+	BootDisk         *PipelineVmDisk      `json:"boot_disk,omitempty"`
+	RollingUpdate    *RollingUpdatePolicy `json:"rolling_update,omitempty"`
+}
+
+// ApplyTo sets the given fields to the pipeline.
+// It returns true if the instance template of the pipeline is changed.
+func (r *PipelineReconfiguration) ApplyTo(pl *Pipeline) bool {
+	changed := false
+	setString := func(dest *string, v *string) {
+		if v != nil && *dest != *v {
+			*dest = *v
+			changed = true
+		}
+	}
+	setString(&pl.ContainerName, r.ContainerName)
+	setString(&pl.Command, r.Command)
+	setString(&pl.DockerRunOptions, r.DockerRunOptions)
+	setString(&pl.MachineType, r.MachineType)
+	if r.ContainerSize != nil && pl.ContainerSize != *r.ContainerSize {
+		pl.ContainerSize = *r.ContainerSize
+		changed = true
+	}
+	if r.Preemptible != nil && pl.Preemptible != *r.Preemptible {
+		pl.Preemptible = *r.Preemptible
+		changed = true
+	}
+	if r.StackdriverAgent != nil && pl.StackdriverAgent != *r.StackdriverAgent {
+		pl.StackdriverAgent = *r.StackdriverAgent
+		changed = true
+	}
+	if r.BootDisk != nil && pl.BootDisk != *r.BootDisk {
+		pl.BootDisk = *r.BootDisk
+		changed = true
+	}
+	if r.RollingUpdate != nil {
+		// The policy is used by the next update, so it doesn't change the instance template
+		pl.RollingUpdate = *r.RollingUpdate
+	}
+	return changed
+}
+
+// Reconfigure applies the reconfiguration to the pipeline and saves it.
+// It returns true if the deployment of the pipeline must be updated by update_task.
+// The pipeline which isn't deployed yet or is hibernating is built with the new
+// configuration later, so it doesn't need to be updated.
+// The pipeline is reloaded in the transaction not to overwrite the concurrent changes.
+func (m *Pipeline) Reconfigure(ctx context.Context, r *PipelineReconfiguration) (bool, error) {
+	needsUpdate := false
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := m.Reload(ctx); err != nil {
+			return err
+		}
+		if m.Updating {
+			return &InvalidOperation{Msg: fmt.Sprintf("Can't reconfigure pipeline %v while it's being updated", m.ID)}
+		}
+		deployed := StatusesOpened.Include(m.Status) || StatusesPaused.Include(m.Status)
+		if !deployed && !StatusesNotDeployedYet.Include(m.Status) && !StatusesHibernating.Include(m.Status) {
+			return &InvalidOperation{Msg: fmt.Sprintf("Can't reconfigure a pipeline which is %v", m.Status)}
+		}
+
+		changed := r.ApplyTo(m)
+		if err := m.Validate(); err != nil {
+			return &InvalidReconfiguration{Msg: err.Error()}
+		}
+
+		needsUpdate = deployed && changed
+		if needsUpdate {
+			m.Updating = true
+		}
+		if err := m.Update(ctx); err != nil {
+			log.Errorf(ctx, "Failed to update pipeline %v with reconfiguration because of %v\n", m.ID, err)
+			return err
+		}
+		return nil
+	}, GetTransactionOptions())
+	if err != nil {
+		return false, err
+	}
+	return needsUpdate, nil
+}
+
+// InstanceTemplateName returns the name of the instance template for TemplateVersion.
+// The first version has no suffix to keep the name of the pipelines built before versioning.
+func (m *Pipeline) InstanceTemplateName() string {
+	if m.TemplateVersion < 1 {
+		return m.Name + "-it"
+	}
+	return fmt.Sprintf("%s-it-v%d", m.Name, m.TemplateVersion)
+}
+
+func (m *Pipeline) InstanceTemplateUrl() string {
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/instanceTemplates/%s", m.ProjectID, m.InstanceTemplateName())
+}
+
+func (m *Pipeline) InstanceGroupManagerName() string {
+	return m.DeploymentName + "-igm"
+}
+
+// CompleteUpdating is called when the instances are replaced by rolling update or the update fails.
+func (m *Pipeline) CompleteUpdating(ctx context.Context) error {
+	m.Updating = false
+	m.UpdatingVersion = 0
+	m.UpdatingFingerprint = ""
+	m.TemplateUpdatedAt = time.Now()
+	return m.Update(ctx)
+}
+
+// UpdateOperationOf returns the operation of update_task which deploys the version.
+// It returns nil if the deployment hasn't been updated to the version yet.
+func (m *Pipeline) UpdateOperationOf(ctx context.Context, version int) (*PipelineOperation, error) {
+	operations, err := m.OperationAccessor().All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ope := range operations {
+		if ope.Service == "deploymentmanager" && ope.TemplateVersion == version {
+			return ope, nil
+		}
+	}
+	return nil, nil
+}
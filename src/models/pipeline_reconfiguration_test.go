@@ -0,0 +1,196 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/deploymentmanager/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+type TestDeployerUpdating struct {
+	TestDeployerRunning
+	Updated []*deploymentmanager.Deployment
+}
+
+func (d *TestDeployerUpdating) Get(ctx context.Context, project string, deployment string) (*deploymentmanager.Deployment, error) {
+	return &deploymentmanager.Deployment{Name: deployment, Fingerprint: "fingerprint1"}, nil
+}
+
+func (d *TestDeployerUpdating) Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	d.Updated = append(d.Updated, deployment)
+	return &deploymentmanager.Operation{Name: "operation-update-1", OperationType: "update", Status: "RUNNING"}, nil
+}
+
+func TestPipelineReconfigure(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Pipelines", "Organizations", "PipelineOperations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	newPipeline := func(name string, st Status) *Pipeline {
+		pl := &Pipeline{
+			Organization: org1,
+			Name:         name,
+			ProjectID:    "dummy-proj-111",
+			Zone:         "asia-northeast1-a",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+			},
+			MachineType:    "f1-micro",
+			TargetSize:     1,
+			ContainerSize:  1,
+			ContainerName:  "groovenauts/batch_type_iot_example:0.3.1",
+			DeploymentName: name,
+			Status:         st,
+		}
+		err := pl.Create(ctx)
+		assert.NoError(t, err)
+		return pl
+	}
+
+	containerName := "groovenauts/batch_type_iot_example:0.3.2"
+	machineType := "n1-standard-1"
+	empty := ""
+
+	// Not deployed yet
+	pl := newPipeline("pipeline-hibernating", Hibernating)
+	needsUpdate, err := pl.Reconfigure(ctx, &PipelineReconfiguration{ContainerName: &containerName})
+	assert.NoError(t, err)
+	assert.False(t, needsUpdate)
+	assert.False(t, pl.Updating)
+	assert.Equal(t, containerName, pl.ContainerName)
+
+	// Closed
+	pl = newPipeline("pipeline-closed", Closed)
+	_, err = pl.Reconfigure(ctx, &PipelineReconfiguration{ContainerName: &containerName})
+	_, ok := err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	// Invalid value
+	pl = newPipeline("pipeline-invalid", Opened)
+	_, err = pl.Reconfigure(ctx, &PipelineReconfiguration{MachineType: &empty})
+	_, ok = err.(*InvalidReconfiguration)
+	assert.True(t, ok)
+
+	// Opened
+	pl = newPipeline("pipeline1", Opened)
+	needsUpdate, err = pl.Reconfigure(ctx, &PipelineReconfiguration{
+		ContainerName: &containerName,
+		MachineType:   &machineType,
+		RollingUpdate: &RollingUpdatePolicy{MaxSurge: 2},
+	})
+	assert.NoError(t, err)
+	assert.True(t, needsUpdate)
+	assert.True(t, pl.Updating)
+	assert.Equal(t, machineType, pl.MachineType)
+	assert.Equal(t, 2, pl.RollingUpdate.EffectiveMaxSurge())
+
+	_, err = pl.Reconfigure(ctx, &PipelineReconfiguration{ContainerName: &containerName})
+	_, ok = err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	// Update the deployment with the new instance template
+	deployer := &TestDeployerUpdating{}
+	builder := &Builder{deployer: deployer}
+	ope, err := builder.Update(ctx, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, "operation-update-1", ope.Name)
+	assert.Equal(t, 1, pl.TemplateVersion)
+	if assert.Equal(t, 1, len(deployer.Updated)) {
+		d := deployer.Updated[0]
+		assert.Equal(t, "pipeline1", d.Name)
+		assert.Equal(t, "fingerprint1", d.Fingerprint)
+	}
+	assert.Equal(t, 1, ope.TemplateVersion)
+
+	// The retried update_task doesn't update the deployment again
+	retried, err := builder.Update(ctx, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, ope.ID, retried.ID)
+	assert.Equal(t, 1, pl.TemplateVersion)
+	assert.Equal(t, 1, len(deployer.Updated))
+
+	resources := builder.GenerateDeploymentResources(pl).Resources
+	it := resources[len(resources)-2]
+	igm := resources[len(resources)-1]
+	assert.Equal(t, "pipeline1-it-v1", it.Name)
+	assert.Equal(t, "$(ref.pipeline1-it-v1.selfLink)", igm.Properties["instanceTemplate"])
+
+	// Replace the instances
+	servicer := &DummyInstanceGroupServicer{}
+	rollingUpdater := NewRollingUpdaterWith(servicer)
+	ope, err = rollingUpdater.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, "compute", ope.Service)
+	assert.Equal(t, []string{"https://www.googleapis.com/compute/v1/projects/dummy-proj-111/global/instanceTemplates/pipeline1-it-v1"}, servicer.Templates)
+
+	stable, err := rollingUpdater.Stable(ctx, pl)
+	assert.NoError(t, err)
+	assert.True(t, stable)
+
+	err = pl.CompleteUpdating(ctx)
+	assert.NoError(t, err)
+	saved, err := GlobalPipelineAccessor.Find(ctx, pl.ID)
+	assert.NoError(t, err)
+	assert.False(t, saved.Updating)
+	assert.Equal(t, 0, saved.UpdatingVersion)
+	assert.Equal(t, 1, saved.TemplateVersion)
+	assert.Equal(t, containerName, saved.ContainerName)
+}
+
+func TestRollingUpdatePolicy(t *testing.T) {
+	type Expectation struct {
+		policy         RollingUpdatePolicy
+		valid          bool
+		maxSurge       int
+		maxUnavailable int
+	}
+	expectations := []Expectation{
+		{RollingUpdatePolicy{}, true, 1, 0},
+		{RollingUpdatePolicy{MaxSurge: 2}, true, 2, 0},
+		{RollingUpdatePolicy{MaxSurge: 0, MaxUnavailable: 1}, true, 0, 1},
+		{RollingUpdatePolicy{MaxSurge: 3, MaxUnavailable: 2}, true, 3, 2},
+		{RollingUpdatePolicy{MinimalAction: RollingUpdateRestart}, true, 0, 1},
+		{RollingUpdatePolicy{MinimalAction: RollingUpdateRestart, MaxUnavailable: 3}, true, 0, 3},
+		{RollingUpdatePolicy{MinimalAction: RollingUpdateRestart, MaxSurge: 1}, false, 0, 1},
+		{RollingUpdatePolicy{MaxSurge: -1}, false, -1, 0},
+		{RollingUpdatePolicy{MinimalAction: "REFRESH"}, false, 1, 0},
+	}
+	for _, x := range expectations {
+		if x.valid {
+			assert.NoError(t, x.policy.Validate(), "%v", x.policy)
+		} else {
+			assert.Error(t, x.policy.Validate(), "%v", x.policy)
+		}
+		assert.Equal(t, x.maxSurge, x.policy.EffectiveMaxSurge(), "%v", x.policy)
+		assert.Equal(t, x.maxUnavailable, x.policy.EffectiveMaxUnavailable(), "%v", x.policy)
+	}
+}
+
+func TestRegionalFixedOrZero(t *testing.T) {
+	assert.Equal(t, 0, RegionalFixedOrZero(0, 3))
+	assert.Equal(t, 3, RegionalFixedOrZero(1, 3))
+	assert.Equal(t, 3, RegionalFixedOrZero(3, 3))
+	assert.Equal(t, 4, RegionalFixedOrZero(4, 3))
+	assert.Equal(t, 1, RegionalFixedOrZero(1, 0))
+}
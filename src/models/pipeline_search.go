@@ -0,0 +1,194 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	MaxPipelineSearchLimit = 1000
+	// PipelineSearchScanLimit is the max number of pipelines scanned to filter
+	// by multiple statuses in a request with limit.
+	PipelineSearchScanLimit = 1000
+)
+
+// StatusSets are the names of status sets which can be given to search pipelines.
+var StatusSets = map[string]Statuses{
+	"not_deployed_yet":        StatusesNotDeployedYet,
+	"deploying":               StatusesNowDeploying,
+	"opened":                  StatusesOpened,
+	"paused":                  StatusesPaused,
+	"hibernation_in_progress": StatusesHibernationInProgresss,
+	"hibernating":             StatusesHibernating,
+	"closed":                  StatusesAlreadyClosing,
+}
+
+// ParseStatuses parses the names of status sets or statuses.
+// A status set name takes precedence over the status name.
+func ParseStatuses(names []string) (Statuses, error) {
+	res := Statuses{}
+	add := func(st Status) {
+		if !res.Include(st) {
+			res = append(res, st)
+		}
+	}
+	for _, name := range names {
+		if sts, ok := StatusSets[name]; ok {
+			for _, st := range sts {
+				add(st)
+			}
+			continue
+		}
+		found := false
+		for st, s := range StatusStrings {
+			if s == name {
+				add(st)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &InvalidSearchCondition{Msg: fmt.Sprintf("Invalid status: %q", name)}
+		}
+	}
+	return res, nil
+}
+
+// PipelineSortOrders maps the sort parameters to the datastore orders.
+var PipelineSortOrders = map[string]string{
+	"created_at":  "CreatedAt",
+	"-created_at": "-CreatedAt",
+	"name":        "Name",
+	"-name":       "-Name",
+}
+
+type PipelineSearchCondition struct {
+	Statuses      Statuses
+	NamePrefix    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string // One of PipelineSortOrders. "name" with NamePrefix or "created_at" otherwise by default
+	Limit         int    // No limit if it's 0
+	Cursor        string
+}
+
+func (c *PipelineSearchCondition) sortOrder() string {
+	if c.Sort != "" {
+		return c.Sort
+	}
+	if c.NamePrefix != "" {
+		return "name"
+	}
+	return "created_at"
+}
+
+func (c *PipelineSearchCondition) Validate() error {
+	if c.Limit < 0 || c.Limit > MaxPipelineSearchLimit {
+		return &InvalidSearchCondition{Msg: fmt.Sprintf("limit must be less than or equal to %d but was %d", MaxPipelineSearchLimit, c.Limit)}
+	}
+	timeRange := !c.CreatedAfter.IsZero() || !c.CreatedBefore.IsZero()
+	if c.NamePrefix != "" && timeRange {
+		// Datastore allows inequality filters on only one property
+		return &InvalidSearchCondition{Msg: "name prefix can't be combined with created_after or created_before"}
+	}
+	sort := c.sortOrder()
+	order, ok := PipelineSortOrders[sort]
+	if !ok {
+		return &InvalidSearchCondition{Msg: fmt.Sprintf("Invalid sort: %q", c.Sort)}
+	}
+	// The property with inequality filters must be sorted first
+	switch {
+	case c.NamePrefix != "" && order != "Name" && order != "-Name":
+		return &InvalidSearchCondition{Msg: fmt.Sprintf("sort must be name or -name with name prefix but was %q", sort)}
+	case timeRange && order != "CreatedAt" && order != "-CreatedAt":
+		return &InvalidSearchCondition{Msg: fmt.Sprintf("sort must be created_at or -created_at with time range but was %q", sort)}
+	}
+	return nil
+}
+
+func (c *PipelineSearchCondition) query() (*datastore.Query, error) {
+	q := datastore.NewQuery("Pipelines")
+	if len(c.Statuses) == 1 {
+		q = q.Filter("Status =", c.Statuses[0])
+	}
+	if c.NamePrefix != "" {
+		q = q.Filter("Name >=", c.NamePrefix).Filter("Name <", c.NamePrefix+"\ufffd")
+	}
+	if !c.CreatedAfter.IsZero() {
+		q = q.Filter("CreatedAt >", c.CreatedAfter)
+	}
+	if !c.CreatedBefore.IsZero() {
+		q = q.Filter("CreatedAt <", c.CreatedBefore)
+	}
+	q = q.Order(PipelineSortOrders[c.sortOrder()])
+	if c.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(c.Cursor)
+		if err != nil {
+			return nil, &InvalidSearchCondition{Msg: fmt.Sprintf("Invalid cursor: %q", c.Cursor)}
+		}
+		q = q.Start(cursor)
+	}
+	return q, nil
+}
+
+// Match returns true if the pipeline matches the statuses
+// which can't be filtered by the query.
+func (c *PipelineSearchCondition) Match(pl *Pipeline) bool {
+	return len(c.Statuses) == 0 || c.Statuses.Include(pl.Status)
+}
+
+// Search returns the pipelines which match the condition and the cursor for the next page.
+// Multiple statuses are filtered after loading, so a page can have less pipelines than
+// the limit when PipelineSearchScanLimit pipelines are scanned.
+// The cursor is empty when there are no more pipelines.
+func (pa *PipelineAccessor) Search(ctx context.Context, c *PipelineSearchCondition) ([]*Pipeline, string, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := c.query()
+	if err != nil {
+		return nil, "", err
+	}
+
+	res := []*Pipeline{}
+	scanned := 0
+	more := false
+	iter, err := pa.EachByQuery(ctx, q, func(pl *Pipeline) bool {
+		scanned++
+		if c.Match(pl) {
+			res = append(res, pl)
+		}
+		if c.Limit > 0 && (len(res) >= c.Limit || scanned >= PipelineSearchScanLimit) {
+			more = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf(ctx, "Failed to search pipelines because of %v\n", err)
+		return nil, "", err
+	}
+	if !more {
+		return res, "", nil
+	}
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return res, cursor.String(), nil
+}
+
+// PipelineSummaryOmittedFields are the JSON fields omitted in the summary of pipelines.
+var PipelineSummaryOmittedFields = []string{
+	"boot_disk",
+	"dependency",
+	"close_policy",
+	"retry_policy",
+	"command",
+	"docker_run_options",
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestParseStatuses(t *testing.T) {
+	sts, err := ParseStatuses([]string{"opened", "hibernating", "closed"})
+	assert.NoError(t, err)
+	assert.Equal(t, Statuses{Opened, HibernationChecking, Hibernating, Closing, ClosingError, Closed}, sts)
+
+	sts, err = ParseStatuses([]string{"building", "deploying", "building"})
+	assert.NoError(t, err)
+	assert.Equal(t, Statuses{Building, Deploying}, sts)
+
+	_, err = ParseStatuses([]string{"unknown"})
+	assert.IsType(t, &InvalidSearchCondition{}, err)
+}
+
+func TestPipelineAccessorSearch(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pipelines := []*Pipeline{}
+	for i, st := range []Status{Opened, Closed, HibernationChecking, Hibernating, Closed} {
+		name := "batch"
+		if i%2 == 1 {
+			name = "etl"
+		}
+		pl := &Pipeline{
+			Organization: org1,
+			Name:         fmt.Sprintf("%s-%d", name, i),
+			ProjectID:    "dummy-proj-111",
+			Zone:         "asia-northeast1-a",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+			},
+			MachineType:   "f1-micro",
+			TargetSize:    1,
+			ContainerSize: 1,
+			ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+			Status:        st,
+		}
+		err = pl.Create(ctx)
+		assert.NoError(t, err)
+		pipelines = append(pipelines, pl)
+	}
+	accessor := org1.PipelineAccessor()
+
+	names := func(pls []*Pipeline) []string {
+		res := []string{}
+		for _, pl := range pls {
+			res = append(res, pl.Name)
+		}
+		return res
+	}
+
+	res, cursor, err := accessor.Search(ctx, &PipelineSearchCondition{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"batch-0", "etl-1", "batch-2", "etl-3", "batch-4"}, names(res))
+	assert.Empty(t, cursor)
+
+	// Status set
+	res, _, err = accessor.Search(ctx, &PipelineSearchCondition{Statuses: StatusesOpened})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"batch-0", "batch-2"}, names(res))
+
+	// Single status
+	res, _, err = accessor.Search(ctx, &PipelineSearchCondition{Statuses: Statuses{Closed}, Sort: "-created_at"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"batch-4", "etl-1"}, names(res))
+
+	// Name prefix
+	res, _, err = accessor.Search(ctx, &PipelineSearchCondition{NamePrefix: "etl-", Sort: "-name"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"etl-3", "etl-1"}, names(res))
+
+	// Time range
+	res, _, err = accessor.Search(ctx, &PipelineSearchCondition{
+		CreatedAfter:  pipelines[1].CreatedAt,
+		CreatedBefore: pipelines[4].CreatedAt,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"batch-2", "etl-3"}, names(res))
+
+	// Pagination with a status set
+	cond := &PipelineSearchCondition{Statuses: Statuses{Opened, Closed}, Limit: 2}
+	pages := [][]string{}
+	for {
+		res, cursor, err = accessor.Search(ctx, cond)
+		assert.NoError(t, err)
+		pages = append(pages, names(res))
+		if cursor == "" {
+			break
+		}
+		cond.Cursor = cursor
+	}
+	assert.Equal(t, [][]string{{"batch-0", "etl-1"}, {"batch-4"}}, pages)
+
+	// Invalid conditions
+	invalids := []*PipelineSearchCondition{
+		{Limit: MaxPipelineSearchLimit + 1},
+		{NamePrefix: "etl-", CreatedAfter: pipelines[0].CreatedAt},
+		{NamePrefix: "etl-", Sort: "created_at"},
+		{CreatedBefore: pipelines[0].CreatedAt, Sort: "name"},
+		{Sort: "status"},
+		{Cursor: "invalid-cursor"},
+	}
+	for _, cond := range invalids {
+		_, _, err = accessor.Search(ctx, cond)
+		assert.IsType(t, &InvalidSearchCondition{}, err, "condition: %v", cond)
+	}
+}
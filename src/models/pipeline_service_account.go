@@ -0,0 +1,89 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultServiceAccount = "default"
+	ScopeURLPrefix        = "https://www.googleapis.com/auth/"
+)
+
+// DefaultScopes are given to the default service account when no scope is given.
+var DefaultScopes = []string{
+	ScopeURLPrefix + "devstorage.full_control",
+	ScopeURLPrefix + "pubsub",
+	ScopeURLPrefix + "logging.write",
+	ScopeURLPrefix + "monitoring.write",
+	ScopeURLPrefix + "cloud-platform",
+}
+
+// PubsubScopes are the scopes either of which the workers need to pull jobs and
+// to create their control subscriptions.
+var PubsubScopes = []string{
+	ScopeURLPrefix + "pubsub",
+	ScopeURLPrefix + "cloud-platform",
+}
+
+var (
+	ServiceAccountEmailRegexp = regexp.MustCompile(`\A[^@\s]+@[^@\s]+\.[^@\s]+\z`)
+	ScopeNameRegexp           = regexp.MustCompile(`\A[a-z][-a-z0-9_.]*\z`)
+)
+
+// ServiceAccount is the service account of the instances of the pipeline.
+// The email must be in Organization.AllowedServiceAccounts unless it's blank or "default".
+type ServiceAccount struct {
+	Email  string   `json:"email,omitempty"`
+	Scopes []string `json:"scopes,omitempty"` // URL or name like "pubsub"
+}
+
+func (sa *ServiceAccount) Validate() error {
+	if sa.Email != "" && sa.Email != DefaultServiceAccount && !ServiceAccountEmailRegexp.MatchString(sa.Email) {
+		return fmt.Errorf("Invalid service_account.email: %q", sa.Email)
+	}
+	for _, scope := range sa.Scopes {
+		if !ScopeNameRegexp.MatchString(strings.TrimPrefix(scope, ScopeURLPrefix)) {
+			return fmt.Errorf("Invalid service_account.scopes: %q", scope)
+		}
+	}
+	if len(sa.Scopes) > 0 && !sa.hasPubsubScope() {
+		return fmt.Errorf("service_account.scopes must include pubsub or cloud-platform: %v", sa.Scopes)
+	}
+	return nil
+}
+
+func (sa *ServiceAccount) hasPubsubScope() bool {
+	for _, scope := range sa.ScopeURLs() {
+		for _, s := range PubsubScopes {
+			if scope == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowed returns true if the organization is allowed to use the service account.
+func (sa *ServiceAccount) Allowed(org *Organization) bool {
+	if sa.Email == "" || sa.Email == DefaultServiceAccount {
+		return true
+	}
+	return org.ServiceAccountAllowed(sa.Email)
+}
+
+// ScopeURLs returns the URLs of the scopes or DefaultScopes if no scope is given.
+func (sa *ServiceAccount) ScopeURLs() []string {
+	if len(sa.Scopes) == 0 {
+		return DefaultScopes
+	}
+	r := []string{}
+	for _, scope := range sa.Scopes {
+		if !strings.HasPrefix(scope, ScopeURLPrefix) {
+			scope = ScopeURLPrefix + scope
+		}
+		r = append(r, scope)
+	}
+	return r
+}
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// PipelineTemplate is the pipeline configuration shared by the pipelines of the organization.
+// Each update makes a new version and the previous versions are kept as PipelineTemplateVersions.
+type PipelineTemplate struct {
+	ID           string          `json:"id"          datastore:"-"`
+	Organization *Organization   `json:"-"           validate:"required" datastore:"-"`
+	Name         string          `json:"name"        validate:"required"`
+	Description  string          `json:"description" datastore:",noindex"`
+	Version      int             `json:"version"`
+	Pipeline     json.RawMessage `json:"pipeline"    datastore:"-"`
+	Body         []byte          `json:"-"           datastore:",noindex"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// PipelineTemplateVersion is the snapshot of the pipeline configuration of a version.
+// It's stored as a child entity of the template with the version as its key.
+type PipelineTemplateVersion struct {
+	Version   int             `json:"version"    datastore:"-"`
+	Pipeline  json.RawMessage `json:"pipeline"   datastore:"-"`
+	Body      []byte          `json:"-"          datastore:",noindex"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (m *PipelineTemplate) Validate() error {
+	validator := validator.New()
+	err := validator.Struct(m)
+	if err != nil {
+		return &InvalidOperation{Msg: err.Error()}
+	}
+	if len(m.Pipeline) == 0 {
+		return &InvalidOperation{Msg: "No pipeline given to the template"}
+	}
+	// The template doesn't have to be a valid pipeline by itself
+	// because the required fields can be given when the pipeline is created.
+	pl := &Pipeline{}
+	if err := json.Unmarshal(m.Pipeline, pl); err != nil {
+		return &InvalidOperation{Msg: fmt.Sprintf("Invalid pipeline of the template: %v", err)}
+	}
+	return nil
+}
+
+func (m *PipelineTemplate) Create(ctx context.Context) error {
+	t := time.Now()
+	m.CreatedAt = t
+	m.UpdatedAt = t
+	m.Version = 1
+
+	if m.Organization == nil {
+		return fmt.Errorf("No organization to create PipelineTemplate: %v\n", m)
+	}
+	parentKey, err := datastore.DecodeKey(m.Organization.ID)
+	if err != nil {
+		return err
+	}
+	key := datastore.NewIncompleteKey(ctx, "PipelineTemplates", parentKey)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return m.putWithVersion(ctx, key)
+	}, GetTransactionOptions())
+}
+
+// Update saves the template as the next version.
+func (m *PipelineTemplate) Update(ctx context.Context) error {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		stored := &PipelineTemplate{}
+		err := datastore.Get(ctx, key, stored)
+		if err != nil {
+			return err
+		}
+		m.Version = stored.Version + 1
+		m.CreatedAt = stored.CreatedAt
+		m.UpdatedAt = time.Now()
+		return m.putWithVersion(ctx, key)
+	}, GetTransactionOptions())
+}
+
+func (m *PipelineTemplate) putWithVersion(ctx context.Context, key *datastore.Key) error {
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+	m.Body = []byte(m.Pipeline)
+	res, err := datastore.Put(ctx, key, m)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put PipelineTemplate %v because of %v\n", m, err)
+		return err
+	}
+	ver := &PipelineTemplateVersion{
+		Version:   m.Version,
+		Body:      m.Body,
+		CreatedAt: m.UpdatedAt,
+	}
+	verKey := datastore.NewKey(ctx, "PipelineTemplateVersions", "", int64(m.Version), res)
+	_, err = datastore.Put(ctx, verKey, ver)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put PipelineTemplateVersion %d of %v because of %v\n", m.Version, res, err)
+		return err
+	}
+	m.ID = res.Encode()
+	return nil
+}
+
+// Destroy deletes the template and all of its versions.
+// The pipelines created from the template aren't changed.
+func (m *PipelineTemplate) Destroy(ctx context.Context) error {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		q := datastore.NewQuery("PipelineTemplateVersions").Ancestor(key).KeysOnly()
+		keys, err := q.GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return datastore.DeleteMulti(ctx, keys)
+	}, GetTransactionOptions())
+}
+
+// Versions returns the versions of the template in ascending order.
+func (m *PipelineTemplate) Versions(ctx context.Context) ([]*PipelineTemplateVersion, error) {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery("PipelineTemplateVersions").Ancestor(key)
+	res := []*PipelineTemplateVersion{}
+	keys, err := q.GetAll(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	for i, ver := range res {
+		ver.Version = int(keys[i].IntID())
+		ver.Pipeline = json.RawMessage(ver.Body)
+	}
+	return res, nil
+}
+
+// FindVersion returns the version of the template. It returns the current version if version is 0.
+func (m *PipelineTemplate) FindVersion(ctx context.Context, version int) (*PipelineTemplateVersion, error) {
+	if version == 0 || version == m.Version {
+		return &PipelineTemplateVersion{
+			Version:   m.Version,
+			Pipeline:  m.Pipeline,
+			Body:      m.Body,
+			CreatedAt: m.UpdatedAt,
+		}, nil
+	}
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	ver := &PipelineTemplateVersion{}
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "PipelineTemplateVersions", "", int64(version), key), ver)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return nil, ErrNoSuchPipelineTemplate
+	case err != nil:
+		return nil, err
+	}
+	ver.Version = version
+	ver.Pipeline = json.RawMessage(ver.Body)
+	return ver, nil
+}
+
+// NewPipeline returns a new pipeline with the configuration of the version.
+// The overrides are merged onto the configuration after that.
+func (m *PipelineTemplate) NewPipeline(ctx context.Context, version int, overrides func(*Pipeline) error) (*Pipeline, error) {
+	ver, err := m.FindVersion(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	pl := &Pipeline{}
+	err = json.Unmarshal(ver.Pipeline, pl)
+	if err != nil {
+		return nil, err
+	}
+	if overrides != nil {
+		err = overrides(pl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pl.PipelineTemplateID = m.ID
+	pl.PipelineTemplateVersion = ver.Version
+	return pl, nil
+}
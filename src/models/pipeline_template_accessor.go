@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+type PipelineTemplateAccessor struct {
+	Parent *Organization
+}
+
+var ErrNoSuchPipelineTemplate = errors.New("No such data in PipelineTemplates")
+
+func (m *Organization) PipelineTemplateAccessor() *PipelineTemplateAccessor {
+	return &PipelineTemplateAccessor{Parent: m}
+}
+
+func (pa *PipelineTemplateAccessor) Find(ctx context.Context, id string) (*PipelineTemplate, error) {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		log.Errorf(ctx, "Failed to decode id(%v) to key because of %v \n", id, err)
+		return nil, ErrNoSuchPipelineTemplate
+	}
+	parentKey, err := datastore.DecodeKey(pa.Parent.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !parentKey.Equal(key.Parent()) {
+		return nil, &InvalidParent{id}
+	}
+
+	m := &PipelineTemplate{}
+	err = datastore.Get(ctx, key, m)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return nil, ErrNoSuchPipelineTemplate
+	case err != nil:
+		log.Errorf(ctx, "Failed to Get pipeline template key(%v) because of %v \n", key, err)
+		return nil, err
+	}
+	pa.loaded(key, m)
+	return m, nil
+}
+
+func (pa *PipelineTemplateAccessor) All(ctx context.Context) ([]*PipelineTemplate, error) {
+	parentKey, err := datastore.DecodeKey(pa.Parent.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery("PipelineTemplates").Ancestor(parentKey)
+	res := []*PipelineTemplate{}
+	keys, err := q.GetAll(ctx, &res)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get pipeline templates because of %v\n", err)
+		return nil, err
+	}
+	for i, m := range res {
+		pa.loaded(keys[i], m)
+	}
+	return res, nil
+}
+
+func (pa *PipelineTemplateAccessor) loaded(key *datastore.Key, m *PipelineTemplate) {
+	m.ID = key.Encode()
+	m.Organization = pa.Parent
+	m.Pipeline = json.RawMessage(m.Body)
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestPipelineTemplateCRUD(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"PipelineTemplates", "PipelineTemplateVersions", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+	org2 := &Organization{Name: "org2"}
+	err = org2.Create(ctx)
+	assert.NoError(t, err)
+
+	// Invalid templates
+	tmpl := &PipelineTemplate{Organization: org1, Name: "iot"}
+	err = tmpl.Create(ctx)
+	_, ok := err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	tmpl.Pipeline = json.RawMessage(`{"machine_type": 1}`)
+	err = tmpl.Create(ctx)
+	_, ok = err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	// Create
+	tmpl = &PipelineTemplate{
+		Organization: org1,
+		Name:         "iot",
+		Pipeline: json.RawMessage(`{
+			"project_id": "dummy-proj-999",
+			"zone": "us-central1-f",
+			"boot_disk": {"source_image": "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable", "disk_size_gb": 50},
+			"machine_type": "f1-micro",
+			"target_size": 1,
+			"container_size": 1,
+			"container_name": "groovenauts/batch_type_iot_example:0.3.1"
+		}`),
+	}
+	err = tmpl.Create(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tmpl.Version)
+
+	_, err = org2.PipelineTemplateAccessor().Find(ctx, tmpl.ID)
+	_, ok = err.(*InvalidParent)
+	assert.True(t, ok)
+
+	// Update makes a new version
+	found, err := org1.PipelineTemplateAccessor().Find(ctx, tmpl.ID)
+	assert.NoError(t, err)
+	found.Pipeline = json.RawMessage(`{
+		"project_id": "dummy-proj-999",
+		"zone": "us-central1-f",
+		"boot_disk": {"source_image": "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable", "disk_size_gb": 50},
+		"machine_type": "n1-standard-1",
+		"target_size": 2,
+		"container_size": 1,
+		"container_name": "groovenauts/batch_type_iot_example:0.3.2"
+	}`)
+	err = found.Update(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, found.Version)
+
+	versions, err := found.Versions(ctx)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(versions)) {
+		assert.Equal(t, 1, versions[0].Version)
+		assert.Equal(t, 2, versions[1].Version)
+	}
+
+	// Pipeline with the current version and overrides
+	pl, err := found.NewPipeline(ctx, 0, func(pl *Pipeline) error {
+		return json.Unmarshal([]byte(`{"name": "pipeline1", "boot_disk": {"disk_type": "pd-ssd"}, "target_size": 3}`), pl)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "pipeline1", pl.Name)
+	assert.Equal(t, "n1-standard-1", pl.MachineType)
+	assert.Equal(t, 3, pl.TargetSize)
+	assert.Equal(t, 50, pl.BootDisk.DiskSizeGb)
+	assert.Equal(t, "pd-ssd", pl.BootDisk.DiskType)
+	assert.Equal(t, found.ID, pl.PipelineTemplateID)
+	assert.Equal(t, 2, pl.PipelineTemplateVersion)
+
+	pl.Organization = org1
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	// Pipeline with the previous version
+	pl, err = found.NewPipeline(ctx, 1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "f1-micro", pl.MachineType)
+	assert.Equal(t, 1, pl.PipelineTemplateVersion)
+
+	_, err = found.NewPipeline(ctx, 3, nil)
+	assert.Equal(t, ErrNoSuchPipelineTemplate, err)
+
+	// Destroy
+	err = found.Destroy(ctx)
+	assert.NoError(t, err)
+	templates, err := org1.PipelineTemplateAccessor().All(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(templates))
+	_, err = org1.PipelineTemplateAccessor().Find(ctx, found.ID)
+	assert.Equal(t, ErrNoSuchPipelineTemplate, err)
+}
@@ -224,6 +224,7 @@ func TestStatusTypeAndValue(t *testing.T) {
 	assert.Equal(t, st, fmt.Sprintf(ft, Closing))
 	assert.Equal(t, st, fmt.Sprintf(ft, ClosingError))
 	assert.Equal(t, st, fmt.Sprintf(ft, Closed))
+	assert.Equal(t, st, fmt.Sprintf(ft, Paused))
 
 	assert.Equal(t, "0", fmt.Sprintf(fv, Uninitialized))
 	assert.Equal(t, "1", fmt.Sprintf(fv, Broken))
@@ -241,6 +242,7 @@ func TestStatusTypeAndValue(t *testing.T) {
 	assert.Equal(t, "13", fmt.Sprintf(fv, Closing))
 	assert.Equal(t, "14", fmt.Sprintf(fv, ClosingError))
 	assert.Equal(t, "15", fmt.Sprintf(fv, Closed))
+	assert.Equal(t, "16", fmt.Sprintf(fv, Paused))
 }
 
 func TestPipelineStateTransition(t *testing.T) {
@@ -328,11 +330,11 @@ func TestGetActiveSubscriptions(t *testing.T) {
 	test_utils.RetryWith(12, func() func() {
 		res, err = GlobalPipelineAccessor.GetActiveSubscriptions(ctx)
 		assert.NoError(t, err)
-		if 1 == len(res) {
+		if 2 == len(res) {
 			return nil
 		} else {
 			return func() {
-				assert.Equal(t, 1, len(res))
+				assert.Equal(t, 2, len(res))
 			}
 		}
 	})
@@ -341,6 +343,11 @@ func TestGetActiveSubscriptions(t *testing.T) {
 	assert.Equal(t, pipelines[Opened].ID, subscription.PipelineID)
 	assert.Equal(t, "pipeline-opened", subscription.Pipeline)
 	assert.Equal(t, "projects/test-project-x/subscriptions/pipeline-opened-progress-subscription", subscription.Name)
+
+	subscription = res[1]
+	assert.Equal(t, pipelines[Paused].ID, subscription.PipelineID)
+	assert.Equal(t, "pipeline-paused", subscription.Pipeline)
+	assert.Equal(t, "projects/test-project-x/subscriptions/pipeline-paused-progress-subscription", subscription.Name)
 }
 
 func TestGetWaitingPipelines(t *testing.T) {
@@ -489,3 +496,403 @@ func TestPipelineHasNewTaskSince(t *testing.T) {
 		assert.Equal(t, expected, actual)
 	}
 }
+
+func TestPipelineFailStuckJobs(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pipeline := &Pipeline{
+		Organization: org1,
+		Name:         "dummy-pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:         "f1-micro",
+		TargetSize:          1,
+		ContainerSize:       1,
+		ContainerName:       "groovenauts/batch_type_iot_example:0.3.1",
+		RetryPolicy:         RetryPolicy{MaxAttempts: 2},
+		MaxQueueSeconds:     3600,
+		MaxExecutionSeconds: 3600,
+	}
+	err = pipeline.Create(ctx)
+	assert.NoError(t, err)
+	assert.True(t, pipeline.HasJobDeadline())
+
+	now := time.Now()
+	longAgo := now.Add(-2 * time.Hour)
+	recently := now.Add(-10 * time.Minute)
+
+	type Pattern struct {
+		status      JobStatus
+		publishedAt time.Time
+		updatedAt   time.Time
+		retryPolicy RetryPolicy
+		expected    JobStatus
+		reason      bool
+	}
+
+	patterns := []Pattern{
+		{Published, longAgo, longAgo, RetryPolicy{MaxAttempts: 1}, Failure, true},
+		{Published, recently, recently, RetryPolicy{}, Published, false},
+		{Executing, longAgo, longAgo, RetryPolicy{}, Ready, false},
+		{Executing, longAgo, recently, RetryPolicy{}, Executing, false},
+		{Success, longAgo, longAgo, RetryPolicy{}, Success, false},
+	}
+
+	jobs := Jobs{}
+	for idx, ptn := range patterns {
+		job := &Job{
+			Pipeline:    pipeline,
+			IdByClient:  fmt.Sprintf("%s-job%d", pipeline.Name, idx),
+			Status:      ptn.status,
+			RetryPolicy: ptn.retryPolicy,
+			PublishedAt: ptn.publishedAt,
+			CreatedAt:   longAgo,
+			UpdatedAt:   ptn.updatedAt,
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+		jobs = append(jobs, job)
+	}
+
+	originalPublisher := GlobalPublisher
+	dummyPublisher := &DummyPublisher{}
+	GlobalPublisher = dummyPublisher
+	defer func() {
+		GlobalPublisher = originalPublisher
+	}()
+
+	retried := []string{}
+	failed, err := pipeline.FailStuckJobs(ctx, now, func(job *Job) error {
+		retried = append(retried, job.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(failed))
+	assert.Equal(t, []string{jobs[2].ID}, retried)
+
+	// The cancel commands for the stuck attempts
+	cancelled := map[string]string{}
+	for _, inv := range dummyPublisher.Invocations {
+		assert.Equal(t, pipeline.ControlTopicFqn(), inv.Topic)
+		for _, msg := range inv.Messages {
+			assert.Equal(t, CancelCommand, msg.Attributes[CommandKey])
+			cancelled[msg.Attributes[JobIdKey]] = msg.Attributes[JobAttemptKey]
+		}
+	}
+	assert.Equal(t, map[string]string{jobs[0].ID: "1", jobs[2].ID: "1"}, cancelled)
+
+	for idx, ptn := range patterns {
+		job, err := GlobalJobAccessor.Find(ctx, jobs[idx].ID)
+		assert.NoError(t, err)
+		assert.Equal(t, ptn.expected, job.Status, "pattern %d", idx)
+		if ptn.reason {
+			assert.NotEmpty(t, job.FailureReason, "pattern %d", idx)
+		} else {
+			assert.Empty(t, job.FailureReason, "pattern %d", idx)
+		}
+	}
+
+	retriedJob, err := GlobalJobAccessor.Find(ctx, jobs[2].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, retriedJob.Attempt)
+	if assert.Equal(t, 1, len(retriedJob.AttemptHistory)) {
+		assert.NotEmpty(t, retriedJob.AttemptHistory[0].Reason)
+	}
+}
+
+func TestPipelinePublishJobs(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pipeline := &Pipeline{
+		Organization: org1,
+		Name:         "dummy-pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+	}
+	err = pipeline.Create(ctx)
+	assert.NoError(t, err)
+
+	jobCount := PublishJobsBatchSize + 5
+	for i := 0; i < jobCount; i++ {
+		job := &Job{
+			Pipeline:   pipeline,
+			IdByClient: fmt.Sprintf("job-%02d", i),
+			Status:     Ready,
+			Priority:   i % 3,
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+	}
+	preparing := &Job{
+		Pipeline:   pipeline,
+		IdByClient: "job-preparing",
+		Status:     Preparing,
+	}
+	err = preparing.Create(ctx)
+	assert.NoError(t, err)
+	// Waiting for the retry backoff
+	backoff := &Job{
+		Pipeline:   pipeline,
+		IdByClient: "job-backoff",
+		Status:     Ready,
+		Priority:   9,
+		Attempt:    2,
+		RetryAt:    time.Now().Add(time.Hour),
+	}
+	err = backoff.Create(ctx)
+	assert.NoError(t, err)
+
+	originalPublisher := GlobalPublisher
+	dummyPublisher := &DummyPublisher{MaxMessages: 10}
+	GlobalPublisher = dummyPublisher
+	defer func() {
+		GlobalPublisher = originalPublisher
+	}()
+
+	err = pipeline.PublishJobs(ctx)
+	assert.NoError(t, err)
+
+	// 30 jobs claimed in 2 transactions are published at once and split into 3 batches
+	assert.Equal(t, 3, len(dummyPublisher.Invocations))
+	for _, inv := range dummyPublisher.Invocations {
+		assert.Equal(t, pipeline.JobTopicFqn(), inv.Topic)
+	}
+
+	jobs, err := pipeline.JobAccessor().All(ctx)
+	assert.NoError(t, err)
+	msgIds := map[string]*Job{}
+	for _, job := range jobs {
+		if job.Status == Preparing || job.ID == backoff.ID {
+			assert.Equal(t, job.ID == backoff.ID, job.Status == Ready)
+			assert.Empty(t, job.MessageID)
+			continue
+		}
+		assert.Equal(t, Published, job.Status)
+		assert.NotEmpty(t, job.MessageID)
+		assert.False(t, job.PublishedAt.IsZero())
+		msgIds[job.MessageID] = job
+	}
+	assert.Equal(t, jobCount, len(msgIds))
+
+	// The published jobs aren't published again
+	err = pipeline.PublishJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(dummyPublisher.Invocations))
+
+	// Higher priority first
+	first := dummyPublisher.Invocations[0].Messages[0]
+	firstJob, err := GlobalJobAccessor.Find(ctx, first.Attributes[JobIdKey])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, firstJob.Priority)
+	assert.Equal(t, "DummyMsgId-1", firstJob.MessageID)
+	assert.Equal(t, firstJob.ID, msgIds["DummyMsgId-1"].ID)
+
+	// The job left Publishing gets back to Ready after the timeout
+	publishing := &Job{
+		Pipeline:   pipeline,
+		IdByClient: "job-publishing",
+		Status:     Publishing,
+	}
+	err = publishing.Create(ctx)
+	assert.NoError(t, err)
+
+	recovered, err := pipeline.RecoverPublishingJobs(ctx, time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, recovered)
+
+	recovered, err = pipeline.RecoverPublishingJobs(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, recovered)
+	reloaded, err := GlobalJobAccessor.Find(ctx, publishing.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Ready, reloaded.Status)
+	assert.Empty(t, reloaded.MessageID)
+}
+
+func TestPipelinePauseAndResume(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pipeline := &Pipeline{
+		Organization: org1,
+		Name:         "dummy-pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        HibernationChecking,
+	}
+	err = pipeline.Create(ctx)
+	assert.NoError(t, err)
+
+	// Pause suspends hibernation
+	err = pipeline.Pause(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Paused, pipeline.Status)
+	assert.False(t, pipeline.PausedAt.IsZero())
+	assert.True(t, pipeline.AcceptsReadyJobs())
+
+	err = pipeline.Pause(ctx)
+	_, ok := err.(*InvalidStateTransition)
+	assert.True(t, ok)
+
+	originalPublisher := GlobalPublisher
+	dummyPublisher := &DummyPublisher{}
+	GlobalPublisher = dummyPublisher
+	defer func() {
+		GlobalPublisher = originalPublisher
+	}()
+
+	// The job is held in Ready while the pipeline is paused
+	job := &Job{
+		Pipeline:   pipeline,
+		IdByClient: "job-1",
+		Status:     Ready,
+	}
+	err = job.CreateAndPublishIfPossible(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Ready, job.Status)
+	assert.Equal(t, 0, len(dummyPublisher.Invocations))
+
+	err = pipeline.Resume(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Opened, pipeline.Status)
+	assert.True(t, pipeline.PausedAt.IsZero())
+
+	err = pipeline.Resume(ctx)
+	_, ok = err.(*InvalidStateTransition)
+	assert.True(t, ok)
+
+	// The paused pipeline can be closed
+	err = pipeline.Pause(ctx)
+	assert.NoError(t, err)
+	err = pipeline.StartClosing(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Closing, pipeline.Status)
+}
+
+func TestPipelineServiceAccountAllowed(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	assert.NoError(t, err)
+	defer done()
+
+	test_utils.ClearDatastore(t, ctx, "Organizations")
+	test_utils.ClearDatastore(t, ctx, "Pipelines")
+
+	org1 := &Organization{
+		Name:                   "org01",
+		TokenAmount:            10,
+		AllowedServiceAccounts: []string{"worker@dummy-proj-999.iam.gserviceaccount.com", " "},
+	}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"worker@dummy-proj-999.iam.gserviceaccount.com"}, org1.AllowedServiceAccounts)
+
+	newPipeline := func(email string) *Pipeline {
+		return &Pipeline{
+			Organization: org1,
+			Name:         "pipeline01",
+			ProjectID:    proj,
+			Zone:         "us-central1-f",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/google-containers/global/images/gci-stable-55-8872-76-0",
+			},
+			MachineType:   "f1-micro",
+			TargetSize:    1,
+			ContainerSize: 1,
+			ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+			ServiceAccount: ServiceAccount{
+				Email:  email,
+				Scopes: []string{"pubsub", "https://www.googleapis.com/auth/devstorage.read_only"},
+			},
+		}
+	}
+
+	for _, email := range []string{"", "default", "worker@dummy-proj-999.iam.gserviceaccount.com"} {
+		pl := newPipeline(email)
+		err = pl.Create(ctx)
+		assert.NoError(t, err, email)
+	}
+
+	pl := newPipeline("other@dummy-proj-999.iam.gserviceaccount.com")
+	err = pl.Create(ctx)
+	_, ok := err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	pl = newPipeline("invalid email")
+	err = pl.Create(ctx)
+	assert.Error(t, err)
+
+	pl = newPipeline("")
+	pl.ServiceAccount.Scopes = []string{"https://example.com/scope"}
+	err = pl.Create(ctx)
+	assert.Error(t, err)
+
+	// The workers can't pull jobs without pubsub or cloud-platform
+	pl = newPipeline("")
+	pl.ServiceAccount.Scopes = []string{"devstorage.read_only", "logging.write"}
+	err = pl.Create(ctx)
+	assert.Error(t, err)
+
+	pl = newPipeline("")
+	pl.ServiceAccount.Scopes = []string{"devstorage.read_only", "https://www.googleapis.com/auth/cloud-platform"}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"golang.org/x/oauth2/google"
 
@@ -9,34 +11,104 @@ import (
 	"google.golang.org/appengine/log"
 )
 
+// Publisher publishes the messages to the topic and returns their message IDs
+// in the same order as the messages.
+// When it fails on the way, it returns the IDs of the messages published before the error.
 type Publisher interface {
-	Publish(ctx context.Context, topic string, req *pubsub.PublishRequest) (string, error)
+	Publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) ([]string, error)
 }
 
-type PubsubPublisher struct{}
+// https://cloud.google.com/pubsub/quotas#resource_limits
+const (
+	PubsubMaxMessagesPerPublish = 1000
+	PubsubMaxBytesPerPublish    = 10 * 1000 * 1000
+	pubsubMessageOverheadBytes  = 64 // For JSON keys and punctuations
+)
+
+// PubsubMessageSize returns the estimated size of msg in a PublishRequest.
+func PubsubMessageSize(msg *pubsub.PubsubMessage) int {
+	size := len(msg.Data) + pubsubMessageOverheadBytes
+	for k, v := range msg.Attributes {
+		size += len(k) + len(v) + 6
+	}
+	return size
+}
+
+// SplitPubsubMessages splits msgs into batches which fit in maxCount messages and maxBytes.
+// A message larger than maxBytes is put in a batch alone and Pub/Sub rejects it.
+func SplitPubsubMessages(msgs []*pubsub.PubsubMessage, maxCount, maxBytes int) [][]*pubsub.PubsubMessage {
+	res := [][]*pubsub.PubsubMessage{}
+	batch := []*pubsub.PubsubMessage{}
+	bytes := 0
+	for _, msg := range msgs {
+		size := PubsubMessageSize(msg)
+		if len(batch) > 0 && (len(batch) >= maxCount || bytes+size > maxBytes) {
+			res = append(res, batch)
+			batch = []*pubsub.PubsubMessage{}
+			bytes = 0
+		}
+		batch = append(batch, msg)
+		bytes += size
+	}
+	if len(batch) > 0 {
+		res = append(res, batch)
+	}
+	return res
+}
+
+type PubsubPublisher struct {
+	mutex   sync.Mutex
+	service *pubsub.Service
+}
+
+// Service returns the pubsub.Service which is created at the first call and reused after that.
+func (p *PubsubPublisher) Service(ctx context.Context) (*pubsub.Service, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.service != nil {
+		return p.service, nil
+	}
 
-func (p *PubsubPublisher) Publish(ctx context.Context, topic string, req *pubsub.PublishRequest) (string, error) {
 	// https://developers.google.com/identity/protocols/application-default-credentials#callinggo
 	client, err := google.DefaultClient(ctx, pubsub.PubsubScope)
 	if err != nil {
 		log.Criticalf(ctx, "Failed to get google.DefaultClient for pubsub scope because of %v\n", err)
-		return "", err
+		return nil, err
 	}
 
 	service, err := pubsub.New(client)
 	if err != nil {
 		log.Criticalf(ctx, "Failed to create pubsub.Service: %v\n", err)
-		return "", err
+		return nil, err
 	}
+	p.service = service
+	return service, nil
+}
 
-	call := service.Projects.Topics.Publish(topic, req)
-	res, err := call.Do()
+func (p *PubsubPublisher) Publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) ([]string, error) {
+	service, err := p.Service(ctx)
 	if err != nil {
-		log.Errorf(ctx, "Publish error: %v\n", err)
-		return "", err
+		return nil, err
+	}
+
+	msgIds := []string{}
+	for _, batch := range SplitPubsubMessages(msgs, PubsubMaxMessagesPerPublish, PubsubMaxBytesPerPublish) {
+		req := &pubsub.PublishRequest{Messages: batch}
+		res, err := service.Projects.Topics.Publish(topic, req).Context(ctx).Do()
+		if err != nil {
+			log.Errorf(ctx, "Publish error: %v\n", err)
+			return msgIds, err
+		}
+		if len(res.MessageIds) != len(batch) {
+			err := fmt.Errorf("Publish returned %d message IDs for %d messages", len(res.MessageIds), len(batch))
+			log.Errorf(ctx, "Publish error: %v\n", err)
+			return msgIds, err
+		}
+		msgIds = append(msgIds, res.MessageIds...)
 	}
 
-	return res.MessageIds[0], nil
+	return msgIds, nil
 }
 
 var GlobalPublisher Publisher = &PubsubPublisher{}
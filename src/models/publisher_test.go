@@ -0,0 +1,49 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+func TestSplitPubsubMessages(t *testing.T) {
+	newMsg := func(dataSize int) *pubsub.PubsubMessage {
+		return &pubsub.PubsubMessage{
+			Attributes: map[string]string{"foo": "bar"},
+			Data:       strings.Repeat("a", dataSize),
+		}
+	}
+	msgSize := PubsubMessageSize(newMsg(100))
+
+	type Pattern struct {
+		dataSizes []int
+		maxCount  int
+		maxBytes  int
+		expected  []int
+	}
+
+	patterns := []Pattern{
+		{[]int{}, 3, 10000, []int{}},
+		{[]int{100, 100, 100}, 3, 10000, []int{3}},
+		{[]int{100, 100, 100, 100, 100, 100, 100}, 3, 10000, []int{3, 3, 1}},
+		{[]int{100, 100, 100, 100}, 10, msgSize * 2, []int{2, 2}},
+		{[]int{100, 100, 100, 100}, 10, msgSize*2 - 1, []int{1, 1, 1, 1}},
+		// Too large message is put in a batch alone
+		{[]int{100, msgSize * 3, 100}, 10, msgSize * 2, []int{1, 1, 1}},
+	}
+
+	for _, ptn := range patterns {
+		msgs := []*pubsub.PubsubMessage{}
+		for _, size := range ptn.dataSizes {
+			msgs = append(msgs, newMsg(size))
+		}
+		batches := SplitPubsubMessages(msgs, ptn.maxCount, ptn.maxBytes)
+		sizes := []int{}
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+		}
+		assert.Equal(t, ptn.expected, sizes, "pattern: %v", ptn)
+	}
+}
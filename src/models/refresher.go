@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	DefaultRefreshBuildingTimeout   = 30 * time.Minute
+	DefaultRefreshSubscribeTimeout  = 10 * time.Minute
+	DefaultDriftCheckInterval       = 5 * time.Minute
+	DefaultRefreshPublishingTimeout = 10 * time.Minute
+
+	// MaxBuildReposts is the max number of build_task posted again for a pipeline.
+	MaxBuildReposts = 3
+)
+
+// RefreshConfig has the thresholds for Refresher to regard a pipeline as stuck.
+type RefreshConfig struct {
+	// A pipeline Building longer than BuildingTimeout is built again.
+	BuildingTimeout time.Duration `json:"building_timeout"`
+	// A subscribe_task chain without heartbeat longer than SubscribeTimeout is regarded as lost.
+	SubscribeTimeout time.Duration `json:"subscribe_timeout"`
+	// The actual size of the instance group is checked every DriftCheckInterval.
+	DriftCheckInterval time.Duration `json:"drift_check_interval"`
+	// A job Publishing longer than PublishingTimeout gets back to Ready to be published again.
+	PublishingTimeout time.Duration `json:"publishing_timeout"`
+}
+
+// RefreshConfigFromEnv returns the config by REFRESH_BUILDING_TIMEOUT, REFRESH_SUBSCRIBE_TIMEOUT,
+// REFRESH_DRIFT_CHECK_INTERVAL and REFRESH_PUBLISHING_TIMEOUT in seconds.
+func RefreshConfigFromEnv() *RefreshConfig {
+	return &RefreshConfig{
+		BuildingTimeout:    getSecondsFromEnv("REFRESH_BUILDING_TIMEOUT", DefaultRefreshBuildingTimeout),
+		SubscribeTimeout:   getSecondsFromEnv("REFRESH_SUBSCRIBE_TIMEOUT", DefaultRefreshSubscribeTimeout),
+		DriftCheckInterval: getSecondsFromEnv("REFRESH_DRIFT_CHECK_INTERVAL", DefaultDriftCheckInterval),
+		PublishingTimeout:  getSecondsFromEnv("REFRESH_PUBLISHING_TIMEOUT", DefaultRefreshPublishingTimeout),
+	}
+}
+
+func getSecondsFromEnv(name string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 1 {
+		return defaultValue
+	}
+	return time.Duration(i) * time.Second
+}
+
+// Conditions detected by Refresher
+const (
+	RefreshBuildingTimeout         = "building_timeout"
+	RefreshPullingTaskSizeMismatch = "pulling_task_size_mismatch"
+	RefreshNoSubscribeLoop         = "no_subscribe_loop"
+	RefreshPublishingTimeout       = "publishing_timeout"
+)
+
+// RefreshLog is the audit log of a repair by Refresher.
+type RefreshLog struct {
+	ID           string    `json:"id"            datastore:"-"`
+	PipelineID   string    `json:"pipeline_id"`
+	PipelineName string    `json:"pipeline_name" datastore:",noindex"`
+	Status       Status    `json:"status"        datastore:",noindex"`
+	Condition    string    `json:"condition"`
+	Action       string    `json:"action"`
+	Detail       string    `json:"detail"        datastore:",noindex"`
+	Error        string    `json:"error,omitempty" datastore:",noindex"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RefreshLogsFor returns the audit logs of the pipeline from the latest.
+func RefreshLogsFor(ctx context.Context, pl *Pipeline, limit int) ([]*RefreshLog, error) {
+	q := datastore.NewQuery("RefreshLogs").Filter("PipelineID =", pl.ID).Order("-CreatedAt")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	res := []*RefreshLog{}
+	keys, err := q.GetAll(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range res {
+		l.ID = keys[i].Encode()
+	}
+	return res, nil
+}
+
+// Refresher repairs the pipelines wedged by the lost tasks.
+//   - Building longer than BuildingTimeout: posts build_task again with backoff up to MaxBuildReposts
+//   - PullingTaskSize different from the live subscribe_task chains: corrects PullingTaskSize
+//   - Opened or Paused with working jobs but no live subscribe_task chain: starts subscribe_task
+//   - Jobs Publishing longer than PublishingTimeout: gets them back to Ready and posts publish_task if Opened
+//
+// It also posts check_instance_size_task every DriftCheckInterval to detect the drift of
+// the instance group size. It isn't recorded in the audit log because it's not a repair.
+type Refresher struct {
+	Config *RefreshConfig
+	// PostTask posts the task like build_task for the pipeline.
+	PostTask func(pl *Pipeline, action string) error
+}
+
+// Process refreshes the pipelines and returns the audit logs of the repairs.
+// The failure of a repair is recorded in the log and the other pipelines are still processed.
+func (r *Refresher) Process(ctx context.Context, now time.Time) ([]*RefreshLog, error) {
+	res := []*RefreshLog{}
+
+	building, err := GlobalPipelineAccessor.GetByStatus(ctx, Building)
+	if err != nil {
+		return nil, err
+	}
+	for _, pl := range building {
+		if l := r.refreshBuilding(ctx, pl, now); l != nil {
+			res = append(res, l)
+		}
+	}
+
+	for _, st := range []Status{Opened, Paused} {
+		pipelines, err := GlobalPipelineAccessor.GetByStatus(ctx, st)
+		if err != nil {
+			return nil, err
+		}
+		for _, pl := range pipelines {
+			if l := r.refreshPublishing(ctx, pl, now); l != nil {
+				res = append(res, l)
+			}
+			logs, err := r.refreshSubscribing(ctx, pl, now)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, logs...)
+			if pl.InstanceSizeCheckDue(now, r.Config.DriftCheckInterval) {
+				if err := r.PostTask(pl, "check_instance_size_task"); err != nil {
+					log.Warningf(ctx, "Failed to post check_instance_size_task for %v because of %v\n", pl.ID, err)
+				}
+			}
+		}
+	}
+
+	deleted, err := DeleteStaleSubscribeHeartbeats(ctx, now.Add(-r.Config.SubscribeTimeout))
+	if err != nil {
+		log.Warningf(ctx, "Failed to delete stale SubscribeHeartbeats because of %v\n", err)
+	} else if deleted > 0 {
+		log.Infof(ctx, "%d stale SubscribeHeartbeats deleted\n", deleted)
+	}
+	return res, nil
+}
+
+// refreshBuilding posts build_task again with the exponential backoff from BuildingTimeout.
+// The pipeline gets Broken after MaxBuildReposts.
+func (r *Refresher) refreshBuilding(ctx context.Context, pl *Pipeline, now time.Time) *RefreshLog {
+	since := pl.UpdatedAt
+	if pl.BuildRepostedAt.After(since) {
+		since = pl.BuildRepostedAt
+	}
+	d := now.Sub(since)
+	if d < r.Config.BuildingTimeout<<uint(pl.BuildReposts) {
+		return nil
+	}
+	detail := fmt.Sprintf("Building since %v (%v) after %d reposts", since, d, pl.BuildReposts)
+	if pl.BuildReposts >= MaxBuildReposts {
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := pl.Reload(ctx); err != nil {
+				return err
+			}
+			return pl.FailBuilding(ctx)
+		}, GetTransactionOptions())
+		return r.record(ctx, pl, now, RefreshBuildingTimeout, "fail_building", detail, err)
+	}
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := pl.Reload(ctx); err != nil {
+			return err
+		}
+		pl.BuildReposts++
+		pl.BuildRepostedAt = now
+		if err := pl.Update(ctx); err != nil {
+			return err
+		}
+		return r.PostTask(pl, "build_task")
+	}, GetTransactionOptions())
+	return r.record(ctx, pl, now, RefreshBuildingTimeout, "build_task", detail, err)
+}
+
+// refreshPublishing gets the jobs left Publishing back to Ready.
+// publish_task of a Paused pipeline is posted when it's resumed.
+func (r *Refresher) refreshPublishing(ctx context.Context, pl *Pipeline, now time.Time) *RefreshLog {
+	recovered, err := pl.RecoverPublishingJobs(ctx, now.Add(-r.Config.PublishingTimeout))
+	if err == nil && recovered == 0 {
+		return nil
+	}
+	action := "ready"
+	if err == nil && pl.Status == Opened {
+		action = "publish_task"
+		err = r.PostTask(pl, "publish_task")
+	}
+	detail := fmt.Sprintf("%d jobs were Publishing longer than %v", recovered, r.Config.PublishingTimeout)
+	return r.record(ctx, pl, now, RefreshPublishingTimeout, action, detail, err)
+}
+
+func (r *Refresher) refreshSubscribing(ctx context.Context, pl *Pipeline, now time.Time) ([]*RefreshLog, error) {
+	res := []*RefreshLog{}
+	if now.Sub(pl.UpdatedAt) < r.Config.SubscribeTimeout {
+		// The subscribe_task chains may not have started yet
+		return res, nil
+	}
+	live, err := pl.LiveSubscribeChains(ctx, now.Add(-r.Config.SubscribeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if live != pl.PullingTaskSize {
+		detail := fmt.Sprintf("PullingTaskSize was %d but %d subscribe_task chains are alive", pl.PullingTaskSize, live)
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := pl.Reload(ctx); err != nil {
+				return err
+			}
+			pl.PullingTaskSize = live
+			return pl.Update(ctx)
+		}, GetTransactionOptions())
+		res = append(res, r.record(ctx, pl, now, RefreshPullingTaskSizeMismatch, "update_pulling_task_size", detail, err))
+		if err != nil {
+			return res, nil
+		}
+	}
+
+	if live == 0 {
+		jobCount, err := pl.JobCount(ctx, Publishing, Published, Executing)
+		if err != nil {
+			return nil, err
+		}
+		if jobCount == 0 {
+			// No subscribe_task is needed until a job is published
+			return res, nil
+		}
+		started := 0
+		err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			return pl.CalcAndUpdatePullingTaskSize(ctx, jobCount, func(newTasks int) error {
+				for i := 0; i < newTasks; i++ {
+					if err := r.PostTask(pl, "subscribe_task"); err != nil {
+						return err
+					}
+					started++
+				}
+				return nil
+			})
+		}, GetTransactionOptions())
+		detail := fmt.Sprintf("%d jobs are working without subscribe_task. %d subscribe_task started", jobCount, started)
+		res = append(res, r.record(ctx, pl, now, RefreshNoSubscribeLoop, "subscribe_task", detail, err))
+	}
+	return res, nil
+}
+
+func (r *Refresher) record(ctx context.Context, pl *Pipeline, now time.Time, condition, action, detail string, err error) *RefreshLog {
+	l := &RefreshLog{
+		PipelineID:   pl.ID,
+		PipelineName: pl.Name,
+		Status:       pl.Status,
+		Condition:    condition,
+		Action:       action,
+		Detail:       detail,
+		CreatedAt:    now,
+	}
+	if err != nil {
+		l.Error = err.Error()
+		log.Errorf(ctx, "Failed to refresh pipeline %v for %v by %v because of %v\n", pl.ID, condition, action, err)
+	} else {
+		log.Warningf(ctx, "Refreshed pipeline %v for %v by %v: %v\n", pl.ID, condition, action, detail)
+	}
+	key, putErr := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "RefreshLogs", nil), l)
+	if putErr != nil {
+		log.Errorf(ctx, "Failed to put RefreshLog %v because of %v\n", l, putErr)
+		return l
+	}
+	l.ID = key.Encode()
+	return l
+}
@@ -2,13 +2,18 @@ package models
 
 import (
 	"context"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/deploymentmanager/v2"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
 	//"google.golang.org/appengine/log"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
 )
 
 type TestDeployerRunning struct{}
@@ -23,6 +28,9 @@ func (d *TestDeployerRunning) Get(ctx context.Context, project string, deploymen
 	ope, _ := d.GetOperation(ctx, project, "")
 	return &deploymentmanager.Deployment{Operation: ope}, nil
 }
+func (d *TestDeployerRunning) Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	return nil, nil
+}
 func (d *TestDeployerRunning) GetOperation(ctx context.Context, project string, operation string) (*deploymentmanager.Operation, error) {
 	return &deploymentmanager.Operation{Status: "RUNNING"}, nil
 }
@@ -39,6 +47,9 @@ func (d *TestDeployerOK) Get(ctx context.Context, project string, deployment str
 	ope, _ := d.GetOperation(ctx, project, "")
 	return &deploymentmanager.Deployment{Operation: ope}, nil
 }
+func (d *TestDeployerOK) Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	return nil, nil
+}
 func (d *TestDeployerOK) GetOperation(ctx context.Context, project string, operation string) (*deploymentmanager.Operation, error) {
 	return &deploymentmanager.Operation{
 		Status: "DONE",
@@ -58,6 +69,9 @@ func (d *TestDeployerError) Get(ctx context.Context, project string, deployment
 	ope, _ := d.GetOperation(ctx, project, "")
 	return &deploymentmanager.Deployment{Operation: ope}, nil
 }
+func (d *TestDeployerError) Update(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	return nil, nil
+}
 func (d *TestDeployerError) GetOperation(ctx context.Context, project string, operation string) (*deploymentmanager.Operation, error) {
 	return &deploymentmanager.Operation{
 		Status: "DONE",
@@ -73,6 +87,87 @@ func (d *TestDeployerError) GetOperation(ctx context.Context, project string, op
 	}, nil
 }
 
+// TestDeployerConflict has the deployment inserted by the previous build_task.
+type TestDeployerConflict struct {
+	TestDeployerRunning
+	Labels []*deploymentmanager.DeploymentLabelEntry
+}
+
+func (d *TestDeployerConflict) Insert(ctx context.Context, project string, deployment *deploymentmanager.Deployment) (*deploymentmanager.Operation, error) {
+	return nil, &googleapi.Error{Code: http.StatusConflict, Message: "already exists"}
+}
+func (d *TestDeployerConflict) Get(ctx context.Context, project string, deployment string) (*deploymentmanager.Deployment, error) {
+	return &deploymentmanager.Deployment{
+		Name:      deployment,
+		Labels:    d.Labels,
+		Operation: &deploymentmanager.Operation{Name: "ope-existing", OperationType: "insert", Status: "RUNNING"},
+	}, nil
+}
+
+func TestBuilderProcessWithExistingDeployment(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"PipelineOperations", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org01", TokenAmount: 10}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	// Building since the build_task failed after inserting the deployment
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline01",
+		ProjectID:    proj,
+		Zone:         "us-central1-f",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/google-containers/global/images/gci-stable-55-8872-76-0",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Building,
+	}
+	assert.NoError(t, pl.Create(ctx))
+	other := *pl
+	assert.NoError(t, other.Create(ctx))
+
+	// The deployment of pl is found by the other pipeline with the same name
+	builder := &Builder{deployer: &TestDeployerConflict{
+		Labels: []*deploymentmanager.DeploymentLabelEntry{{Key: PipelineIDLabel, Value: LabelValueOfID(pl.ID)}},
+	}}
+	_, err = builder.Process(ctx, &other)
+	_, ok := err.(*InvalidOperation)
+	assert.True(t, ok)
+	reloaded, err := GlobalPipelineAccessor.Find(ctx, other.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Broken, reloaded.Status)
+
+	ope, err := builder.Process(ctx, pl)
+	assert.NoError(t, err)
+	if assert.NotNil(t, ope) {
+		assert.Equal(t, "ope-existing", ope.Name)
+		assert.Equal(t, "insert", ope.OperationType)
+	}
+
+	reloaded, err = GlobalPipelineAccessor.Find(ctx, pl.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Deploying, reloaded.Status)
+	assert.Equal(t, pl.Name, reloaded.DeploymentName)
+}
+
 func TestRefresherProcessForDeploying(t *testing.T) {
 	opt := &aetest.Options{StronglyConsistentDatastore: true}
 	inst, err := aetest.NewInstance(opt)
@@ -283,3 +378,140 @@ func TestRefresherProcessForClosing(t *testing.T) {
 		}
 	}
 }
+
+func TestRefresherProcess(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"RefreshLogs", "SubscribeHeartbeats", "Jobs", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org01", TokenAmount: 10}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	newPipeline := func(name string, st Status, pullingTaskSize int) *Pipeline {
+		pl := &Pipeline{
+			Organization: org1,
+			Name:         name,
+			ProjectID:    proj,
+			Zone:         "us-central1-f",
+			BootDisk: PipelineVmDisk{
+				SourceImage: "https://www.googleapis.com/compute/v1/projects/google-containers/global/images/gci-stable-55-8872-76-0",
+			},
+			MachineType:     "f1-micro",
+			TargetSize:      1,
+			ContainerSize:   1,
+			ContainerName:   "groovenauts/batch_type_iot_example:0.3.1",
+			Status:          st,
+			PullingTaskSize: pullingTaskSize,
+		}
+		assert.NoError(t, pl.Create(ctx))
+		return pl
+	}
+
+	building := newPipeline("building", Building, 0)
+	// 2 chains counted but 1 chain alive
+	lost := newPipeline("lost", Opened, 2)
+	// 1 chain counted but no chain alive with a working job
+	noLoop := newPipeline("no-loop", Opened, 1)
+	// No job and no chain
+	idle := newPipeline("idle", Opened, 0)
+
+	job := &Job{Pipeline: noLoop, IdByClient: "job1", Status: Published}
+	assert.NoError(t, job.Create(ctx))
+
+	now := time.Now().Add(time.Hour)
+	assert.NoError(t, lost.BeatSubscribe(ctx, "chain1", now.Add(-time.Minute)))
+	assert.NoError(t, lost.BeatSubscribe(ctx, "chain2", now.Add(-time.Hour)))
+
+	posted := map[string][]string{}
+	refresher := &Refresher{
+		Config: &RefreshConfig{
+			BuildingTimeout:    30 * time.Minute,
+			SubscribeTimeout:   10 * time.Minute,
+			DriftCheckInterval: 5 * time.Minute,
+			PublishingTimeout:  10 * time.Minute,
+		},
+		PostTask: func(pl *Pipeline, action string) error {
+			posted[pl.Name] = append(posted[pl.Name], action)
+			return nil
+		},
+	}
+	logs, err := refresher.Process(ctx, now)
+	assert.NoError(t, err)
+
+	conditions := map[string][]string{}
+	for _, l := range logs {
+		assert.Empty(t, l.Error)
+		conditions[l.PipelineName] = append(conditions[l.PipelineName], l.Condition)
+	}
+	assert.Equal(t, map[string][]string{
+		"building": []string{RefreshBuildingTimeout},
+		"lost":     []string{RefreshPullingTaskSizeMismatch},
+		"no-loop":  []string{RefreshPullingTaskSizeMismatch, RefreshNoSubscribeLoop},
+	}, conditions)
+	assert.Equal(t, map[string][]string{
+		"building": []string{"build_task"},
+		"lost":     []string{"check_instance_size_task"},
+		"no-loop":  []string{"subscribe_task", "check_instance_size_task"},
+		"idle":     []string{"check_instance_size_task"},
+	}, posted)
+
+	for _, ptn := range []struct {
+		pl              *Pipeline
+		pullingTaskSize int
+	}{
+		{building, 0},
+		{lost, 1},
+		{noLoop, 1},
+		{idle, 0},
+	} {
+		pl, err := GlobalPipelineAccessor.Find(ctx, ptn.pl.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, ptn.pullingTaskSize, pl.PullingTaskSize, pl.Name)
+	}
+
+	stored, err := RefreshLogsFor(ctx, noLoop, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(stored))
+
+	// The stale heartbeat is deleted
+	live, err := lost.LiveSubscribeChains(ctx, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, live)
+
+	// build_task is posted again with backoff and the pipeline gets Broken at last
+	refresher.Config.SubscribeTimeout = 100 * time.Hour
+	refresher.Config.DriftCheckInterval = 100 * time.Hour
+	for i, ptn := range []struct {
+		after   time.Duration
+		reposts int
+		status  Status
+	}{
+		{59 * time.Minute, 1, Building},
+		{60 * time.Minute, 2, Building},
+		{119 * time.Minute, 2, Building},
+		{120 * time.Minute, 3, Building},
+		{240 * time.Minute, 3, Broken},
+	} {
+		reloaded, err := GlobalPipelineAccessor.Find(ctx, building.ID)
+		assert.NoError(t, err)
+		_, err = refresher.Process(ctx, reloaded.BuildRepostedAt.Add(ptn.after))
+		assert.NoError(t, err)
+		reloaded, err = GlobalPipelineAccessor.Find(ctx, building.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, ptn.reposts, reloaded.BuildReposts, "patterns[%d]", i)
+		assert.Equal(t, ptn.status, reloaded.Status, "patterns[%d]", i)
+	}
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	RetryPolicy struct {
+		MaxAttempts            int      `json:"max_attempts,omitempty"             validate:"min=0"`
+		InitialIntervalSeconds int      `json:"initial_interval_seconds,omitempty" validate:"min=0"`
+		MaxIntervalSeconds     int      `json:"max_interval_seconds,omitempty"     validate:"min=0"`
+		RetryableSteps         []string `json:"retryable_steps,omitempty"`
+	}
+
+	JobAttempt struct {
+		Number      int       `json:"number"`
+		MessageID   string    `json:"message_id"`
+		Zone        string    `json:"zone"`
+		Hostname    string    `json:"hostname"`
+		FailedStep  string    `json:"failed_step"`
+		Reason      string    `json:"reason,omitempty"`
+		PublishedAt time.Time `json:"published_at"`
+		StartTime   string    `json:"start_time"`
+		FinishTime  string    `json:"finish_time"`
+		FinishedAt  time.Time `json:"finished_at"`
+	}
+)
+
+// Enabled returns true when the policy allows at least one retry.
+func (p *RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+func (p *RetryPolicy) Validate() error {
+	for _, s := range p.RetryableSteps {
+		if _, err := ParseJobStep(s); err != nil {
+			return fmt.Errorf("Invalid retryable_steps: %v", err)
+		}
+	}
+	return nil
+}
+
+// Retryable returns true when a job which failed at failedStep in the attempt
+// can be published again. An empty failedStep means the step is unknown.
+func (p *RetryPolicy) Retryable(attempt int, failedStep string) bool {
+	if !p.Enabled() || attempt >= p.MaxAttempts {
+		return false
+	}
+	if len(p.RetryableSteps) == 0 {
+		return true
+	}
+	for _, s := range p.RetryableSteps {
+		if s == failedStep {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the interval before publishing the attempt next to the given attempt.
+// The interval doubles for each attempt like with_backoff in the startup script.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	interval := p.InitialIntervalSeconds
+	for i := 1; i < attempt; i++ {
+		interval = interval * 2
+		if p.MaxIntervalSeconds > 0 && interval > p.MaxIntervalSeconds {
+			break
+		}
+	}
+	if p.MaxIntervalSeconds > 0 && interval > p.MaxIntervalSeconds {
+		interval = p.MaxIntervalSeconds
+	}
+	return time.Duration(interval) * time.Second
+}
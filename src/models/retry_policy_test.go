@@ -0,0 +1,167 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	type Pattern struct {
+		policy     RetryPolicy
+		attempt    int
+		failedStep string
+		expected   bool
+	}
+
+	patterns := []Pattern{
+		{RetryPolicy{}, 1, "EXECUTING", false},
+		{RetryPolicy{MaxAttempts: 1}, 1, "EXECUTING", false},
+		{RetryPolicy{MaxAttempts: 3}, 1, "EXECUTING", true},
+		{RetryPolicy{MaxAttempts: 3}, 2, "", true},
+		{RetryPolicy{MaxAttempts: 3}, 3, "EXECUTING", false},
+		{RetryPolicy{MaxAttempts: 3, RetryableSteps: []string{"DOWNLOADING"}}, 1, "DOWNLOADING", true},
+		{RetryPolicy{MaxAttempts: 3, RetryableSteps: []string{"DOWNLOADING"}}, 1, "EXECUTING", false},
+		{RetryPolicy{MaxAttempts: 3, RetryableSteps: []string{"DOWNLOADING"}}, 1, "", false},
+	}
+
+	for _, ptn := range patterns {
+		assert.Equal(t, ptn.expected, ptn.policy.Retryable(ptn.attempt, ptn.failedStep), "pattern: %v", ptn)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialIntervalSeconds: 10, MaxIntervalSeconds: 60}
+	assert.Equal(t, 10*time.Second, p.Backoff(1))
+	assert.Equal(t, 20*time.Second, p.Backoff(2))
+	assert.Equal(t, 40*time.Second, p.Backoff(3))
+	assert.Equal(t, 60*time.Second, p.Backoff(4))
+	assert.Equal(t, 60*time.Second, p.Backoff(9))
+
+	assert.Equal(t, time.Duration(0), (&RetryPolicy{MaxAttempts: 3}).Backoff(2))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&RetryPolicy{RetryableSteps: []string{"DOWNLOADING", "EXECUTING"}}).Validate())
+	assert.Error(t, (&RetryPolicy{RetryableSteps: []string{"EXECUTION"}}).Validate())
+}
+
+func TestJobPrepareRetryIfPossible(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	assert.NoError(t, err)
+	defer done()
+
+	pl := &Pipeline{RetryPolicy: RetryPolicy{MaxAttempts: 2}}
+	job := &Job{
+		Pipeline:   pl,
+		Status:     Failure,
+		Attempt:    1,
+		MessageID:  "msg-1",
+		Hostname:   "host-1",
+		FailedStep: "EXECUTING",
+	}
+
+	// Messages of the current attempt
+	assert.True(t, job.IsProgressOfCurrentAttempt(map[string]string{JobAttemptKey: "1"}, ""))
+	assert.True(t, job.IsProgressOfCurrentAttempt(map[string]string{}, time.Now().Format(time.RFC3339)))
+
+	assert.True(t, job.PrepareRetryIfPossible(ctx))
+	assert.Equal(t, Ready, job.Status)
+	assert.True(t, job.RetryAt.After(time.Now()))
+	assert.Equal(t, 2, job.Attempt)
+	assert.Empty(t, job.MessageID)
+	assert.Empty(t, job.FailedStep)
+	if assert.Equal(t, 1, len(job.AttemptHistory)) {
+		h := job.AttemptHistory[0]
+		assert.Equal(t, 1, h.Number)
+		assert.Equal(t, "msg-1", h.MessageID)
+		assert.Equal(t, "host-1", h.Hostname)
+		assert.Equal(t, "EXECUTING", h.FailedStep)
+	}
+
+	// Messages of the earlier attempt are ignored
+	assert.False(t, job.IsProgressOfCurrentAttempt(map[string]string{JobAttemptKey: "1"}, ""))
+	assert.True(t, job.IsProgressOfCurrentAttempt(map[string]string{JobAttemptKey: "2"}, ""))
+	past := job.AttemptHistory[0].FinishedAt.Add(-1 * time.Minute)
+	assert.False(t, job.IsProgressOfCurrentAttempt(map[string]string{}, past.Format(time.RFC3339)))
+
+	// No more attempt
+	job.Status = Failure
+	assert.False(t, job.PrepareRetryIfPossible(ctx))
+	assert.Equal(t, Failure, job.Status)
+
+	// The policy of the job overrides the pipeline's one
+	job = &Job{Pipeline: pl, Status: Failure, Attempt: 1, RetryPolicy: RetryPolicy{MaxAttempts: 1}}
+	assert.False(t, job.PrepareRetryIfPossible(ctx))
+}
+
+func TestHasWaitingJobPrioritizedOver(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Jobs", "Pipelines", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	create := func(idx, priority int, retryAt time.Time) *Job {
+		job := &Job{
+			Pipeline:   pl,
+			IdByClient: fmt.Sprintf("job-%v", idx),
+			Status:     Ready,
+			Priority:   priority,
+			RetryAt:    retryAt,
+		}
+		err := job.Create(ctx)
+		assert.NoError(t, err)
+		return job
+	}
+	low := create(1, 0, time.Time{})
+	backoff := create(2, 10, time.Now().Add(1*time.Hour))
+
+	// The job waiting for the backoff of its retry doesn't block lower priority jobs
+	deferred, err := pl.JobAccessor().HasWaitingJobPrioritizedOver(ctx, low)
+	assert.NoError(t, err)
+	assert.False(t, deferred)
+
+	backoff.RetryAt = time.Now().Add(-1 * time.Second)
+	err = backoff.Update(ctx)
+	assert.NoError(t, err)
+	deferred, err = pl.JobAccessor().HasWaitingJobPrioritizedOver(ctx, low)
+	assert.NoError(t, err)
+	assert.True(t, deferred)
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine/log"
+)
+
+// RollingUpdater replaces the instances of the pipeline with the current instance template.
+type RollingUpdater struct {
+	igServicer InstanceGroupServicer
+}
+
+func NewRollingUpdater(ctx context.Context) (*RollingUpdater, error) {
+	igServicer, err := DefaultInstanceGroupServicer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewRollingUpdaterWith(igServicer), nil
+}
+
+func NewRollingUpdaterWith(igServicer InstanceGroupServicer) *RollingUpdater {
+	return &RollingUpdater{igServicer: igServicer}
+}
+
+func WithRollingUpdater(ctx context.Context, f func(*RollingUpdater) error) error {
+	updater, err := NewRollingUpdater(ctx)
+	if err != nil {
+		return err
+	}
+	return f(updater)
+}
+
+func (u *RollingUpdater) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation, error) {
+	igm := pl.InstanceGroupManagerName()
+	ope, err := u.igServicer.StartRollingUpdate(pl.ProjectID, pl.Location(), igm, pl.InstanceTemplateUrl(), &pl.RollingUpdate)
+	if err != nil {
+		log.Errorf(ctx, "Failed to start rolling update of %v/%v/%v because of %v\n", pl.ProjectID, pl.Location(), igm, err)
+		return nil, err
+	}
+
+	operation := &PipelineOperation{
+		Pipeline:      pl,
+		ProjectID:     pl.ProjectID,
+		Zone:          pl.Location(),
+		Service:       "compute",
+		Name:          ope.Name,
+		OperationType: ope.OperationType,
+		Status:        ope.Status,
+		Logs: []OperationLog{
+			OperationLog{CreatedAt: time.Now(), Message: "Start replacing instances with " + pl.InstanceTemplateName()},
+		},
+	}
+	err = operation.Create(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to create PipelineOperation: %v because of %v\n", operation, err)
+		return nil, err
+	}
+	return operation, nil
+}
+
+// Stable returns true if all of the instances are replaced and running.
+func (u *RollingUpdater) Stable(ctx context.Context, pl *Pipeline) (bool, error) {
+	igm, err := u.igServicer.GetIgm(pl.ProjectID, pl.Location(), pl.InstanceGroupManagerName())
+	if err != nil {
+		log.Errorf(ctx, "Failed to get instance group manager of %v because of %v\n", pl.ID, err)
+		return false, err
+	}
+	st := igm.Status
+	if st == nil || !st.IsStable {
+		return false, nil
+	}
+	if st.VersionTarget != nil && !st.VersionTarget.IsReached {
+		return false, nil
+	}
+	return true, nil
+}
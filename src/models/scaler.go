@@ -2,11 +2,61 @@ package models
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 )
 
+type jobScalerJSON struct {
+	Enabled         bool `json:"enabled"`
+	MaxInstanceSize int  `json:"max_instance_size"`
+	MinInstanceSize *int `json:"min_instance_size,omitempty"`
+	ScaleInCooldown *int `json:"scale_in_cooldown,omitempty"` // seconds
+}
+
+func (s JobScaler) toJSON() *jobScalerJSON {
+	v := &jobScalerJSON{
+		Enabled:         s.Enabled,
+		MaxInstanceSize: s.MaxInstanceSize,
+	}
+	if s.MinInstanceSizeGiven || s.MinInstanceSize != 0 {
+		v.MinInstanceSize = &s.MinInstanceSize
+	}
+	if s.ScaleInCooldownGiven || s.ScaleInCooldown != 0 {
+		v.ScaleInCooldown = &s.ScaleInCooldown
+	}
+	return v
+}
+
+func (s JobScaler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toJSON())
+}
+
+// UnmarshalJSON overwrites only the given attributes like PipelineNetwork.
+// min_instance_size and scale_in_cooldown given as 0 are used instead of their defaults.
+func (s *JobScaler) UnmarshalJSON(data []byte) error {
+	v := s.toJSON()
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	s.Enabled = v.Enabled
+	s.MaxInstanceSize = v.MaxInstanceSize
+	if v.MinInstanceSize != nil {
+		s.MinInstanceSize = *v.MinInstanceSize
+		s.MinInstanceSizeGiven = true
+	}
+	if v.ScaleInCooldown != nil {
+		s.ScaleInCooldown = *v.ScaleInCooldown
+		s.ScaleInCooldownGiven = true
+	}
+	return nil
+}
+
 type Scaler struct {
 	igServicer InstanceGroupServicer
 }
@@ -37,17 +87,23 @@ func (s *Scaler) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation,
 		log.Errorf(ctx, "Failed to get workingJobCount of %v because of %v\n", pl.ID, err)
 		return nil, err
 	}
-	capacity := pl.InstanceSize * pl.ContainerSize
-	shortage := workingJobCount - capacity
-	if shortage < 1 {
-		log.Debugf(ctx, "Pipeline has enough %d instances for %d jobs\n", pl.InstanceSize, workingJobCount)
-		return nil, err
-	}
 	newInstanceSize := workingJobCount / pl.ContainerSize
 	if m := workingJobCount % pl.ContainerSize; m > 0 {
 		newInstanceSize += 1
 	}
 
+	switch {
+	case newInstanceSize > pl.InstanceSize:
+		return s.scaleOut(ctx, pl, newInstanceSize)
+	case newInstanceSize < pl.InstanceSize:
+		return s.scaleIn(ctx, pl, newInstanceSize)
+	default:
+		log.Debugf(ctx, "Pipeline has enough %d instances for %d jobs\n", pl.InstanceSize, workingJobCount)
+		return nil, nil
+	}
+}
+
+func (s *Scaler) scaleOut(ctx context.Context, pl *Pipeline, newInstanceSize int) (*PipelineOperation, error) {
 	if newInstanceSize > pl.JobScaler.MaxInstanceSize {
 		if pl.JobScaler.MaxInstanceSize > pl.InstanceSize {
 			log.Warningf(ctx, "Can't assign %d VMs but can assign %d VMs as max\n", newInstanceSize, pl.JobScaler.MaxInstanceSize)
@@ -57,33 +113,110 @@ func (s *Scaler) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation,
 			return nil, nil
 		}
 	}
+	return s.resize(ctx, pl, newInstanceSize)
+}
+
+func (s *Scaler) scaleIn(ctx context.Context, pl *Pipeline, newInstanceSize int) (*PipelineOperation, error) {
+	minInstanceSize := pl.MinInstanceSize()
+	if newInstanceSize < minInstanceSize {
+		newInstanceSize = minInstanceSize
+	}
 
-	ope, err := s.igServicer.Resize(pl.ProjectID, pl.Zone, pl.DeploymentName+"-igm", int64(newInstanceSize))
+	// Don't remove the hosts which are executing jobs
+	hosts, err := pl.JobAccessor().ExecutingHosts(ctx)
 	if err != nil {
-		log.Errorf(ctx, "Failed to Resize %v/%v/%v to %d\n", pl.ProjectID, pl.Zone, pl.DeploymentName, newInstanceSize)
+		log.Errorf(ctx, "Failed to get ExecutingHosts of %v because of %v\n", pl.ID, err)
 		return nil, err
 	}
+	hostCount := len(hosts)
+	if newInstanceSize < hostCount {
+		newInstanceSize = hostCount
+	}
 
+	if newInstanceSize >= pl.InstanceSize {
+		log.Debugf(ctx, "Quit decreasing instances from %d because of MinInstanceSize %d and %d executing hosts\n", pl.InstanceSize, minInstanceSize, hostCount)
+		return nil, nil
+	}
+
+	if !pl.ScaleInCooldownPassed(time.Now()) {
+		log.Debugf(ctx, "Quit decreasing instances to %d because the pipeline was scaled at %v\n", newInstanceSize, pl.LastScaledAt)
+		return nil, nil
+	}
+
+	return s.deleteIdleInstances(ctx, pl, pl.InstanceSize-newInstanceSize, hosts)
+}
+
+// deleteIdleInstances deletes the instances which aren't executing any job
+// because Resize of the instance group manager removes arbitrary instances.
+// A job which an instance starts just before the deletion is retried after
+// MaxExecutionSeconds like the other stuck jobs.
+func (s *Scaler) deleteIdleInstances(ctx context.Context, pl *Pipeline, count int, hosts map[string]bool) (*PipelineOperation, error) {
+	igm := pl.InstanceGroupManagerName()
+	urls, err := s.igServicer.ListInstances(pl.ProjectID, pl.Location(), igm)
+	if err != nil {
+		log.Errorf(ctx, "Failed to list instances of %v/%v/%v because of %v\n", pl.ProjectID, pl.Location(), igm, err)
+		return nil, err
+	}
+	idles := []string{}
+	for _, url := range urls {
+		if len(idles) >= count {
+			break
+		}
+		if !hosts[InstanceNameOf(url)] {
+			idles = append(idles, url)
+		}
+	}
+	if len(idles) == 0 {
+		log.Debugf(ctx, "Quit decreasing instances because all of %d instances are executing jobs\n", len(urls))
+		return nil, nil
+	}
+
+	ope, err := s.igServicer.DeleteInstances(pl.ProjectID, pl.Location(), igm, idles)
+	if err != nil {
+		log.Errorf(ctx, "Failed to delete instances %v of %v/%v/%v because of %v\n", idles, pl.ProjectID, pl.Location(), igm, err)
+		return nil, err
+	}
+	newInstanceSize := pl.InstanceSize - len(idles)
+	return s.recordOperation(ctx, pl, ope, newInstanceSize, fmt.Sprintf("Start deleting idle instances %v to resize from %d to %d", idles, pl.InstanceSize, newInstanceSize))
+}
+
+func (s *Scaler) resize(ctx context.Context, pl *Pipeline, newInstanceSize int) (*PipelineOperation, error) {
+	ope, err := s.igServicer.Resize(pl.ProjectID, pl.Location(), pl.DeploymentName+"-igm", int64(newInstanceSize))
+	if err != nil {
+		log.Errorf(ctx, "Failed to Resize %v/%v/%v to %d\n", pl.ProjectID, pl.Location(), pl.DeploymentName, newInstanceSize)
+		return nil, err
+	}
+	return s.recordOperation(ctx, pl, ope, newInstanceSize, fmt.Sprintf("Start resizing from %d to %d", pl.InstanceSize, newInstanceSize))
+}
+
+func (s *Scaler) recordOperation(ctx context.Context, pl *Pipeline, ope *compute.Operation, newInstanceSize int, msg string) (*PipelineOperation, error) {
 	operation := &PipelineOperation{
 		Pipeline:      pl,
 		ProjectID:     pl.ProjectID,
-		Zone:          pl.Zone,
+		Zone:          pl.Location(),
 		Service:       "compute",
 		Name:          ope.Name,
 		OperationType: ope.OperationType,
 		Status:        ope.Status,
 		Logs: []OperationLog{
-			OperationLog{CreatedAt: time.Now(), Message: "Start"},
+			OperationLog{CreatedAt: time.Now(), Message: msg},
 		},
 	}
-	err = operation.Create(ctx)
+	err := operation.Create(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Failed to create PipelineOperation: %v because of %v\n", operation, err)
 		return nil, err
 	}
 
-	pl.InstanceSize = newInstanceSize
-	err = pl.Update(ctx)
+	// Reload the pipeline not to overwrite the fields updated while calling the API
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := pl.Reload(ctx); err != nil {
+			return err
+		}
+		pl.InstanceSize = newInstanceSize
+		pl.LastScaledAt = time.Now()
+		return pl.Update(ctx)
+	}, GetTransactionOptions())
 	if err != nil {
 		log.Errorf(ctx, "Failed to update Pipeline InstanceSize : %v because of %v\n", pl, err)
 		return nil, err
@@ -91,3 +224,9 @@ func (s *Scaler) Process(ctx context.Context, pl *Pipeline) (*PipelineOperation,
 
 	return operation, nil
 }
+
+// InstanceNameOf returns the name of the instance from its URL.
+// It's the hostname which the workers report as Job.Hostname.
+func InstanceNameOf(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
+}
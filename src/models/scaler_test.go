@@ -0,0 +1,319 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+type DummyInstanceGroupServicer struct {
+	Sizes     []int64
+	Templates []string
+	IgSize    int64
+	Locations []string
+	Instances []string
+	Deleted   [][]string
+}
+
+func (s *DummyInstanceGroupServicer) GetIg(project, location, instanceGroup string) (*compute.InstanceGroup, error) {
+	return &compute.InstanceGroup{Name: instanceGroup, Size: s.IgSize}, nil
+}
+
+func (s *DummyInstanceGroupServicer) Resize(project, location, instanceGroupManager string, size int64) (*compute.Operation, error) {
+	s.Sizes = append(s.Sizes, size)
+	s.Locations = append(s.Locations, location)
+	return &compute.Operation{
+		Name:          fmt.Sprintf("operation-resize-%d", len(s.Sizes)),
+		OperationType: "compute.instanceGroupManagers.resize",
+		Status:        "RUNNING",
+	}, nil
+}
+
+func (s *DummyInstanceGroupServicer) GetOp(project, location, operation string) (*compute.Operation, error) {
+	return &compute.Operation{Name: operation, Status: "DONE"}, nil
+}
+
+func (s *DummyInstanceGroupServicer) GetIgm(project, location, instanceGroupManager string) (*compute.InstanceGroupManager, error) {
+	return &compute.InstanceGroupManager{
+		Name:   instanceGroupManager,
+		Status: &compute.InstanceGroupManagerStatus{IsStable: true},
+	}, nil
+}
+
+func (s *DummyInstanceGroupServicer) StartRollingUpdate(project, location, instanceGroupManager, instanceTemplate string, policy *RollingUpdatePolicy) (*compute.Operation, error) {
+	s.Templates = append(s.Templates, instanceTemplate)
+	return &compute.Operation{
+		Name:          fmt.Sprintf("operation-patch-%d", len(s.Templates)),
+		OperationType: "compute.instanceGroupManagers.patch",
+		Status:        "RUNNING",
+	}, nil
+}
+
+func (s *DummyInstanceGroupServicer) ListInstances(project, location, instanceGroupManager string) ([]string, error) {
+	r := []string{}
+	for _, name := range s.Instances {
+		r = append(r, ComputeAPIBaseURL+"projects/"+project+"/zones/"+location+"/instances/"+name)
+	}
+	return r, nil
+}
+
+func (s *DummyInstanceGroupServicer) DeleteInstances(project, location, instanceGroupManager string, instances []string) (*compute.Operation, error) {
+	s.Deleted = append(s.Deleted, instances)
+	return &compute.Operation{
+		Name:          fmt.Sprintf("operation-delete-instances-%d", len(s.Deleted)),
+		OperationType: "compute.instanceGroupManagers.deleteInstances",
+		Status:        "RUNNING",
+	}, nil
+}
+
+func TestScalerProcess(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Jobs", "Pipelines", "Organizations", "PipelineOperations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Zone:         "asia-northeast1-a",
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+		JobScaler: JobScaler{
+			Enabled:         true,
+			MaxInstanceSize: 4,
+			MinInstanceSize: 1,
+			ScaleInCooldown: 60,
+		},
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	jobs := Jobs{}
+	for i := 0; i < 3; i++ {
+		job := &Job{
+			Pipeline:   pl,
+			IdByClient: fmt.Sprintf("job-%v", i),
+			Status:     Executing,
+			Hostname:   fmt.Sprintf("host-%v", i),
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+		jobs = append(jobs, job)
+	}
+
+	servicer := &DummyInstanceGroupServicer{}
+	scaler := &Scaler{igServicer: servicer}
+
+	// Scale out
+	ope, err := scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.NotNil(t, ope)
+	assert.Equal(t, []int64{3}, servicer.Sizes)
+	assert.Equal(t, 3, pl.InstanceSize)
+
+	// Enough instances
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.Nil(t, ope)
+
+	// Don't scale in during the cooldown
+	jobs[0].Status = Success
+	err = jobs[0].Update(ctx)
+	assert.NoError(t, err)
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.Nil(t, ope)
+	assert.Equal(t, 3, pl.InstanceSize)
+
+	// Scale in after the cooldown by deleting the idle instance
+	servicer.Instances = []string{"host-0", "host-1", "host-2"}
+	pl.LastScaledAt = time.Now().Add(-61 * time.Second)
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.NotNil(t, ope)
+	assert.Equal(t, []int64{3}, servicer.Sizes)
+	if assert.Equal(t, 1, len(servicer.Deleted)) {
+		assert.Equal(t, []string{ComputeAPIBaseURL + "projects/dummy-proj-111/zones/asia-northeast1-a/instances/host-0"}, servicer.Deleted[0])
+	}
+	assert.Equal(t, 2, pl.InstanceSize)
+
+	// Don't shrink below the hosts which have Executing jobs
+	jobs[1].Status = Success
+	err = jobs[1].Update(ctx)
+	assert.NoError(t, err)
+	jobs[2].Status = Success
+	err = jobs[2].Update(ctx)
+	assert.NoError(t, err)
+	newJobs := Jobs{}
+	for i := 3; i < 5; i++ {
+		job := &Job{
+			Pipeline:   pl,
+			IdByClient: fmt.Sprintf("job-%v", i),
+			Status:     Executing,
+			Hostname:   fmt.Sprintf("host-%v", i),
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+		newJobs = append(newJobs, job)
+	}
+	// 2 jobs fit in 1 instance but they are executing on 2 hosts
+	servicer.Instances = []string{"host-3", "host-4"}
+	pl.ContainerSize = 2
+	pl.LastScaledAt = time.Now().Add(-61 * time.Second)
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.Nil(t, ope)
+	assert.Equal(t, 2, pl.InstanceSize)
+
+	newJobs[1].Status = Success
+	err = newJobs[1].Update(ctx)
+	assert.NoError(t, err)
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.NotNil(t, ope)
+	assert.Equal(t, []int64{3}, servicer.Sizes)
+	if assert.Equal(t, 2, len(servicer.Deleted)) {
+		assert.Equal(t, []string{ComputeAPIBaseURL + "projects/dummy-proj-111/zones/asia-northeast1-a/instances/host-4"}, servicer.Deleted[1])
+	}
+	assert.Equal(t, 1, pl.InstanceSize)
+
+	// Don't shrink below MinInstanceSize
+	newJobs[0].Status = Success
+	err = newJobs[0].Update(ctx)
+	assert.NoError(t, err)
+	pl.LastScaledAt = time.Now().Add(-61 * time.Second)
+	ope, err = scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	assert.Nil(t, ope)
+	assert.Equal(t, 1, pl.InstanceSize)
+
+	assert.False(t, pl.CanScaleIn())
+	assert.True(t, pl.CanScale())
+}
+
+func TestScalerProcessRegional(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Jobs", "Pipelines", "Organizations", "PipelineOperations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1"}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	pl := &Pipeline{
+		Organization: org1,
+		Name:         "pipeline1",
+		ProjectID:    "dummy-proj-111",
+		Region:       "asia-northeast1",
+		Zones:        []string{"asia-northeast1-a", "asia-northeast1-b"},
+		BootDisk: PipelineVmDisk{
+			SourceImage: "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable",
+		},
+		MachineType:   "f1-micro",
+		TargetSize:    1,
+		ContainerSize: 1,
+		ContainerName: "groovenauts/batch_type_iot_example:0.3.1",
+		Status:        Opened,
+		JobScaler: JobScaler{
+			Enabled:         true,
+			MaxInstanceSize: 4,
+		},
+	}
+	err = pl.Create(ctx)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		job := &Job{
+			Pipeline:   pl,
+			IdByClient: fmt.Sprintf("job-%v", i),
+			Status:     Executing,
+			Hostname:   fmt.Sprintf("host-%v", i),
+		}
+		err = job.Create(ctx)
+		assert.NoError(t, err)
+	}
+
+	servicer := &DummyInstanceGroupServicer{}
+	scaler := &Scaler{igServicer: servicer}
+
+	ope, err := scaler.Process(ctx, pl)
+	assert.NoError(t, err)
+	if assert.NotNil(t, ope) {
+		assert.Equal(t, "asia-northeast1", ope.Zone)
+	}
+	assert.Equal(t, []int64{2}, servicer.Sizes)
+	assert.Equal(t, []string{"asia-northeast1"}, servicer.Locations)
+}
+
+func TestJobScalerJSON(t *testing.T) {
+	now := time.Now()
+
+	// The defaults
+	pl := &Pipeline{TargetSize: 2, LastScaledAt: now}
+	err := json.Unmarshal([]byte(`{"job_scaler":{"enabled":true,"max_instance_size":3}}`), pl)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pl.MinInstanceSize())
+	assert.False(t, pl.ScaleInCooldownPassed(now.Add(time.Minute)))
+	b, err := json.Marshal(pl.JobScaler)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"enabled":true,"max_instance_size":3}`, string(b))
+
+	// 0 given explicitly
+	pl = &Pipeline{TargetSize: 2, LastScaledAt: now}
+	err = json.Unmarshal([]byte(`{"job_scaler":{"enabled":true,"max_instance_size":3,"min_instance_size":0,"scale_in_cooldown":0}}`), pl)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pl.MinInstanceSize())
+	assert.True(t, pl.ScaleInCooldownPassed(now.Add(time.Second)))
+	b, err = json.Marshal(pl.JobScaler)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"enabled":true,"max_instance_size":3,"min_instance_size":0,"scale_in_cooldown":0}`, string(b))
+
+	// Overwrite only the given attributes
+	err = json.Unmarshal([]byte(`{"job_scaler":{"enabled":true,"max_instance_size":4,"min_instance_size":1}}`), pl)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pl.MinInstanceSize())
+	assert.Equal(t, 4, pl.JobScaler.MaxInstanceSize)
+	assert.True(t, pl.JobScaler.ScaleInCooldownGiven)
+}
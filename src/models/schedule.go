@@ -0,0 +1,544 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	// CatchUpSkip runs only the run on time. The missed runs are recorded as skipped.
+	CatchUpSkip = "skip"
+	// CatchUpLatest runs the latest of the missed runs.
+	CatchUpLatest = "latest"
+	// CatchUpAll runs the missed runs up to MaxCatchUpRuns.
+	CatchUpAll = "all"
+)
+
+const (
+	DefaultMaxCatchUpRuns = 5
+	// ScheduleMaxRunsAtTick is the max number of the runs at a tick.
+	// It's the limit of the tasks added in a transaction by App Engine.
+	ScheduleMaxRunsAtTick = 5
+	// ScheduleMissedAfter is the delay after which a run is regarded as missed.
+	ScheduleMissedAfter = 5 * time.Minute
+	// ScheduleScanLimit is the max number of the runs handled at a tick.
+	ScheduleScanLimit = 100
+)
+
+var ScheduleNameRegexp = regexp.MustCompile(`\A[a-z][-a-z0-9]*\z`)
+
+// Schedule creates a pipeline from the template and its jobs at each time matching Cron in TimeZone.
+// Pipeline overrides the configuration of the template and the name of the pipeline is
+// the name of the schedule followed by the scheduled time like nightly-201801020300.
+type Schedule struct {
+	ID               string          `json:"id"                          datastore:"-"`
+	Organization     *Organization   `json:"-"                           validate:"required" datastore:"-"`
+	Name             string          `json:"name"                        validate:"required,max=40"`
+	Cron             string          `json:"cron"                        validate:"required"`
+	TimeZone         string          `json:"time_zone,omitempty"`
+	TemplateID       string          `json:"template_id"                 validate:"required"`
+	TemplateVersion  int             `json:"template_version,omitempty"  validate:"min=0"` // 0 means the current version
+	Pipeline         json.RawMessage `json:"pipeline,omitempty"          datastore:"-"`
+	PipelineBody     []byte          `json:"-"                           datastore:",noindex"`
+	Jobs             json.RawMessage `json:"jobs,omitempty"              datastore:"-"`
+	JobsBody         []byte          `json:"-"                           datastore:",noindex"`
+	JobGenerator     *JobGenerator   `json:"job_generator,omitempty"     datastore:"-"`
+	JobGeneratorBody []byte          `json:"-"                           datastore:",noindex"`
+	CatchUp          string          `json:"catch_up,omitempty"`
+	MaxCatchUpRuns   int             `json:"max_catch_up_runs,omitempty" validate:"min=0,max=5"` // Up to ScheduleMaxRunsAtTick
+	Disabled         bool            `json:"disabled"`
+	NextRunAt        time.Time       `json:"next_run_at"`
+	LastRunAt        time.Time       `json:"last_run_at,omitempty"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+}
+
+// JobGenerator generates Count jobs at each run.
+// %{index}, %{scheduled_at} and %{date} in IdByClient, Attributes and Data are replaced with
+// the index from 1, the scheduled time in RFC3339 and its date in the time zone of the schedule.
+type JobGenerator struct {
+	Count      int               `json:"count"                  validate:"min=1"`
+	IdByClient string            `json:"id_by_client,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Data       string            `json:"data,omitempty"`
+}
+
+const (
+	ScheduleRunRunning   = "running"
+	ScheduleRunSucceeded = "succeeded"
+	ScheduleRunFailed    = "failed"
+	ScheduleRunSkipped   = "skipped"
+)
+
+// ScheduleRun is the history of a run of the schedule.
+// It's stored as a child entity of the schedule with the scheduled time as its key.
+type ScheduleRun struct {
+	ScheduledAt time.Time `json:"scheduled_at"`
+	Status      string    `json:"status"`
+	PipelineID  string    `json:"pipeline_id,omitempty"`
+	JobCount    int       `json:"job_count"`
+	Error       string    `json:"error,omitempty"       datastore:",noindex"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	FinishedAt  time.Time `json:"finished_at,omitempty"`
+}
+
+func (m *Schedule) Location() (*time.Location, error) {
+	return time.LoadLocation(m.TimeZone)
+}
+
+func (m *Schedule) CronExpression() (*CronExpression, error) {
+	return ParseCronExpression(m.Cron)
+}
+
+// Next returns the first scheduled time after t.
+func (m *Schedule) Next(t time.Time) (time.Time, error) {
+	expr, err := m.CronExpression()
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := m.Location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expr.Next(t.In(loc)), nil
+}
+
+func (m *Schedule) Validate() error {
+	validator := validator.New()
+	err := validator.Struct(m)
+	if err != nil {
+		return &InvalidOperation{Msg: err.Error()}
+	}
+	if !ScheduleNameRegexp.MatchString(m.Name) {
+		return &InvalidOperation{Msg: fmt.Sprintf("Invalid schedule name: %q", m.Name)}
+	}
+	if _, err := m.Location(); err != nil {
+		return &InvalidOperation{Msg: fmt.Sprintf("Invalid time_zone: %v", err)}
+	}
+	next, err := m.Next(time.Now())
+	if err != nil {
+		return &InvalidOperation{Msg: err.Error()}
+	}
+	if next.IsZero() {
+		return &InvalidOperation{Msg: fmt.Sprintf("No time matches cron %q", m.Cron)}
+	}
+	switch m.CatchUp {
+	case "", CatchUpSkip, CatchUpLatest, CatchUpAll:
+	default:
+		return &InvalidOperation{Msg: fmt.Sprintf("Invalid catch_up: %q", m.CatchUp)}
+	}
+	if len(m.Pipeline) > 0 {
+		if err := json.Unmarshal(m.Pipeline, &Pipeline{}); err != nil {
+			return &InvalidOperation{Msg: fmt.Sprintf("Invalid pipeline of the schedule: %v", err)}
+		}
+	}
+	if len(m.Jobs) == 0 && m.JobGenerator == nil {
+		return &InvalidOperation{Msg: "No jobs nor job_generator given to the schedule"}
+	}
+	if len(m.Jobs) > 0 {
+		if err := json.Unmarshal(m.Jobs, &Jobs{}); err != nil {
+			return &InvalidOperation{Msg: fmt.Sprintf("Invalid jobs of the schedule: %v", err)}
+		}
+	}
+	if m.JobGenerator != nil {
+		if err := validator.Struct(m.JobGenerator); err != nil {
+			return &InvalidOperation{Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (m *Schedule) validateTemplate(ctx context.Context) error {
+	_, err := m.Organization.PipelineTemplateAccessor().Find(ctx, m.TemplateID)
+	if _, ok := err.(*InvalidParent); ok || err == ErrNoSuchPipelineTemplate {
+		return &InvalidOperation{Msg: fmt.Sprintf("No pipeline template found for %v", m.TemplateID)}
+	}
+	return err
+}
+
+func (m *Schedule) Create(ctx context.Context) error {
+	t := time.Now()
+	m.CreatedAt = t
+	m.UpdatedAt = t
+
+	if m.Organization == nil {
+		return fmt.Errorf("No organization to create Schedule: %v\n", m)
+	}
+	parentKey, err := datastore.DecodeKey(m.Organization.ID)
+	if err != nil {
+		return err
+	}
+	if err := m.prepareToPut(ctx, t); err != nil {
+		return err
+	}
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Schedules", parentKey), m)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put Schedule %v because of %v\n", m, err)
+		return err
+	}
+	m.ID = key.Encode()
+	return nil
+}
+
+// Update saves the schedule and calculates NextRunAt from now again.
+func (m *Schedule) Update(ctx context.Context) error {
+	t := time.Now()
+	m.UpdatedAt = t
+	if err := m.prepareToPut(ctx, t); err != nil {
+		return err
+	}
+	return m.put(ctx)
+}
+
+func (m *Schedule) prepareToPut(ctx context.Context, t time.Time) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := m.validateTemplate(ctx); err != nil {
+		return err
+	}
+	next, err := m.Next(t)
+	if err != nil {
+		return err
+	}
+	m.NextRunAt = next
+	m.PipelineBody = []byte(m.Pipeline)
+	m.JobsBody = []byte(m.Jobs)
+	m.JobGeneratorBody = nil
+	if m.JobGenerator != nil {
+		b, err := json.Marshal(m.JobGenerator)
+		if err != nil {
+			return err
+		}
+		m.JobGeneratorBody = b
+	}
+	return nil
+}
+
+func (m *Schedule) put(ctx context.Context) error {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(ctx, key, m)
+	if err != nil {
+		log.Errorf(ctx, "Failed to put Schedule %v because of %v\n", m, err)
+		return err
+	}
+	return nil
+}
+
+// Destroy deletes the schedule and its run history.
+// The pipelines created by the schedule aren't changed.
+func (m *Schedule) Destroy(ctx context.Context) error {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		keys, err := datastore.NewQuery("ScheduleRuns").Ancestor(key).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return datastore.DeleteMulti(ctx, keys)
+	}, GetTransactionOptions())
+}
+
+// DueRuns returns the scheduled times to run at now by the catch-up policy
+// and the missed times to skip. It advances NextRunAt to the first time after now.
+func (m *Schedule) DueRuns(now time.Time) (runs, skipped []time.Time, err error) {
+	due := []time.Time{}
+	t := m.NextRunAt
+	for !t.IsZero() && !t.After(now) && len(due) < ScheduleScanLimit {
+		due = append(due, t)
+		t, err = m.Next(t)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !t.IsZero() && !t.After(now) {
+		// Too many runs missed. The rest of them are ignored.
+		t, err = m.Next(now)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	m.NextRunAt = t
+	if len(due) == 0 {
+		return []time.Time{}, []time.Time{}, nil
+	}
+
+	last := len(due) - 1
+	switch m.CatchUp {
+	case CatchUpAll:
+		n := IntWithDefault(m.MaxCatchUpRuns, DefaultMaxCatchUpRuns)
+		if n > ScheduleMaxRunsAtTick {
+			// For the schedules saved before the limit
+			n = ScheduleMaxRunsAtTick
+		}
+		if len(due) > n {
+			return due[len(due)-n:], due[:len(due)-n], nil
+		}
+		return due, []time.Time{}, nil
+	case CatchUpLatest:
+		return due[last:], due[:last], nil
+	default:
+		if now.Sub(due[last]) > ScheduleMissedAfter {
+			return []time.Time{}, due, nil
+		}
+		return due[last:], due[:last], nil
+	}
+}
+
+// Tick advances the schedule at now in a transaction and records the skipped runs.
+// It returns the scheduled times to run. post is called with the times in the transaction
+// to add the tasks for them transactionally, so the runs aren't lost if adding the tasks fails.
+func (m *Schedule) Tick(ctx context.Context, now time.Time, post func(ctx context.Context, runs []time.Time) error) ([]time.Time, error) {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	var runs []time.Time
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		runs = []time.Time{}
+		if err := datastore.Get(ctx, key, m); err != nil {
+			return err
+		}
+		if m.Disabled || m.NextRunAt.After(now) {
+			return nil
+		}
+		r, skipped, err := m.DueRuns(now)
+		if err != nil {
+			return err
+		}
+		if len(r) > 0 {
+			m.LastRunAt = r[len(r)-1]
+		}
+		if _, err := datastore.Put(ctx, key, m); err != nil {
+			return err
+		}
+		if len(skipped) > 0 {
+			keys := []*datastore.Key{}
+			records := []*ScheduleRun{}
+			for _, t := range skipped {
+				keys = append(keys, m.runKey(ctx, key, t))
+				records = append(records, &ScheduleRun{ScheduledAt: t, Status: ScheduleRunSkipped, FinishedAt: now})
+			}
+			if _, err := datastore.PutMulti(ctx, keys, records); err != nil {
+				return err
+			}
+		}
+		if len(r) > 0 {
+			if err := post(ctx, r); err != nil {
+				return err
+			}
+		}
+		runs = r
+		return nil
+	}, GetTransactionOptions())
+	if err != nil {
+		log.Errorf(ctx, "Failed to tick Schedule %v because of %v\n", m.ID, err)
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (m *Schedule) runKey(ctx context.Context, key *datastore.Key, scheduledAt time.Time) *datastore.Key {
+	return datastore.NewKey(ctx, "ScheduleRuns", scheduledAt.UTC().Format(time.RFC3339), 0, key)
+}
+
+// Runs returns the run history of the schedule from the latest.
+func (m *Schedule) Runs(ctx context.Context, limit int) ([]*ScheduleRun, error) {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery("ScheduleRuns").Ancestor(key).Order("-ScheduledAt")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	res := []*ScheduleRun{}
+	_, err = q.GetAll(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PipelineName returns the name of the pipeline for the run scheduled at scheduledAt.
+func (m *Schedule) PipelineName(scheduledAt time.Time) (string, error) {
+	loc, err := m.Location()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", m.Name, scheduledAt.In(loc).Format("200601021504")), nil
+}
+
+// BuildJobs returns the Ready jobs for the run scheduled at scheduledAt.
+func (m *Schedule) BuildJobs(scheduledAt time.Time) (Jobs, error) {
+	jobs := Jobs{}
+	if len(m.Jobs) > 0 {
+		if err := json.Unmarshal(m.Jobs, &jobs); err != nil {
+			return nil, err
+		}
+	}
+	if g := m.JobGenerator; g != nil {
+		loc, err := m.Location()
+		if err != nil {
+			return nil, err
+		}
+		local := scheduledAt.In(loc)
+		for i := 1; i <= g.Count; i++ {
+			r := strings.NewReplacer(
+				"%{index}", strconv.Itoa(i),
+				"%{scheduled_at}", local.Format(time.RFC3339),
+				"%{date}", local.Format("2006-01-02"),
+			)
+			attrs := map[string]string{}
+			for k, v := range g.Attributes {
+				attrs[k] = r.Replace(v)
+			}
+			jobs = append(jobs, &Job{
+				IdByClient: r.Replace(g.IdByClient),
+				Message: JobMessage{
+					AttributeMap: attrs,
+					Data:         r.Replace(g.Data),
+				},
+			})
+		}
+	}
+	for _, job := range jobs {
+		job.InitStatus(true)
+	}
+	return jobs, nil
+}
+
+// Run creates the pipeline and its jobs for the run scheduled at scheduledAt and records the result.
+// The run which has already succeeded isn't run again because the task can be retried.
+// The pipeline created by the failed run is reused when it's run again.
+// started is called with the pipeline before the run succeeds. If it fails, the run is left
+// Running and started is called again for the same pipeline when the task is retried.
+func (m *Schedule) Run(ctx context.Context, scheduledAt time.Time, started func(*Pipeline) error) (*ScheduleRun, *Pipeline, error) {
+	key, err := datastore.DecodeKey(m.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	runKey := m.runKey(ctx, key, scheduledAt)
+	run := &ScheduleRun{}
+	err = datastore.Get(ctx, runKey, run)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		run = &ScheduleRun{ScheduledAt: scheduledAt}
+	case err != nil:
+		return nil, nil, err
+	case run.Status == ScheduleRunSucceeded || run.Status == ScheduleRunSkipped:
+		log.Infof(ctx, "Schedule %v run at %v has already been %v\n", m.ID, scheduledAt, run.Status)
+		return run, nil, nil
+	}
+	run.Status = ScheduleRunRunning
+	run.Error = ""
+	run.StartedAt = time.Now()
+
+	fail := func(err error) (*ScheduleRun, *Pipeline, error) {
+		log.Errorf(ctx, "Failed to run Schedule %v at %v because of %v\n", m.ID, scheduledAt, err)
+		run.Status = ScheduleRunFailed
+		run.Error = err.Error()
+		run.FinishedAt = time.Now()
+		if _, putErr := datastore.Put(ctx, runKey, run); putErr != nil {
+			return nil, nil, putErr
+		}
+		return run, nil, err
+	}
+
+	var pl *Pipeline
+	if run.PipelineID != "" {
+		pl, err = m.Organization.PipelineAccessor().Find(ctx, run.PipelineID)
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		pl, err = m.newPipeline(ctx, scheduledAt)
+		if err != nil {
+			return fail(err)
+		}
+		// Record the pipeline in the transaction which creates it
+		// not to create another pipeline when the task is retried.
+		err = pl.CreateWith(ctx, func(ctx context.Context) error {
+			return pl.ReserveOrWait(ctx, func(ctx context.Context) error {
+				if err := pl.PutWithNewKey(ctx); err != nil {
+					return err
+				}
+				run.PipelineID = pl.ID
+				_, err := datastore.Put(ctx, runKey, run)
+				return err
+			})
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	jobs, err := m.BuildJobs(scheduledAt)
+	if err != nil {
+		return fail(err)
+	}
+	msgs := ErrorMessages{}
+	for i, err := range pl.CreateJobs(ctx, jobs) {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("jobs[%d]: %v", i, err))
+		}
+	}
+	run.JobCount = len(jobs) - len(msgs)
+	if len(msgs) > 0 {
+		return fail(msgs.Error())
+	}
+
+	if err := started(pl); err != nil {
+		log.Errorf(ctx, "Failed to start pipeline %v of Schedule %v at %v because of %v\n", pl.ID, m.ID, scheduledAt, err)
+		if _, putErr := datastore.Put(ctx, runKey, run); putErr != nil {
+			return nil, nil, putErr
+		}
+		return nil, nil, err
+	}
+
+	run.Status = ScheduleRunSucceeded
+	run.FinishedAt = time.Now()
+	if _, err := datastore.Put(ctx, runKey, run); err != nil {
+		return nil, nil, err
+	}
+	return run, pl, nil
+}
+
+func (m *Schedule) newPipeline(ctx context.Context, scheduledAt time.Time) (*Pipeline, error) {
+	tmpl, err := m.Organization.PipelineTemplateAccessor().Find(ctx, m.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := tmpl.NewPipeline(ctx, m.TemplateVersion, func(pl *Pipeline) error {
+		if len(m.Pipeline) == 0 {
+			return nil
+		}
+		return json.Unmarshal(m.Pipeline, pl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	name, err := m.PipelineName(scheduledAt)
+	if err != nil {
+		return nil, err
+	}
+	pl.Name = name
+	pl.Organization = m.Organization
+	pl.ScheduleID = m.ID
+	return pl, nil
+}
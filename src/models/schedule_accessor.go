@@ -0,0 +1,110 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+type ScheduleAccessor struct {
+	Parent *Organization
+}
+
+var GlobalScheduleAccessor = &ScheduleAccessor{}
+
+var ErrNoSuchSchedule = errors.New("No such data in Schedules")
+
+func (m *Organization) ScheduleAccessor() *ScheduleAccessor {
+	return &ScheduleAccessor{Parent: m}
+}
+
+func (sa *ScheduleAccessor) Find(ctx context.Context, id string) (*Schedule, error) {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		log.Errorf(ctx, "Failed to decode id(%v) to key because of %v \n", id, err)
+		return nil, ErrNoSuchSchedule
+	}
+	if sa.Parent != nil {
+		parentKey, err := datastore.DecodeKey(sa.Parent.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !parentKey.Equal(key.Parent()) {
+			return nil, &InvalidParent{id}
+		}
+	}
+
+	m := &Schedule{}
+	err = datastore.Get(ctx, key, m)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return nil, ErrNoSuchSchedule
+	case err != nil:
+		log.Errorf(ctx, "Failed to Get schedule key(%v) because of %v \n", key, err)
+		return nil, err
+	}
+	if err := sa.loaded(ctx, key, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (sa *ScheduleAccessor) All(ctx context.Context) ([]*Schedule, error) {
+	q := datastore.NewQuery("Schedules")
+	if sa.Parent != nil {
+		parentKey, err := datastore.DecodeKey(sa.Parent.ID)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Ancestor(parentKey)
+	}
+	return sa.GetByQuery(ctx, q)
+}
+
+// GetDue returns the enabled schedules whose NextRunAt has come at now.
+func (sa *ScheduleAccessor) GetDue(ctx context.Context, now time.Time) ([]*Schedule, error) {
+	q := datastore.NewQuery("Schedules").Filter("Disabled =", false).Filter("NextRunAt <=", now)
+	return sa.GetByQuery(ctx, q)
+}
+
+func (sa *ScheduleAccessor) GetByQuery(ctx context.Context, q *datastore.Query) ([]*Schedule, error) {
+	res := []*Schedule{}
+	keys, err := q.GetAll(ctx, &res)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get schedules because of %v\n", err)
+		return nil, err
+	}
+	for i, m := range res {
+		if err := sa.loaded(ctx, keys[i], m); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (sa *ScheduleAccessor) loaded(ctx context.Context, key *datastore.Key, m *Schedule) error {
+	m.ID = key.Encode()
+	m.Pipeline = json.RawMessage(m.PipelineBody)
+	m.Jobs = json.RawMessage(m.JobsBody)
+	m.JobGenerator = nil
+	if len(m.JobGeneratorBody) > 0 {
+		m.JobGenerator = &JobGenerator{}
+		if err := json.Unmarshal(m.JobGeneratorBody, m.JobGenerator); err != nil {
+			return err
+		}
+	}
+	if sa.Parent != nil {
+		m.Organization = sa.Parent
+		return nil
+	}
+	org, err := GlobalOrganizationAccessor.FindByKey(ctx, key.Parent())
+	if err != nil {
+		return err
+	}
+	m.Organization = org
+	return nil
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/groovenauts/blocks-concurrent-batch-server/src/test_utils"
+)
+
+func TestScheduleDueRuns(t *testing.T) {
+	base := time.Date(2018, 1, 2, 3, 0, 0, 0, time.UTC)
+	hours := func(hs ...int) []time.Time {
+		res := []time.Time{}
+		for _, h := range hs {
+			res = append(res, base.Add(time.Duration(h)*time.Hour))
+		}
+		return res
+	}
+
+	type Pattern struct {
+		catchUp        string
+		maxCatchUpRuns int
+		now            time.Time
+		runs           []time.Time
+		skipped        []time.Time
+	}
+	patterns := []Pattern{
+		// Not yet
+		{CatchUpSkip, 0, base.Add(-time.Minute), []time.Time{}, []time.Time{}},
+		// On time
+		{CatchUpSkip, 0, base.Add(time.Minute), hours(0), []time.Time{}},
+		{CatchUpLatest, 0, base.Add(time.Minute), hours(0), []time.Time{}},
+		{CatchUpAll, 0, base.Add(time.Minute), hours(0), []time.Time{}},
+		// Missed
+		{CatchUpSkip, 0, base.Add(3*time.Hour + 10*time.Minute), []time.Time{}, hours(0, 1, 2, 3)},
+		{CatchUpSkip, 0, base.Add(3*time.Hour + 1*time.Minute), hours(3), hours(0, 1, 2)},
+		{CatchUpLatest, 0, base.Add(3*time.Hour + 10*time.Minute), hours(3), hours(0, 1, 2)},
+		{CatchUpAll, 0, base.Add(3*time.Hour + 10*time.Minute), hours(0, 1, 2, 3), []time.Time{}},
+		{CatchUpAll, 2, base.Add(3*time.Hour + 10*time.Minute), hours(2, 3), hours(0, 1)},
+	}
+	for i, ptn := range patterns {
+		schedule := &Schedule{Cron: "0 * * * *", CatchUp: ptn.catchUp, MaxCatchUpRuns: ptn.maxCatchUpRuns, NextRunAt: base}
+		runs, skipped, err := schedule.DueRuns(ptn.now)
+		if assert.NoError(t, err, "patterns[%d]", i) {
+			assert.Equal(t, ptn.runs, runs, "patterns[%d]", i)
+			assert.Equal(t, ptn.skipped, skipped, "patterns[%d]", i)
+			assert.True(t, schedule.NextRunAt.After(ptn.now), "patterns[%d]", i)
+		}
+	}
+}
+
+func TestScheduleTickAndRun(t *testing.T) {
+	opt := &aetest.Options{StronglyConsistentDatastore: true}
+	inst, err := aetest.NewInstance(opt)
+	assert.NoError(t, err)
+	defer inst.Close()
+
+	req, err := inst.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err) {
+		inst.Close()
+		return
+	}
+	ctx := appengine.NewContext(req)
+
+	for _, k := range []string{"Schedules", "ScheduleRuns", "PipelineTemplates", "PipelineTemplateVersions", "Pipelines", "Jobs", "Organizations"} {
+		test_utils.ClearDatastore(t, ctx, k)
+	}
+
+	org1 := &Organization{Name: "org1", TokenAmount: 10}
+	err = org1.Create(ctx)
+	assert.NoError(t, err)
+
+	tmpl := &PipelineTemplate{
+		Organization: org1,
+		Name:         "nightly",
+		Pipeline: json.RawMessage(`{
+			"project_id": "dummy-proj-999",
+			"zone": "us-central1-f",
+			"boot_disk": {"source_image": "https://www.googleapis.com/compute/v1/projects/cos-cloud/global/images/family/cos-stable"},
+			"machine_type": "f1-micro",
+			"target_size": 1,
+			"container_size": 1,
+			"container_name": "groovenauts/batch_type_iot_example:0.3.1",
+			"token_consumption": 1
+		}`),
+	}
+	err = tmpl.Create(ctx)
+	assert.NoError(t, err)
+
+	// Invalid schedules
+	schedule := &Schedule{
+		Organization: org1,
+		Name:         "nightly",
+		Cron:         "0 3 * * *",
+		TimeZone:     "Asia/Tokyo",
+		TemplateID:   tmpl.ID,
+	}
+	err = schedule.Create(ctx)
+	_, ok := err.(*InvalidOperation)
+	assert.True(t, ok)
+
+	schedule.JobGenerator = &JobGenerator{
+		Count:      3,
+		IdByClient: "%{date}-%{index}",
+		Attributes: map[string]string{"date": "%{date}"},
+	}
+	for _, f := range []func(*Schedule){
+		func(s *Schedule) { s.Cron = "0 3 * *" },
+		func(s *Schedule) { s.Cron = "0 0 30 2 *" },
+		func(s *Schedule) { s.TimeZone = "Unknown/Zone" },
+		func(s *Schedule) { s.Name = "Nightly" },
+		func(s *Schedule) { s.CatchUp = "unknown" },
+		func(s *Schedule) { s.TemplateID = org1.ID },
+	} {
+		invalid := *schedule
+		f(&invalid)
+		err = invalid.Create(ctx)
+		_, ok := err.(*InvalidOperation)
+		assert.True(t, ok)
+	}
+
+	// Create
+	schedule.Pipeline = json.RawMessage(`{"target_size": 2}`)
+	err = schedule.Create(ctx)
+	assert.NoError(t, err)
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(t, err)
+	next := schedule.NextRunAt.In(jst)
+	assert.Equal(t, 3, next.Hour())
+	assert.Equal(t, 0, next.Minute())
+
+	found, err := org1.ScheduleAccessor().Find(ctx, schedule.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, found.JobGenerator.Count)
+
+	// Tick
+	scheduledAt := time.Date(2018, 1, 2, 3, 0, 0, 0, jst)
+	found.NextRunAt = scheduledAt
+	err = found.put(ctx)
+	assert.NoError(t, err)
+
+	due, err := GlobalScheduleAccessor.GetDue(ctx, scheduledAt.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(due))
+
+	now := scheduledAt.Add(time.Minute)
+	due, err = GlobalScheduleAccessor.GetDue(ctx, now)
+	assert.NoError(t, err)
+	if !assert.Equal(t, 1, len(due)) {
+		return
+	}
+	assert.Equal(t, org1.ID, due[0].Organization.ID)
+
+	// Failing to post the runs doesn't advance the schedule
+	_, err = due[0].Tick(ctx, now, func(ctx context.Context, runs []time.Time) error {
+		return fmt.Errorf("Dummy error")
+	})
+	assert.Error(t, err)
+	reloaded, err := GlobalScheduleAccessor.Find(ctx, due[0].ID)
+	assert.NoError(t, err)
+	assert.True(t, scheduledAt.Equal(reloaded.NextRunAt))
+
+	posted := []time.Time{}
+	post := func(ctx context.Context, runs []time.Time) error {
+		posted = append(posted, runs...)
+		return nil
+	}
+	runs, err := due[0].Tick(ctx, now, post)
+	assert.NoError(t, err)
+	if !assert.Equal(t, 1, len(runs)) {
+		return
+	}
+	assert.True(t, scheduledAt.Equal(runs[0]))
+	assert.Equal(t, runs, posted)
+	assert.True(t, due[0].NextRunAt.Equal(scheduledAt.AddDate(0, 0, 1)))
+
+	// Tick again does nothing
+	runs, err = due[0].Tick(ctx, now, post)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(runs))
+	assert.Equal(t, 1, len(posted))
+
+	// Failing to start the pipeline leaves the run Running with the pipeline
+	startedPipelines := []string{}
+	run, pl, err := due[0].Run(ctx, scheduledAt, func(pl *Pipeline) error {
+		startedPipelines = append(startedPipelines, pl.ID)
+		return fmt.Errorf("Dummy error")
+	})
+	assert.Error(t, err)
+	assert.Nil(t, run)
+	history, err := due[0].Runs(ctx, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(history)) {
+		assert.Equal(t, ScheduleRunRunning, history[0].Status)
+		assert.Equal(t, []string{history[0].PipelineID}, startedPipelines)
+	}
+
+	// Run again with the same pipeline
+	run, pl, err = due[0].Run(ctx, scheduledAt, func(pl *Pipeline) error {
+		startedPipelines = append(startedPipelines, pl.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleRunSucceeded, run.Status)
+	assert.Equal(t, 3, run.JobCount)
+	if assert.NotNil(t, pl) {
+		assert.Equal(t, "nightly-201801020300", pl.Name)
+		assert.Equal(t, 2, pl.TargetSize)
+		assert.Equal(t, Reserved, pl.Status)
+		assert.Equal(t, schedule.ID, pl.ScheduleID)
+		assert.Equal(t, tmpl.ID, pl.PipelineTemplateID)
+		assert.Equal(t, pl.ID, run.PipelineID)
+		assert.Equal(t, []string{pl.ID, pl.ID}, startedPipelines)
+
+		jobs, err := pl.JobAccessor().All(ctx)
+		assert.NoError(t, err)
+		if assert.Equal(t, 3, len(jobs)) {
+			for _, job := range jobs {
+				assert.Equal(t, Ready, job.Status)
+				assert.Regexp(t, `\A2018-01-02-[1-3]\z`, job.IdByClient)
+			}
+		}
+	}
+
+	// The succeeded run isn't run again
+	run, pl, err = due[0].Run(ctx, scheduledAt, func(pl *Pipeline) error {
+		startedPipelines = append(startedPipelines, pl.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleRunSucceeded, run.Status)
+	assert.Nil(t, pl)
+	assert.Equal(t, 2, len(startedPipelines))
+
+	history, err = due[0].Runs(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(history))
+
+	// Destroy
+	err = due[0].Destroy(ctx)
+	assert.NoError(t, err)
+	_, err = org1.ScheduleAccessor().Find(ctx, schedule.ID)
+	assert.Equal(t, ErrNoSuchSchedule, err)
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// SubscribeHeartbeat is put by each subscribe_task to tell that its chain is alive.
+// A chain is the series of subscribe_task which posts the next one, and is identified
+// by the name of the first task. It's a root entity not to write the entity group of the organization.
+type SubscribeHeartbeat struct {
+	PipelineID string    `datastore:"pipeline_id"`
+	BeatAt     time.Time `datastore:"beat_at"`
+}
+
+// BeatSubscribe puts the heartbeat of the subscribe_task chain.
+func (m *Pipeline) BeatSubscribe(ctx context.Context, chain string, t time.Time) error {
+	key := datastore.NewKey(ctx, "SubscribeHeartbeats", chain, 0, nil)
+	_, err := datastore.Put(ctx, key, &SubscribeHeartbeat{PipelineID: m.ID, BeatAt: t})
+	if err != nil {
+		log.Warningf(ctx, "Failed to put SubscribeHeartbeat %v of %v because of %v\n", chain, m.ID, err)
+		return err
+	}
+	return nil
+}
+
+// StopSubscribeHeartbeat deletes the heartbeat of the subscribe_task chain which is ending.
+func (m *Pipeline) StopSubscribeHeartbeat(ctx context.Context, chain string) error {
+	key := datastore.NewKey(ctx, "SubscribeHeartbeats", chain, 0, nil)
+	err := datastore.Delete(ctx, key)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(ctx, "Failed to delete SubscribeHeartbeat %v of %v because of %v\n", chain, m.ID, err)
+		return err
+	}
+	return nil
+}
+
+// LiveSubscribeChains returns the number of the subscribe_task chains which beat after since.
+func (m *Pipeline) LiveSubscribeChains(ctx context.Context, since time.Time) (int, error) {
+	q := datastore.NewQuery("SubscribeHeartbeats").Filter("pipeline_id =", m.ID)
+	heartbeats := []*SubscribeHeartbeat{}
+	_, err := q.GetAll(ctx, &heartbeats)
+	if err != nil {
+		return 0, err
+	}
+	r := 0
+	for _, hb := range heartbeats {
+		if !hb.BeatAt.Before(since) {
+			r++
+		}
+	}
+	return r, nil
+}
+
+// DeleteStaleSubscribeHeartbeats deletes the heartbeats of the chains which stopped without deleting them.
+func DeleteStaleSubscribeHeartbeats(ctx context.Context, before time.Time) (int, error) {
+	q := datastore.NewQuery("SubscribeHeartbeats").Filter("beat_at <", before).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	err = datastore.DeleteMulti(ctx, keys)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
@@ -6,3 +6,17 @@ func Int64WithDefault(val, defaultValue int64) int64 {
 	}
 	return val
 }
+
+func IntWithDefault(val, defaultValue int) int {
+	if val == 0 {
+		return defaultValue
+	}
+	return val
+}
+
+func StringWithDefault(val, defaultValue string) string {
+	if val == "" {
+		return defaultValue
+	}
+	return val
+}